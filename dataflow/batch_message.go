@@ -14,4 +14,51 @@ type BatchMessage struct {
 	SourceIndex int
 	// Batch of records to be processed
 	Records *[]*Record
+	// Partition that sent the message (set by exchange operators)
+	SourcePartition uint64
+	// Set if the message asks the partition to answer an upquery for a
+	// partially materialized view, rather than to process @Records
+	Upquery *UpqueryRequest
+	// Set if @Records are the response to an upquery
+	Replay *ReplayResponse
+	// Ticket of the DataflowEngine.Process call that caused the message (nil
+	// for upqueries and their responses)
+	Ticket *Ticket
+	// Tickets of the batches coalesced into the message besides @Ticket
+	// (refer exchange.go)
+	coalesced []*Ticket
+	// Node that the message's ticket accounts it at (refer progress.go)
+	location int
+	// Set if the message changes the graph (refer migration.go)
+	migration *migrationStep
+	// Set if the message runs a task on the partition's goroutine (refer
+	// rescale.go)
+	task func(graph *Graph) error
+}
+
+// Returns the tickets that account for the message
+func (msg *BatchMessage) tickets() []*Ticket {
+	if msg.Ticket == nil {
+		return nil
+	}
+	return append([]*Ticket{msg.Ticket}, msg.coalesced...)
+}
+
+// Makes @ticket account for the message (at its location), unless it already
+// does; must be invoked before the message is sent
+func (msg *BatchMessage) attach(ticket *Ticket) {
+	if ticket == nil {
+		return
+	}
+	if msg.Ticket == nil {
+		msg.Ticket = ticket
+	} else {
+		for _, attached := range msg.tickets() {
+			if attached == ticket {
+				return
+			}
+		}
+		msg.coalesced = append(msg.coalesced, ticket)
+	}
+	ticket.add(msg.location)
 }
@@ -0,0 +1,215 @@
+package dataflow
+
+// The planner chooses how the records of a join's parents reach the join by
+// the records it estimates to be sent across partitions (from statistics,
+// refer stats.go), per record that the engine's inputs hold:
+// (a) Hash partitioning both sides by the join key sends the records of every
+// side that is not partitioned by it yet through an exchange, i.e. a share of
+// (n-1)/n of them for n partitions. Sides whose partitioning is undecided are
+// partitioned at the inputs instead, which sends nothing. A side's most
+// frequent key overloads the partition that owns it, which is accounted as the
+// records that partition holds beyond its share.
+// (b) Broadcasting a side sends each of its records to the other n-1
+// partitions, while the other side's records stay wherever they are, i.e.
+// that side must already be partitioned. Every partition then joins its share
+// of the other side with the whole broadcast side, hence each match is
+// emitted exactly once, and the join's output is partitioned as the other
+// side is.
+// Broadcasting hence pays off for small sides (e.g. dimension tables) joined
+// with large ones that are partitioned by another column. Ties go to hash
+// partitioning, which is what an engine without statistics always chooses.
+// A broadcast side whose partitioning is undecided is replicated at its inputs
+// (whose updates then reach every partition) rather than by an exchange.
+// Inputs may also be broadcast from the start (refer BroadcastInput), in which
+// case a side that they feed is always broadcast, since that sends nothing,
+// unless the other side is replicated too. The other side is then partitioned
+// by the join key if its partitioning is undecided.
+
+// Rows assumed for inputs that have no statistics
+const defaultRows = 1 << 20
+
+// What the planner estimates costs from
+type costModel struct {
+	statistics *Statistics
+	partitions uint64
+}
+
+func (engine *DataflowEngine) costModel() costModel {
+	return costModel{
+		statistics: engine.statistics,
+		partitions: engine.partitionCount,
+	}
+}
+
+// A side of a join broadcast to every partition
+type broadcastJoin struct {
+	replicated JoinSide
+	// Partitioning of the other side's records, in terms of that side's schema
+	// (by which rescaling places them, refer EquiJoinOperator.collectState),
+	// and of the join's output
+	local  partitioning
+	output partitioning
+	// Estimated records sent across partitions when broadcasting, and when
+	// hash partitioning instead
+	cost     float64
+	hashCost float64
+}
+
+// What the planner knows of the records that a parent sends to an operator
+type edgeEstimate struct {
+	current partitioning
+	rows    float64
+	// Share of the rows that hold the most frequent value of the column the
+	// operator requires them partitioned by (0 if unknown)
+	share float64
+}
+
+// Returns the parents of a node that is being planned
+type parentsFunc func(node Operator) []Operator
+
+func graphParents(node Operator) []Operator {
+	return node.GetCore().GetParents()
+}
+
+// Estimates the records that @parent sends to an operator that requires them
+// partitioned by @column
+func (model costModel) estimateEdge(parent Operator, column uint64, current partitioning, parentsOf parentsFunc) edgeEstimate {
+	return edgeEstimate{
+		current: current,
+		rows:    model.estimateRows(parent, parentsOf),
+		share:   model.keyShare(parent, column, parentsOf),
+	}
+}
+
+// Returns the number of records that @node emits, as estimated from the
+// statistics of the inputs upstream of it. Filters are assumed to keep every
+// record, and joins to emit a record for each record of their larger side.
+func (model costModel) estimateRows(node Operator, parentsOf parentsFunc) float64 {
+	if input, ok := node.(*InputOperator); ok {
+		if stats, ok := model.statistics.input(input.GetName()); ok {
+			return float64(stats.Rows)
+		}
+		return defaultRows
+	}
+	var rows float64
+	for _, parent := range parentsOf(node) {
+		if parentRows := model.estimateRows(parent, parentsOf); parentRows > rows {
+			rows = parentRows
+		}
+	}
+	return rows
+}
+
+// Returns the share of the records emitted by @node that hold the most
+// frequent value of @column (0 if unknown)
+func (model costModel) keyShare(node Operator, column uint64, parentsOf parentsFunc) float64 {
+	switch op := node.(type) {
+	case *InputOperator:
+		stats, ok := model.statistics.input(op.GetName())
+		if !ok || stats.Rows == 0 || column >= uint64(len(stats.Columns)) {
+			return 0
+		}
+		return float64(stats.Columns[column].MaxFrequency) / float64(stats.Rows)
+	case *FilterOperator:
+		return model.keyShare(parentsOf(node)[0], column, parentsOf)
+	case *ProjectOperator:
+		if column >= uint64(len(op.cids)) {
+			return 0
+		}
+		return model.keyShare(parentsOf(node)[0], op.cids[column], parentsOf)
+	case *EquiJoinOperator:
+		stats, ok := model.statistics.operator(op.GetCore().GetIndex())
+		if !ok || stats.Rows == 0 || column != op.leftID {
+			return 0
+		}
+		return float64(stats.MaxKeyRows) / float64(stats.Rows)
+	}
+	return 0
+}
+
+func (stats *Statistics) input(name string) (*InputStatistics, bool) {
+	if stats == nil {
+		return nil, false
+	}
+	input, ok := stats.Inputs[name]
+	return input, ok && input != nil
+}
+
+func (stats *Statistics) operator(index int) (*OperatorStatistics, bool) {
+	if stats == nil {
+		return nil, false
+	}
+	operator, ok := stats.Operators[index]
+	return operator, ok && operator != nil
+}
+
+// Returns the side of @join to broadcast, or nil if both sides are to be hash
+// partitioned by the join key (refer the top of the file). @edges are the
+// estimates of the left and right sides, and @leftWidth is the width of the
+// left side's schema.
+func (model costModel) chooseJoinStrategy(join *EquiJoinOperator, edges []edgeEstimate, leftWidth uint64) *broadcastJoin {
+	n := float64(model.partitions)
+	required := requiredPartitioning(join)
+	var hashCost float64
+	for side, edge := range edges {
+		// Replicated records are partitioned without being sent
+		if edge.current.decided && !edge.current.replicated && !edge.current.satisfies(required[side]) {
+			hashCost += edge.rows * (n - 1) / n
+		}
+		if edge.share > 1/n {
+			hashCost += edge.rows * (edge.share - 1/n)
+		}
+	}
+	var chosen *broadcastJoin
+	for _, replicated := range []JoinSide{RightSide, LeftSide} {
+		local := edges[1-replicated].current
+		if local.replicated {
+			continue
+		}
+		if edges[replicated].current.replicated {
+			if !local.decided {
+				local = keyedBy(required[1-replicated])
+			}
+			return &broadcastJoin{
+				replicated: replicated,
+				local:      local,
+				output:     join.mapLocalPartitioning(replicated, local, leftWidth),
+				hashCost:   hashCost,
+			}
+		}
+		if !local.decided {
+			continue
+		}
+		cost := edges[replicated].rows * (n - 1)
+		if cost >= hashCost || (chosen != nil && cost >= chosen.cost) {
+			continue
+		}
+		chosen = &broadcastJoin{
+			replicated: replicated,
+			local:      local,
+			output:     join.mapLocalPartitioning(replicated, local, leftWidth),
+			cost:       cost,
+			hashCost:   hashCost,
+		}
+	}
+	return chosen
+}
+
+// Returns the partitioning of the join's output when @replicated is
+// broadcast, and the other side is partitioned as @local
+func (op *EquiJoinOperator) mapLocalPartitioning(replicated JoinSide, local partitioning, leftWidth uint64) partitioning {
+	if replicated == RightSide || !local.keyed {
+		// The left side's columns keep their positions in the output
+		return local
+	}
+	// The right join column is not emitted, but holds the left one's value
+	// (refer emitRecord)
+	switch {
+	case local.column == op.rightID:
+		return keyedBy(op.leftID)
+	case local.column < op.rightID:
+		return keyedBy(leftWidth + local.column)
+	default:
+		return keyedBy(leftWidth + local.column - 1)
+	}
+}
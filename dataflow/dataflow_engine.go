@@ -1,231 +1,335 @@
 package dataflow
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
 
 type DataflowEngine struct {
+	// Graph the engine was created with, and a copy of it once started (refer
+	// planner.go)
 	baseGraph      *Graph
 	partitionCount uint64
 	graphs         map[uint64]*Graph
-	graphChans     map[uint64]chan *BatchMessage
-	killChans      map[uint64]chan bool
-	inputPartition map[string]uint64
+	// Senders' ends of the partitions' mailboxes
+	graphChans map[uint64]chan *BatchMessage
+	mailboxes  map[uint64]*mailbox
+	killChans  map[uint64]chan bool
+	// Plan that the partitions run (refer planner.go)
+	plan *physicalPlan
+	// Engine-wide memory budget (nil if unbounded)
+	memoryBudget *MemoryBudget
+	// Runs the partitions' operators as pipeline stages (refer pipeline.go)
+	pipelined bool
+	// Rewrites the graph before planning (refer optimizer.go)
+	optimized bool
+	// Set if exchanges coalesce the batches they send (refer exchange.go)
+	coalescing *coalescing
+	// Copies of the operators of the graph the engine was created with
+	copies map[Operator]Operator
+	// Operators passed to the engine that were merged into another one, which
+	// computes the same records (refer optimizer.go and planMigration)
+	shared map[Operator]Operator
+	// Renumbering of the output columns of the operators whose columns the
+	// optimizer renumbered, from those of the graph the engine was created
+	// with (refer translateColumns)
+	renumbered map[Operator]map[uint64]uint64
+	// Inputs to replicate to every partition, by name (refer BroadcastInput)
+	broadcastInputs map[string]bool
+	// Statistics that the planner estimates costs from (refer stats.go); nil
+	// if there are none
+	statistics *Statistics
+	tickets    *ticketTracker
+	flow       *flowControl
+	progress   *progressTracker
+	lifecycle  *lifecycle
+	// Exchanges inserted by the planner; their listeners are launched once
+	// planning succeeds
+	exchanges []*ExchangeOperator
+	// Routers of the inputs, by name (refer skew.go)
+	routers map[string]*router
+	// Keys split by inputs and exchanges
+	splitKeys map[routedKey]bool
+	// Nodes that route split keys to joins, and the joins (by index)
+	splitNodes map[int]bool
+	splitJoins map[int]bool
+	// Guards @stopped; held for reading while Process sends batches
+	stateMu sync.RWMutex
+	stopped bool
+	// Serializes migrations
+	migrateMu sync.Mutex
+	// Held for writing while migrations modify the partitions' graphs, and for
+	// reading by accessors that look up their nodes
+	topologyMu sync.RWMutex
 }
 
 func NewDataflowEngine(partitionCount uint64, graph *Graph) *DataflowEngine {
+	flow := newFlowControl(DefaultFlowCapacity)
+	progress := newProgressTracker()
 	return &DataflowEngine{
-		baseGraph:      graph,
-		partitionCount: partitionCount,
-		graphs:         make(map[uint64]*Graph),
-		graphChans:     make(map[uint64]chan *BatchMessage),
-		killChans:      make(map[uint64]chan bool),
-		inputPartition: make(map[string]uint64),
+		baseGraph:       graph,
+		partitionCount:  partitionCount,
+		graphs:          make(map[uint64]*Graph),
+		graphChans:      make(map[uint64]chan *BatchMessage),
+		mailboxes:       make(map[uint64]*mailbox),
+		killChans:       make(map[uint64]chan bool),
+		plan:            newPhysicalPlan(),
+		copies:          make(map[Operator]Operator),
+		tickets:         newTicketTracker(flow, progress),
+		flow:            flow,
+		progress:        progress,
+		lifecycle:       newLifecycle(),
+		shared:          make(map[Operator]Operator),
+		broadcastInputs: make(map[string]bool),
 	}
 }
 
-func (engine *DataflowEngine) StartEngine() {
+// Returns an error (without launching anything) if the graph can't be
+// partitioned
+func (engine *DataflowEngine) StartEngine() error {
+	engine.copyGraph()
+	if engine.optimized {
+		engine.shared, engine.renumbered = engine.baseGraph.optimize()
+	}
+	plan, err := newPlanner(engine.baseGraph, engine.costModel(), engine.broadcastInputs).planGraph()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[ENGINE] Traversal of base graph complete.\n")
 	// Clone and establish channels for communicating with graphs
+	engine.makeMailboxes()
+	engine.instantiate(plan)
+	if err := engine.checkPartitioning(engine.graphs[0]); err != nil {
+		return err
+	}
+	engine.progress.computeUpstream(engine.graphs[0])
+	fmt.Printf("[ENGINE] Input Operators to be partitioned by: %v\n", engine.plan.inputPartition)
+	engine.makeRouters()
+	engine.launch()
+	fmt.Printf("[ENGINE] Launched graphs in go routines.\n")
+	return nil
+}
+
+func (engine *DataflowEngine) makeMailboxes() {
 	var i uint64
 	for i = 0; i < engine.partitionCount; i++ {
-		engine.graphs[i] = engine.baseGraph.Clone(i)
-		engine.graphChans[i] = make(chan *BatchMessage)
+		engine.mailboxes[i] = newMailbox()
+		engine.graphChans[i] = engine.mailboxes[i].in
 		engine.killChans[i] = make(chan bool)
-		fmt.Printf("[ENGINE] Cloned: Graph%d\n", i)
 	}
-	engine.traverseBaseGraph()
-	fmt.Printf("[ENGINE] Traversal of base graph complete.\n")
-	fmt.Printf("[ENGINE] Input Operators to be partitioned by: %v\n", engine.inputPartition)
-	// Launch goroutines
+}
+
+// Makes @graph the graph run by partition @i
+func (engine *DataflowEngine) attachGraph(i uint64, graph *Graph) {
+	engine.graphs[i] = graph
+	graph.inbox = engine.graphChans[i]
+	graph.lifecycle = engine.lifecycle
+	graph.progress = engine.progress
+	graph.setMemoryBudget(engine.memoryBudget)
+	graph.pipelined = engine.pipelined
+}
+
+// Launches the goroutines of the partitions, i.e. their mailboxes, the
+// exchanges' listeners and the partitions themselves
+func (engine *DataflowEngine) launch() {
+	for _, box := range engine.mailboxes {
+		box := box
+		engine.lifecycle.mailboxes.Add(1)
+		go func() {
+			defer engine.lifecycle.mailboxes.Done()
+			box.run(engine.lifecycle)
+		}()
+	}
+	for _, exchangeOp := range engine.exchanges {
+		engine.launchExchange(exchangeOp)
+	}
 	for k := range engine.graphs {
-		go engine.graphs[k].Start(engine.graphChans[k], engine.killChans[k])
+		graph, msgChan, killChan := engine.graphs[k], engine.mailboxes[k].out, engine.killChans[k]
+		engine.lifecycle.partitions.Add(1)
+		go func() {
+			defer engine.lifecycle.partitions.Done()
+			graph.Start(msgChan, killChan)
+		}()
 	}
-	fmt.Printf("[ENGINE] Launched graphs in go routines.\n")
 }
 
-func (engine *DataflowEngine) Process(inputName string, records *[]*Record) {
-	var recordsByPartition map[uint64]*[]*Record
-	if partitionColumn, ok := engine.inputPartition[inputName]; ok {
-		recordsByPartition = engine.partitionRecords(records, partitionColumn)
-	} else {
-		// By default partition by 0th column; in pelton this would translate to
-		// partitioning by record's key
-		recordsByPartition = engine.partitionRecords(records, 0)
+// Sends @records to the partitions and returns without waiting for them to be
+// processed. The returned ticket can be used to wait for that, and reports the
+// batches that failed in any partition. Batches for unknown inputs and batches
+// with malformed records are rejected as a whole, without a ticket. Blocks
+// while the engine is at its flow capacity (refer flow.go).
+func (engine *DataflowEngine) Process(inputName string, records *[]*Record) (*Ticket, error) {
+	return engine.ProcessContext(context.Background(), inputName, records)
+}
+
+// Same as Process, but gives up waiting for flow capacity once @ctx expires
+func (engine *DataflowEngine) ProcessContext(ctx context.Context, inputName string, records *[]*Record) (*Ticket, error) {
+	engine.stateMu.RLock()
+	defer engine.stateMu.RUnlock()
+	if engine.stopped {
+		return nil, ErrEngineStopped
 	}
+	input, ok := engine.baseGraph.inputs[inputName]
+	if !ok {
+		return nil, &ProcessError{NodeIndex: -1, InputName: inputName, Err: ErrUnknownInput}
+	}
+	// Partitioning reads the records, hence they are validated beforehand
+	if err := input.Validate(*records); err != nil {
+		return nil, &ProcessError{NodeIndex: input.GetCore().GetIndex(), Type: INPUT, InputName: inputName, Err: err}
+	}
+	recordsByPartition := engine.routers[inputName].route(records)
+	credits, err := engine.flow.acquire(ctx, int64(len(*records)), engine.lifecycle.done)
+	if err != nil {
+		return nil, err
+	}
+	ticket := engine.tickets.issue(credits)
 	// Send records to appropriate partitions
 	for k := range recordsByPartition {
 		fmt.Printf("[ENGINE] Sending batch of %d record(s) to partition %d\n", len(*recordsByPartition[k]), k)
-		engine.graphChans[k] <- &BatchMessage{
+		location := input.GetCore().GetIndex()
+		ticket.add(location)
+		engine.lifecycle.send(engine.graphChans[k], &BatchMessage{
 			InputName:  inputName,
 			EntryIndex: -1,
 			Records:    recordsByPartition[k],
-		}
+			Ticket:     ticket,
+			location:   location,
+		})
 	}
+	ticket.release(engineLocation)
+	return ticket, nil
 }
 
-func (engine *DataflowEngine) GetOutput(partition uint64) *MatViewOperator {
-	return engine.graphs[partition].GetOutputs()[0]
+// Same as Process, but blocks until @records are reflected in every output
+func (engine *DataflowEngine) ProcessSync(inputName string, records *[]*Record) error {
+	ticket, err := engine.Process(inputName, records)
+	if err != nil {
+		return err
+	}
+	return ticket.Wait()
 }
 
-func (engine *DataflowEngine) partitionRecords(records *[]*Record, partitionColumn uint64) map[uint64]*[]*Record {
-	// Performs a modulous parition; in pelton we can use a hash based one
-	recordsByPartition := make(map[uint64]*[]*Record)
-	for _, record := range *records {
-		value := record.GetValue(partitionColumn)
-		partition := value % engine.partitionCount
-		if _, ok := recordsByPartition[partition]; ok {
-			*recordsByPartition[partition] = append(*recordsByPartition[partition], record)
-		} else {
-			tempRecords := make([]*Record, 1)
-			recordsByPartition[partition] = &tempRecords
-			(*recordsByPartition[partition])[0] = record
-		}
-	}
-	return recordsByPartition
+// Blocks until every batch passed to Process before the call is reflected in
+// every output. Returns the error of the first of them that failed.
+func (engine *DataflowEngine) Flush() error {
+	return engine.tickets.flush()
 }
 
-func (engine *DataflowEngine) traverseBaseGraph() {
-	for _, op := range engine.baseGraph.GetInputs() {
-		if op.GetCore().IsVisited {
-			fmt.Printf("Visited Node: %d of type %d", op.GetCore().GetIndex(), op.GetCore().GetIndex())
-			continue
-		}
-		engine.visitNode(op)
-	}
-}
-
-func (engine *DataflowEngine) visitNode(node Operator) {
-	if node.GetCore().IsVisited {
-		return
-	}
-	fmt.Printf("[VISIT] Node: %d of Type: %d\n", node.GetCore().GetIndex(), node.GetCore().opType)
-	node.GetCore().IsVisited = true
-	switch node.(type) {
-	case *InputOperator:
-		// The initial partitioning column will be decided later (based on join
-		// matview... etc). An input operator by default is partitioned by 0th column.
-		// (semantically could be partitioned by the record key as well)
-		engine.visitNode(node.GetCore().GetChildren()[0])
-	case *FilterOperator:
-		engine.visitNode(node.GetCore().GetChildren()[0])
-	case *ProjectOperator:
-		// These operators don't require any shuffle
-		engine.visitNode(node.GetCore().GetChildren()[0])
-		return
-	case *MatViewOperator:
-		isPartitioned, _ := engine.getRecentPartition(node, false)
-		if !isPartitioned {
-			// Simply employ paritioning at the input; no exchange operator is needed
-			for _, inputOp := range engine.baseGraph.GetInputs() {
-				// There could be multiple inputs because of a union, nevertheless they
-				// all will be partitioned by the same column
-				engine.inputPartition[inputOp.GetName()] = node.(*MatViewOperator).GetKey()
-			}
-		} else {
-			// Needs an exchange operator
-			engine.addExchangeAfter(node.GetCore().GetParents()[0], node.(*MatViewOperator).GetKey())
-		}
-		return
-	case *EquiJoinOperator:
-		fmt.Printf("[VISIT] EquiJoin\n")
-		leftOp := node.(*EquiJoinOperator).GetCore().GetParents()[0]
-		rightOp := node.(*EquiJoinOperator).GetCore().GetParents()[1]
-		isLeftPartitioned, _ := engine.getRecentPartition(leftOp, true)
-		isRightPartitioned, _ := engine.getRecentPartition(rightOp, true)
-		if !isLeftPartitioned && !isRightPartitioned {
-			// Records to be partitioned at the relevant input operators; no exchange
-			// operator is needed
-			leftSubgraphInputs := engine.getSubgraphInputs(leftOp)
-			rightSubgraphInputs := engine.getSubgraphInputs(rightOp)
-			// All left inputs must be partitioned by the same column
-			for _, leftInput := range leftSubgraphInputs {
-				engine.inputPartition[leftInput.GetName()] = node.(*EquiJoinOperator).GetLeftPartitionColumn()
-			}
-			// All right inputs must be partitioned by the same column
-			for _, rightInput := range rightSubgraphInputs {
-				engine.inputPartition[rightInput.GetName()] = node.(*EquiJoinOperator).GetRightPartitionColumn()
-			}
-		} else if !isLeftPartitioned {
-			// For left: partition at input, for right: add exchange operator
-			leftInputs := engine.getSubgraphInputs(leftOp)
-			for _, inputOp := range leftInputs {
-				engine.inputPartition[inputOp.GetName()] = node.(*EquiJoinOperator).GetLeftPartitionColumn()
-			}
-			engine.addExchangeAfter(rightOp, node.(*EquiJoinOperator).GetRightPartitionColumn())
-		} else if !isRightPartitioned {
-			// For right: partition at input, for left: add exchange operator
-			rightInputs := engine.getSubgraphInputs(rightOp)
-			for _, inputOp := range rightInputs {
-				engine.inputPartition[inputOp.GetName()] = node.(*EquiJoinOperator).GetRightPartitionColumn()
-			}
-			engine.addExchangeAfter(leftOp, node.(*EquiJoinOperator).GetLeftPartitionColumn())
-		} else {
-			// Needs exchange for both parents
-			engine.addExchangeAfter(rightOp, node.(*EquiJoinOperator).GetRightPartitionColumn())
-			engine.addExchangeAfter(leftOp, node.(*EquiJoinOperator).GetLeftPartitionColumn())
-		}
-		engine.visitNode(node.GetCore().GetChildren()[0])
-		return
-	default:
-		fmt.Printf("Type: %d\n", node.GetCore().opType)
-		panic("Unsupported operator")
+// Bounds the memory used by the state of all operators across partitions,
+// except for the base state of inputs (refer MemoryBudget).
+// Must be invoked before the engine is started.
+func (engine *DataflowEngine) SetMemoryBudget(limit int64) {
+	engine.memoryBudget = NewMemoryBudget(limit)
+}
+
+// Runs the operators of every partition as pipeline stages on separate
+// goroutines (refer pipeline.go). Must be invoked before the engine is started.
+func (engine *DataflowEngine) SetPipelined(pipelined bool) {
+	engine.pipelined = pipelined
+}
+
+// Rewrites the graph into an equivalent one before it is planned (refer
+// optimizer.go). Disabled by default, since the rewrites may renumber the
+// columns of the graph's operators. Must be invoked before the engine is
+// started.
+func (engine *DataflowEngine) SetLogicalOptimization(enabled bool) {
+	engine.optimized = enabled
+}
+
+// Replicates the input named @name to every partition rather than
+// partitioning it, e.g. a small dimension table, which joins then broadcast
+// instead of shuffling their other side (refer cost.go). Without the hint, the
+// planner broadcasts inputs that its statistics find small enough. Must be
+// invoked before the engine is started.
+func (engine *DataflowEngine) BroadcastInput(name string) {
+	engine.broadcastInputs[name] = true
+}
+
+// Returns the operator of the engine's graph that stands for @node: its copy
+// if @node is an operator of the graph the engine was created with, and the
+// operator that computes its records in its place if it was merged into
+// another one (@node itself otherwise)
+func (engine *DataflowEngine) resolve(node Operator) Operator {
+	if copy, ok := engine.copies[node]; ok {
+		node = copy
+	}
+	if same, ok := engine.shared[node]; ok {
+		return same
 	}
+	return node
 }
 
-func (engine *DataflowEngine) getRecentPartition(node Operator, checkSelf bool) (bool, uint64) {
-	if checkSelf {
-		if _, ok := node.(*InputOperator); ok {
-			if _, ok := engine.inputPartition[node.(*InputOperator).GetName()]; ok {
-				return true, engine.inputPartition[node.(*InputOperator).GetName()]
+func (engine *DataflowEngine) GetMemoryReport() *MemoryReport {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	report := &MemoryReport{}
+	if engine.memoryBudget != nil {
+		report.Budget = engine.memoryBudget.GetLimit()
+	}
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		graph := engine.graphs[i]
+		for _, node := range graph.nodes {
+			if usage, ok := node.GetCore().GetMemoryUsage(); ok {
+				report.Operators = append(report.Operators, usage)
+				if node.GetCore().memory.retained {
+					report.BaseBytes += usage.Bytes
+				} else {
+					report.TotalBytes += usage.Bytes
+				}
 			}
-			return false, 0
-		}
-		// Else, check recursively until a partition boundary is encountered.
-		// Reuse this existing method; start checking from one level lower (since
-		// @node has to also be checked)
-		return engine.getRecentPartition(node.GetCore().GetChildren()[0], false)
-	}
-	// Possibility of multiple parents here?
-	// ->There will be the case with union op as a consequence of
-	// fork join (which is currently not supported)
-	parent := node.GetCore().GetParents()[0]
-	switch parent.(type) {
-	case *FilterOperator:
-	case *ProjectOperator:
-		return engine.getRecentPartition(parent, false)
-	case *InputOperator:
-		if _, ok := engine.inputPartition[parent.(*InputOperator).GetName()]; ok {
-			return true, engine.inputPartition[parent.(*InputOperator).GetName()]
 		}
-		return false, 0
-	case *EquiJoinOperator:
-		// Equijoin will always emit records partitioned by the joined column.
-		return true, parent.(*EquiJoinOperator).GetParitionColumn()
-	default:
-		panic("Unexpected operator encounterd when obtaining recent partition column")
-	}
-	return false, 0
-}
-
-// Get input operators for the subgraph that starts by @node
-func (engine *DataflowEngine) getSubgraphInputs(node Operator) []*InputOperator {
-	// Check if @node is an input operator
-	if _, ok := node.(*InputOperator); ok {
-		return []*InputOperator{node.(*InputOperator)}
-	}
-
-	parents := node.GetCore().GetParents()
-	inputs := make([]*InputOperator, 0)
-	for _, parent := range parents {
-		if _, ok := parent.(*InputOperator); ok {
-			inputs = append(inputs, parent.(*InputOperator))
-		} else {
-			inputs = append(inputs, engine.getSubgraphInputs(parent)...)
+	}
+	sort.Slice(report.Operators, func(i, j int) bool {
+		if report.Operators[i].Partition != report.Operators[j].Partition {
+			return report.Operators[i].Partition < report.Operators[j].Partition
 		}
+		return report.Operators[i].NodeIndex < report.Operators[j].NodeIndex
+	})
+	return report
+}
+
+func (engine *DataflowEngine) GetOutput(partition uint64) *MatViewOperator {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	return engine.graphs[partition].GetOutputs()[0]
+}
+
+// Returns @partition's clone of @view, which is an output of the graph the
+// engine was created with
+func (engine *DataflowEngine) GetView(partition uint64, view *MatViewOperator) *MatViewOperator {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	return engine.viewOf(partition, view)
+}
+
+// Same as GetView; must be invoked with @engine.topologyMu held
+func (engine *DataflowEngine) viewOf(partition uint64, view *MatViewOperator) *MatViewOperator {
+	// nil if the view has been removed
+	clone, _ := engine.graphs[partition].GetNode(view.GetCore().GetIndex()).(*MatViewOperator)
+	return clone
+}
+
+// Inserts an exchange on the edge from the parent at @position (among its
+// parents) of the node at @child; the parent's other children are unaffected.
+// The exchange routes the records by @partitionColumn as @mode sets.
+func (engine *DataflowEngine) addExchangeBefore(child int, position int, partitionColumn uint64, mode routingMode) {
+	fmt.Printf("[ENGINE] Inserting exchange before Node: %d (parent %d)\n", child, position)
+	exchangeOps := engine.newExchanges(partitionColumn, mode)
+	// Insert exchage operators in their respective graphs
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		engine.graphs[i].InsertNodeOnEdge(exchangeOps[i], engine.graphs[i].GetNode(child), position)
+	}
+	for i = 0; i < engine.partitionCount; i++ {
+		engine.exchanges = append(engine.exchanges, exchangeOps[i])
 	}
-	return inputs
 }
 
-func (engine *DataflowEngine) addExchangeAfter(node Operator, partitionColumn uint64) {
-	fmt.Printf("[ENGINE] Inserting exchange after Node: %d\n", node.GetCore().GetIndex())
+// Returns an exchange operator for each partition, connected to each other
+func (engine *DataflowEngine) newExchanges(partitionColumn uint64, mode routingMode) map[uint64]*ExchangeOperator {
 	// Initialise comm channels
 	exchangeChans := make(map[uint64]chan *BatchMessage)
 	var i uint64
@@ -233,13 +337,20 @@ func (engine *DataflowEngine) addExchangeAfter(node Operator, partitionColumn ui
 		exchangeChans[i] = make(chan *BatchMessage)
 	}
 	// Initialise exchange ops
-	exchangeOps := make(map[uint64]Operator)
+	exchangeOps := make(map[uint64]*ExchangeOperator)
 	for i = 0; i < engine.partitionCount; i++ {
 		exchangeOps[i] = NewExchangeOperator(exchangeChans[i], engine.graphChans[i], exchangeChans, partitionColumn, i, engine.partitionCount)
+		exchangeOps[i].coalescing = engine.coalescing
+		exchangeOps[i].routing.mode = mode
 	}
-	// Insert exchage operators in their respective graphs
-	for i = 0; i < engine.partitionCount; i++ {
-		engine.graphs[i].InsertNode(exchangeOps[i], node)
-	}
-	return
+	return exchangeOps
+}
+
+// Must be invoked once @exchangeOp is part of its partition's graph
+func (engine *DataflowEngine) launchExchange(exchangeOp *ExchangeOperator) {
+	engine.lifecycle.exchanges.Add(1)
+	go func() {
+		defer engine.lifecycle.exchanges.Done()
+		exchangeOp.listenFromPeers()
+	}()
 }
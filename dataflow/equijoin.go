@@ -2,12 +2,23 @@ package dataflow
 
 import "fmt"
 
+// Tables of the equijoin's state (used as stateKey.table)
+const (
+	leftTable uint8 = iota
+	rightTable
+)
+
 type EquiJoinOperator struct {
 	Core       OperatorCore
 	leftID     uint64
 	rightID    uint64
 	leftTable  map[uint64][]*Record
 	rightTable map[uint64][]*Record
+	// Keys split across partitions, mapped to the table that is replicated to
+	// every partition (refer skew.go)
+	splits map[uint64]JoinSide
+	// Set if a side of the join is broadcast to every partition (refer cost.go)
+	broadcast *broadcastJoin
 }
 
 func NewEquiJoinOperator(leftID uint64, rightID uint64) *EquiJoinOperator {
@@ -16,41 +27,171 @@ func NewEquiJoinOperator(leftID uint64, rightID uint64) *EquiJoinOperator {
 		rightID:    rightID,
 		leftTable:  make(map[uint64][]*Record),
 		rightTable: make(map[uint64][]*Record),
+		splits:     make(map[uint64]JoinSide),
 	}
 	equijoinOpCore := OperatorCore{
 		opType:  EQUIJOIN,
 		opIface: equijoinOp,
+		memory:  newMemoryState(Spill),
 	}
 	equijoinOp.SetCore(equijoinOpCore)
 	return equijoinOp
 }
 
-func (op *EquiJoinOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+func (op *EquiJoinOperator) Process(source int, input *[]*Record, output *[]*Record) error {
+	if source != op.leftIndex() && source != op.rightIndex() {
+		return fmt.Errorf("%w: node %d is not a parent of the equijoin", ErrInvalidSource, source)
+	}
 	for _, record := range *input {
 		if source == op.leftIndex() {
 			// fmt.Printf("[EQUI] Node: %d, Source: %d, leftIndex: %d, rightIndex: %d, Record: %v\n", op.GetCore().GetIndex(), source, op.leftIndex(), op.rightIndex(), *record)
 			leftValue := record.GetValue(op.leftID)
 			// Match with all seen records in right table
-			for _, rightRecord := range op.rightTable[leftValue] {
+			rightRecords, err := op.probe(rightTable, leftValue)
+			if err != nil {
+				return err
+			}
+			for _, rightRecord := range rightRecords {
 				op.emitRecord(record, rightRecord, output)
 			}
 			// Store record in left table
-			op.leftTable[leftValue] = append(op.leftTable[leftValue], record)
-		} else if source == op.rightIndex() {
+			if err := op.store(leftTable, leftValue, record); err != nil {
+				return err
+			}
+		} else {
 			rightValue := record.GetValue(op.rightID)
 			// Match with all seen records in left table
-			for _, leftRecord := range op.leftTable[rightValue] {
+			leftRecords, err := op.probe(leftTable, rightValue)
+			if err != nil {
+				return err
+			}
+			for _, leftRecord := range leftRecords {
 				op.emitRecord(leftRecord, record, output)
 			}
 			// Store record in right table
-			op.rightTable[rightValue] = append(op.rightTable[rightValue], record)
-		} else {
-			fmt.Printf("[EQUI] Node: %d, Source: %d, leftIndex: %d, rightIndex: %d, Record: %v\n", op.GetCore().GetIndex(), source, op.leftIndex(), op.rightIndex(), *record)
-			panic("Invalid source in equijoin")
+			if err := op.store(rightTable, rightValue, record); err != nil {
+				return err
+			}
 		}
 	}
+	return op.enforceMemoryLimit()
+}
 
-	return true
+func (op *EquiJoinOperator) table(table uint8) map[uint64][]*Record {
+	if table == leftTable {
+		return op.leftTable
+	}
+	return op.rightTable
+}
+
+// Returns the records of @table for @key, loading them back if spilled
+func (op *EquiJoinOperator) probe(table uint8, key uint64) ([]*Record, error) {
+	memory := op.Core.memory
+	if memory.isSpilled(stateKey{table, key}) {
+		if err := op.reload(table, key); err != nil {
+			return nil, err
+		}
+	} else if memory.isEvicted(stateKey{table, key}) {
+		// Matches with the evicted records are lost
+		memory.recordMiss()
+	}
+	records := op.table(table)[key]
+	if len(records) > 0 {
+		memory.touch(stateKey{table, key})
+	}
+	return records, nil
+}
+
+func (op *EquiJoinOperator) store(table uint8, key uint64, record *Record) error {
+	memory := op.Core.memory
+	if memory.isSpilled(stateKey{table, key}) {
+		if err := op.reload(table, key); err != nil {
+			return err
+		}
+	}
+	records, ok := op.table(table)[key]
+	if !ok {
+		memory.clearEvicted(stateKey{table, key})
+		memory.charge(keyOverhead, 1)
+	}
+	op.table(table)[key] = append(records, record)
+	memory.charge(record.Size(), 0)
+	memory.touch(stateKey{table, key})
+	return nil
+}
+
+func (op *EquiJoinOperator) reload(table uint8, key uint64) error {
+	schema := op.GetCore().GetParents()[table].GetCore().OutputSchema
+	records, err := op.Core.memory.spill.take(stateKey{table, key}, schema)
+	if err != nil {
+		return err
+	}
+	op.table(table)[key] = records
+	op.Core.memory.charge(recordsSize(records)+keyOverhead, 1)
+	return nil
+}
+
+// Loads back every spilled key; used by upqueries that have to scan a table
+func (op *EquiJoinOperator) reloadAll() error {
+	if op.Core.memory.spill == nil {
+		return nil
+	}
+	for _, key := range op.Core.memory.spill.keys() {
+		if err := op.reload(key.table, key.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *EquiJoinOperator) evict(key stateKey) error {
+	records, ok := op.table(key.table)[key.key]
+	if !ok {
+		return nil
+	}
+	memory := op.Core.memory
+	if memory.mode == Spill {
+		// The records are only dropped once they are safely spilled
+		spill, err := memory.getSpill()
+		if err != nil {
+			return err
+		}
+		if err := spill.write(key, records); err != nil {
+			return err
+		}
+	} else {
+		memory.markEvicted(key)
+	}
+	delete(op.table(key.table), key.key)
+	memory.remove(key)
+	memory.charge(-(recordsSize(records) + keyOverhead), -1)
+	memory.recordEviction()
+	return nil
+}
+
+func (op *EquiJoinOperator) enforceMemoryLimit() error {
+	for op.Core.memory.overLimit() {
+		victim, ok := op.Core.memory.victim()
+		if !ok {
+			return nil
+		}
+		if err := op.evict(victim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bounds the memory used by the join's tables (per partition) to @limit
+// bytes. Evicted keys are either spilled or dropped, in which case the
+// matches they would have produced are lost and reported as misses. Returns
+// ErrUnsupportedOperator for the Recompute mode, or ErrInvalidArgument for an
+// unknown policy.
+func (op *EquiJoinOperator) SetMemoryLimit(limit int64, policy EvictionPolicy, mode EvictionMode) error {
+	if mode == Recompute {
+		return fmt.Errorf("%w: joins can't recompute evicted keys", ErrUnsupportedOperator)
+	}
+	return op.Core.memory.configure(limit, policy, mode)
 }
 
 func (op *EquiJoinOperator) emitRecord(left *Record, right *Record, output *[]*Record) {
@@ -71,6 +212,89 @@ func (op *EquiJoinOperator) emitRecord(left *Record, right *Record, output *[]*R
 	*output = append(*output, outRecord)
 }
 
+// Answers the upquery from the join's own state, hence the parents are not
+// upqueried. The tables hold every record the join has seen, except for the
+// keys evicted in ReportMiss mode: an upquery that would read any of them
+// returns ErrKeyEvicted rather than an incomplete result.
+func (op *EquiJoinOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	var output []*Record
+	leftWidth := uint64(len(op.GetCore().GetParents()[0].GetCore().OutputSchema.ColumnNames))
+	memory := op.Core.memory
+	if column == op.leftID {
+		if memory.isEvicted(stateKey{leftTable, value}) || memory.isEvicted(stateKey{rightTable, value}) {
+			memory.recordMiss()
+			return nil, ErrKeyEvicted
+		}
+		leftRecords, err := op.probe(leftTable, value)
+		if err != nil {
+			return nil, err
+		}
+		rightRecords, err := op.probe(rightTable, value)
+		if err != nil {
+			return nil, err
+		}
+		for _, leftRecord := range leftRecords {
+			for _, rightRecord := range rightRecords {
+				op.emitRecord(leftRecord, rightRecord, &output)
+			}
+		}
+		return output, nil
+	}
+	// Any of the evicted keys may hold matching records
+	if memory.hasEvicted() {
+		memory.recordMiss()
+		return nil, ErrKeyEvicted
+	}
+	if err := op.reloadAll(); err != nil {
+		return nil, err
+	}
+	if column < leftWidth {
+		for _, leftRecords := range op.leftTable {
+			for _, leftRecord := range leftRecords {
+				if leftRecord.GetValue(column) != value {
+					continue
+				}
+				for _, rightRecord := range op.rightTable[leftRecord.GetValue(op.leftID)] {
+					op.emitRecord(leftRecord, rightRecord, &output)
+				}
+			}
+		}
+	} else {
+		// Map @column to the right schema; the rightID column is not emitted
+		rightColumn := column - leftWidth
+		if rightColumn >= op.rightID {
+			rightColumn++
+		}
+		for _, rightRecords := range op.rightTable {
+			for _, rightRecord := range rightRecords {
+				if rightRecord.GetValue(rightColumn) != value {
+					continue
+				}
+				for _, leftRecord := range op.leftTable[rightRecord.GetValue(op.rightID)] {
+					op.emitRecord(leftRecord, rightRecord, &output)
+				}
+			}
+		}
+	}
+	return output, nil
+}
+
+// Returns every record emitted by the join so far, i.e. the join of its tables
+func (op *EquiJoinOperator) snapshot() ([]*Record, error) {
+	if err := op.reloadAll(); err != nil {
+		return nil, err
+	}
+	var output []*Record
+	for key, leftRecords := range op.leftTable {
+		for _, leftRecord := range leftRecords {
+			for _, rightRecord := range op.rightTable[key] {
+				op.emitRecord(leftRecord, rightRecord, &output)
+			}
+		}
+	}
+	return output, nil
+}
+
 func (op *EquiJoinOperator) leftIndex() int {
 	return op.GetCore().Parents[0].From().GetCore().GetIndex()
 }
@@ -104,8 +328,9 @@ func (op *EquiJoinOperator) GetRightPartitionColumn() uint64 {
 func (op *EquiJoinOperator) ComputeOutputSchema() {
 	var outputColNames []string
 	outputColNames = append(outputColNames, op.GetCore().Parents[0].From().GetCore().OutputSchema.ColumnNames...)
+	// The right join column is not emitted (refer emitRecord)
 	for i := range op.GetCore().Parents[1].From().GetCore().OutputSchema.ColumnNames {
-		if uint64(i) == op.leftID {
+		if uint64(i) == op.rightID {
 			continue
 		}
 		outputColNames = append(outputColNames, op.GetCore().Parents[1].From().GetCore().OutputSchema.ColumnNames[i])
@@ -121,11 +346,14 @@ func (op *EquiJoinOperator) Clone() Operator {
 		rightID:    op.rightID,
 		leftTable:  make(map[uint64][]*Record),
 		rightTable: make(map[uint64][]*Record),
+		splits:     make(map[uint64]JoinSide),
+		broadcast:  op.broadcast,
 	}
 	cloneOpCore := OperatorCore{
 		opType:  EQUIJOIN,
 		opIface: cloneOp,
 		index:   op.GetCore().GetIndex(),
+		memory:  op.GetCore().memory.clone(),
 	}
 	cloneOp.SetCore(cloneOpCore)
 	return cloneOp
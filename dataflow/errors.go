@@ -0,0 +1,65 @@
+package dataflow
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEngineStopped = errors.New("dataflow: engine has been stopped")
+	ErrNotStarted    = errors.New("dataflow: engine has not been started")
+	ErrUnknownInput  = errors.New("dataflow: unknown input")
+	// An argument is out of range (e.g. a non-positive limit)
+	ErrInvalidArgument = errors.New("dataflow: invalid argument")
+	// The record's width does not match the input's schema
+	ErrMalformedRecord = errors.New("dataflow: malformed record")
+	// A batch was received from a node that is not a parent of the operator
+	ErrInvalidSource       = errors.New("dataflow: invalid source")
+	ErrInvalidFilter       = errors.New("dataflow: invalid filter operations")
+	ErrUnsupportedOperator = errors.New("dataflow: unsupported operator")
+	// An operator panicked while processing a batch
+	ErrOperatorPanic = errors.New("dataflow: operator panicked")
+	// The key was evicted from a view that reports misses
+	ErrKeyEvicted = errors.New("dataflow: key evicted")
+	ErrSpill      = errors.New("dataflow: spill file failure")
+	// The operators passed to a migration can't be added to the engine
+	ErrInvalidMigration = errors.New("dataflow: invalid migration")
+	// The view was removed from the engine, or its partition was replaced by
+	// rescaling
+	ErrViewRemoved           = errors.New("dataflow: view removed")
+	ErrInvalidPartitionCount = errors.New("dataflow: invalid partition count")
+	// The join key can't be split across partitions
+	ErrInvalidSplit = errors.New("dataflow: invalid key split")
+	// The planner failed to partition an operator's input as the operator
+	// requires
+	ErrPartitioningConflict = errors.New("dataflow: conflicting partitioning")
+)
+
+// Describes a batch that could not be processed. Errors returned by
+// DataflowEngine.Process itself (i.e. before the batch is partitioned) leave
+// Partition unset.
+type ProcessError struct {
+	Partition uint64
+	// Node that failed (-1 if the batch did not reach one)
+	NodeIndex int
+	Type      OperatorType
+	// Input through which the batch entered the graph; "" for batches sent by
+	// exchanges
+	InputName string
+	Err       error
+}
+
+func (err *ProcessError) Error() string {
+	if err.NodeIndex < 0 {
+		return fmt.Sprintf("partition %d, input %q: %v", err.Partition, err.InputName, err.Err)
+	}
+	return fmt.Sprintf("partition %d, node %d (%v), input %q: %v", err.Partition, err.NodeIndex, err.Type, err.InputName, err.Err)
+}
+
+func (err *ProcessError) Unwrap() error {
+	return err.Err
+}
+
+func spillError(err error) error {
+	return fmt.Errorf("%w: %v", ErrSpill, err)
+}
@@ -1,5 +1,12 @@
 package dataflow
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type ExchangeOperator struct {
 	Core            OperatorCore
 	incomingChan    <-chan *BatchMessage
@@ -8,6 +15,32 @@ type ExchangeOperator struct {
 	partitionColumn uint64
 	currentParition uint64
 	totalParitions  uint64
+	// Closed once the exchange is removed from its graph
+	stop chan struct{}
+	// Routes the records processed by the exchange (refer skew.go)
+	routing *router
+	// Set if the batches sent to peers are coalesced
+	coalescing *coalescing
+	// Guards @pending, since partitions flush it from their own goroutine
+	// when pipelined (refer Graph.flushExchanges)
+	pendingMu sync.Mutex
+	// Message being coalesced for each peer
+	pending map[uint64]*BatchMessage
+	// Accessed atomically
+	sentMessages     int64
+	coalescedBatches int64
+}
+
+// Batches sent to the same peer are merged into a message until it holds
+// @maxRecords records; a partition sends the messages its exchanges coalesce
+// every @maxDelay, and before it handles any message other than a batch
+// (i.e. an upquery, a replay, a migration or a task), which hence observes
+// every batch processed before it. A ticket completes once the messages it
+// was coalesced into are processed, hence waiting for one may take up to
+// @maxDelay longer.
+type coalescing struct {
+	maxRecords int
+	maxDelay   time.Duration
 }
 
 func NewExchangeOperator(incomingChan <-chan *BatchMessage, graphChan chan<- *BatchMessage, peerChans map[uint64]chan *BatchMessage, paritionColumn uint64, currentParition uint64, totalParitions uint64) *ExchangeOperator {
@@ -18,17 +51,23 @@ func NewExchangeOperator(incomingChan <-chan *BatchMessage, graphChan chan<- *Ba
 		partitionColumn: paritionColumn,
 		currentParition: currentParition,
 		totalParitions:  totalParitions,
+		stop:            make(chan struct{}),
+		routing:         newRouter(paritionColumn, totalParitions),
+		pending:         make(map[uint64]*BatchMessage),
 	}
 	exchangeOpCore := OperatorCore{
 		opType:  EXCHANGE,
 		opIface: exchangeOp,
 	}
 	exchangeOp.SetCore(exchangeOpCore)
-	go exchangeOp.listenFromPeers()
 	return exchangeOp
 }
 
+// Supposed to be used as an entry point for a go routine (launched by the
+// engine once the exchange is part of a graph). Forwards batches sent by peers
+// to the graph until the engine stops (or the exchange is removed).
 func (op *ExchangeOperator) listenFromPeers() {
+	lifecycle := op.GetCore().GetGraph().lifecycle
 	for {
 		select {
 		case msg := <-op.incomingChan:
@@ -36,15 +75,21 @@ func (op *ExchangeOperator) listenFromPeers() {
 			msg.EntryIndex = op.GetCore().Children[0].To().GetCore().GetIndex()
 			// Set the source index as the current index
 			msg.SourceIndex = op.GetCore().GetIndex()
-			op.graphChan <- msg
+			if !lifecycle.send(op.graphChan, msg) {
+				return
+			}
+		case <-lifecycle.done:
+			return
+		case <-op.stop:
+			return
 		}
 	}
 }
 
-func (op *ExchangeOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+func (op *ExchangeOperator) Process(source int, input *[]*Record, output *[]*Record) error {
 	// If there are no records to process then return
 	if len(*input) == 0 {
-		return true
+		return nil
 	}
 	recordsByPartition := op.partitionRecords(input)
 	// Forward records that are meant to be in the current parition
@@ -55,36 +100,94 @@ func (op *ExchangeOperator) Process(source int, input *[]*Record, output *[]*Rec
 	}
 
 	// delete(recordsByPartition, op.currentParition)
+	if op.routing.mode == localRouting {
+		// Peers route the same records themselves
+		return nil
+	}
 	// Send batches to appropriate peers
+	tickets := op.GetCore().currentTickets()
 	for k := range recordsByPartition {
 		if k == op.currentParition {
 			continue
 		}
-		msg := &BatchMessage{
-			InputName:  "",
-			EntryIndex: -1,
-			Records:    recordsByPartition[k],
-		}
-		op.peerChans[k] <- msg
+		op.send(k, recordsByPartition[k], tickets)
 	}
-	return true
+	return nil
 }
 
-func (op *ExchangeOperator) partitionRecords(records *[]*Record) map[uint64]*[]*Record {
-	// Performs a modulous parition; in pelton we can use a hash based one
-	recordsByPartition := make(map[uint64]*[]*Record)
-	for _, record := range *records {
-		value := record.GetValue(op.partitionColumn)
-		partition := value % op.totalParitions
-		if _, ok := recordsByPartition[partition]; ok {
-			*recordsByPartition[partition] = append(*recordsByPartition[partition], record)
-		} else {
-			tempRecords := make([]*Record, 1)
-			recordsByPartition[partition] = &tempRecords
-			(*recordsByPartition[partition])[0] = record
+// Sends @records to peer @k, or adds them to the message being coalesced for
+// it. @tickets are those of the batch that caused the records.
+func (op *ExchangeOperator) send(k uint64, records *[]*Record, tickets []*Ticket) {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	msg, ok := op.pending[k]
+	if ok {
+		*msg.Records = append(*msg.Records, *records...)
+		atomic.AddInt64(&op.coalescedBatches, 1)
+	} else {
+		msg = &BatchMessage{
+			InputName:       "",
+			EntryIndex:      -1,
+			Records:         records,
+			SourcePartition: op.currentParition,
+			// The peer enters the message at its exchange's child
+			location: op.GetCore().Children[0].To().GetCore().GetIndex(),
 		}
 	}
-	return recordsByPartition
+	// The batch that caused the records can only complete once @msg does,
+	// and holds credits for them until then (refer flow.go)
+	for _, ticket := range tickets {
+		msg.attach(ticket)
+	}
+	if len(tickets) > 0 {
+		tickets[0].charge(int64(len(*records)))
+	}
+	if op.coalescing == nil || len(*msg.Records) >= op.coalescing.maxRecords {
+		delete(op.pending, k)
+		op.sendMessage(k, msg)
+	} else if !ok {
+		op.pending[k] = msg
+	}
+}
+
+func (op *ExchangeOperator) sendMessage(k uint64, msg *BatchMessage) {
+	atomic.AddInt64(&op.sentMessages, 1)
+	op.GetCore().GetGraph().lifecycle.send(op.peerChans[k], msg)
+}
+
+// Sends the messages being coalesced
+func (op *ExchangeOperator) flush() {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	for k, msg := range op.pending {
+		delete(op.pending, k)
+		op.sendMessage(k, msg)
+	}
+}
+
+// Drops the messages being coalesced once the partition stops
+func (op *ExchangeOperator) dropPending() {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	for k, msg := range op.pending {
+		delete(op.pending, k)
+		op.GetCore().GetGraph().lifecycle.drop(msg)
+	}
+}
+
+// Records upstream of an exchange are spread across all partitions, hence
+// upqueries through an exchange are answered asynchronously (refer upquery.go)
+func (op *ExchangeOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	return nil, fmt.Errorf("%w: upqueries cannot be answered synchronously by an exchange", ErrUnsupportedOperator)
+}
+
+// Returns the partition that @record gets sent to by the exchange
+func (op *ExchangeOperator) partitionOf(record *Record) uint64 {
+	return record.GetValue(op.partitionColumn) % op.totalParitions
+}
+
+func (op *ExchangeOperator) partitionRecords(records *[]*Record) map[uint64]*[]*Record {
+	return op.routing.route(records)
 }
 
 func (op *ExchangeOperator) GetCore() *OperatorCore {
@@ -0,0 +1,203 @@
+package dataflow
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Physical plan chosen by the engine's planner (refer DataflowEngine.Explain)
+type PhysicalPlan struct {
+	Partitions uint64
+	// Partitioning column of each input, by name
+	InputPartitioning map[string]uint64
+	// Inputs replicated to every partition (refer BroadcastInput), which have
+	// no partitioning column
+	BroadcastInputs []string
+	// Parents before their children
+	Nodes []PlanNode
+}
+
+type PlanNode struct {
+	Index   int
+	Type    OperatorType
+	Parents []int
+	// Parameters of the operator, e.g. the name of an input or a view's key
+	Details string
+	// Partitioning of the records that the operator emits (refer
+	// partitioning.go). @Decided is unset while the engine is not started, and
+	// @Keyed is unset if no column determines the partition of the records.
+	Decided         bool
+	Keyed           bool
+	PartitionColumn uint64
+	// Set if every partition receives every record (i.e. for exchanges that
+	// broadcast, refer cost.go)
+	Replicated bool
+	// Set for exchanges: why the records are shuffled
+	Reason string
+}
+
+// Returns the plan that the partitions run, i.e. the engine's graph along
+// with the exchanges that the planner (and migrations) inserted. Before the
+// engine is started, the plan is that of its graph with no partitioning
+// decided.
+func (engine *DataflowEngine) Explain() *PhysicalPlan {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	graph := engine.baseGraph
+	if len(engine.graphs) > 0 {
+		graph = engine.graphs[0]
+	}
+	plan := &PhysicalPlan{
+		Partitions:        engine.partitionCount,
+		InputPartitioning: make(map[string]uint64),
+	}
+	for name, column := range engine.plan.inputPartition {
+		if engine.plan.broadcastInputs[name] {
+			plan.BroadcastInputs = append(plan.BroadcastInputs, name)
+			continue
+		}
+		plan.InputPartitioning[name] = column
+	}
+	sort.Strings(plan.BroadcastInputs)
+	for _, index := range graph.topologicalOrder() {
+		node := graph.GetNode(index)
+		current := engine.partitioningOf(node)
+		planNode := PlanNode{
+			Index:           index,
+			Type:            node.GetCore().opType,
+			Details:         describeOperator(node),
+			Decided:         current.decided,
+			Keyed:           current.keyed,
+			PartitionColumn: current.column,
+			Replicated:      current.replicated,
+		}
+		for _, parent := range node.GetCore().GetParents() {
+			planNode.Parents = append(planNode.Parents, parent.GetCore().GetIndex())
+		}
+		if exchangeOp, ok := node.(*ExchangeOperator); ok {
+			planNode.Reason = engine.exchangeReason(exchangeOp)
+		}
+		plan.Nodes = append(plan.Nodes, planNode)
+	}
+	return plan
+}
+
+// Explains the exchange by the requirement of its child, which its parent
+// doesn't meet, or by the estimated cost of the broadcast
+func (engine *DataflowEngine) exchangeReason(exchangeOp *ExchangeOperator) string {
+	parent := exchangeOp.GetCore().GetParents()[0]
+	child := exchangeOp.GetCore().GetChildren()[0]
+	input := "its input"
+	if _, ok := child.(*EquiJoinOperator); ok {
+		input = "its left input"
+		if child.GetCore().GetParents()[1] == Operator(exchangeOp) {
+			input = "its right input"
+		}
+	}
+	if exchangeOp.routing.mode == broadcastRouting {
+		strategy := child.(*EquiJoinOperator).broadcast
+		return fmt.Sprintf("%v %d broadcasts %s, which sends about %.0f records across partitions rather than %.0f",
+			child.GetCore().opType, child.GetCore().GetIndex(), input, strategy.cost, strategy.hashCost)
+	}
+	upstream := engine.partitioningOf(parent)
+	return fmt.Sprintf("%v %d requires %s partitioned by column %d, but %v %d emits records %s",
+		child.GetCore().opType, child.GetCore().GetIndex(), input, exchangeOp.partitionColumn,
+		parent.GetCore().opType, parent.GetCore().GetIndex(), describePartitioning(upstream))
+}
+
+func describePartitioning(current partitioning) string {
+	if !current.decided {
+		return "whose partitioning is undecided"
+	}
+	if current.replicated {
+		return "replicated to every partition"
+	}
+	if !current.keyed {
+		return "not partitioned by any column"
+	}
+	return fmt.Sprintf("partitioned by column %d", current.column)
+}
+
+func describeOperator(node Operator) string {
+	switch op := node.(type) {
+	case *InputOperator:
+		return op.GetName()
+	case *FilterOperator:
+		var conditions []string
+		for i := range op.cids {
+			symbol := map[CompOp]string{LessThan: "<", GreaterThan: ">", Equal: "="}[op.ops[i]]
+			conditions = append(conditions, fmt.Sprintf("column %d %s %d", op.cids[i], symbol, op.vals[i]))
+		}
+		return strings.Join(conditions, " and ")
+	case *ProjectOperator:
+		return fmt.Sprintf("columns %v", op.cids)
+	case *EquiJoinOperator:
+		details := fmt.Sprintf("left column %d = right column %d", op.leftID, op.rightID)
+		if op.broadcast != nil {
+			details += fmt.Sprintf(", broadcasting the %s input", map[JoinSide]string{LeftSide: "left", RightSide: "right"}[op.broadcast.replicated])
+		}
+		return details
+	case *MatViewOperator:
+		details := fmt.Sprintf("key %d", op.GetKey())
+		if op.scatter != nil {
+			details += fmt.Sprintf(", gathered from every partition, which sends about %.0f lookups across partitions rather than %.0f records",
+				op.scatter.cost, op.scatter.exchangeCost)
+		}
+		return details
+	case *ExchangeOperator:
+		switch op.routing.mode {
+		case broadcastRouting:
+			return "to every partition"
+		case localRouting:
+			return fmt.Sprintf("by column %d, within every partition", op.partitionColumn)
+		}
+		return fmt.Sprintf("by column %d", op.partitionColumn)
+	}
+	return ""
+}
+
+// Renders the plan as text, one operator per line (exchanges are followed by
+// the reason for them)
+func (plan *PhysicalPlan) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Physical plan (%d partitions)\n", plan.Partitions)
+	var names []string
+	for name := range plan.InputPartitioning {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	builder.WriteString("Inputs:\n")
+	for _, name := range names {
+		fmt.Fprintf(&builder, "  %s: partitioned by column %d\n", name, plan.InputPartitioning[name])
+	}
+	for _, name := range plan.BroadcastInputs {
+		fmt.Fprintf(&builder, "  %s: replicated to every partition\n", name)
+	}
+	builder.WriteString("Operators:\n")
+	for _, node := range plan.Nodes {
+		fmt.Fprintf(&builder, "  [%d] %v", node.Index, node.Type)
+		if node.Details != "" {
+			fmt.Fprintf(&builder, " %s", node.Details)
+		}
+		if len(node.Parents) > 0 {
+			var parents []string
+			for _, parent := range node.Parents {
+				parents = append(parents, strconv.Itoa(parent))
+			}
+			fmt.Fprintf(&builder, " <- %s", strings.Join(parents, ", "))
+		}
+		current := partitioning{
+			decided:    node.Decided,
+			keyed:      node.Keyed,
+			column:     node.PartitionColumn,
+			replicated: node.Replicated,
+		}
+		fmt.Fprintf(&builder, ": %s\n", strings.TrimPrefix(describePartitioning(current), "whose "))
+		if node.Reason != "" {
+			fmt.Fprintf(&builder, "      (%s)\n", node.Reason)
+		}
+	}
+	return builder.String()
+}
@@ -1,5 +1,7 @@
 package dataflow
 
+import "fmt"
+
 type CompOp uint8
 
 const (
@@ -29,50 +31,57 @@ func NewFilterOperator(cids []uint64, ops []CompOp, vals []uint64) *FilterOperat
 	return filterOp
 }
 
-func evaluate(record *Record, cid uint64, operator CompOp, value uint64) bool {
+func evaluate(record *Record, cid uint64, operator CompOp, value uint64) (bool, error) {
 	switch operator {
 	case LessThan:
-		if record.GetValue(cid) < value {
-			return true
-		}
-		break
+		return record.GetValue(cid) < value, nil
 	case GreaterThan:
-		if record.GetValue(cid) > value {
-			return true
-		}
-		break
+		return record.GetValue(cid) > value, nil
 	case Equal:
-		if record.GetValue(cid) == value {
-			return true
-		}
-		break
-	default:
-		panic("Invalid filter condition")
+		return record.GetValue(cid) == value, nil
 	}
-	return false
+	return false, fmt.Errorf("%w: unknown condition %d", ErrInvalidFilter, operator)
 }
 
-func (op *FilterOperator) accept(record *Record) bool {
+func (op *FilterOperator) accept(record *Record) (bool, error) {
 	// Implicitly performs logical AND on the filter operations
 	for i, _ := range op.cids {
-		if !evaluate(record, op.cids[i], op.ops[i], op.vals[i]) {
-			return false
+		ok, err := evaluate(record, op.cids[i], op.ops[i], op.vals[i])
+		if err != nil || !ok {
+			return false, err
 		}
 	}
-	return true
+	return true, nil
 }
 
-func (op *FilterOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+func (op *FilterOperator) Process(source int, input *[]*Record, output *[]*Record) error {
 	if len(op.cids) != len(op.ops) || len(op.ops) != len(op.vals) {
-		panic("Invalid filter operations")
+		return fmt.Errorf("%w: %d columns, %d conditions and %d values", ErrInvalidFilter, len(op.cids), len(op.ops), len(op.vals))
 	}
 	for _, record := range *input {
-		if !op.accept(record) {
+		ok, err := op.accept(record)
+		if err != nil {
+			return err
+		}
+		if !ok {
 			continue
 		}
 		*output = append(*output, record)
 	}
-	return true
+	return nil
+}
+
+func (op *FilterOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	// Filters don't alter the schema, hence the column is the same upstream
+	parentRecords, err := op.GetCore().GetParents()[0].Upquery(column, value)
+	if err != nil {
+		return nil, err
+	}
+	var output []*Record
+	if err := op.Process(-1, &parentRecords, &output); err != nil {
+		return nil, err
+	}
+	return output, nil
 }
 
 func (op *FilterOperator) GetCore() *OperatorCore {
@@ -0,0 +1,237 @@
+package dataflow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messaging between the goroutines of an engine is designed so that it cannot
+// deadlock:
+// (a) Every partition receives its messages through a mailbox, whose queue
+// always accepts messages. Exchanges (running on a partition's goroutine)
+// hence never wait on another partition, which could in turn be waiting on
+// them.
+// (b) The queues are bounded by admitting batches into the engine against
+// credits, counted in records. DataflowEngine.Process acquires a credit per
+// record of the batch, and exchanges charge a credit per record they send to
+// a peer to the ticket of the batch that caused it, e.g. the records that a
+// join emits for a hot key. The credits are returned once the batch's ticket
+// completes, i.e. once every message it caused has been processed. Exchanges
+// cannot wait for credits, by (a), hence their charges may take the engine
+// over capacity, and Process blocks until enough credits are returned. This
+// applies backpressure to the caller rather than letting the queues grow:
+// the records queued are at most those of the batches admitted while the
+// engine was below capacity, and those derived from them. Upqueries and
+// their responses are not charged, since each is awaited by the reader that
+// caused it.
+
+const DefaultFlowCapacity = 1 << 16
+
+// Queue in front of a partition. Messages sent on @in are queued by a pump
+// goroutine until the partition receives them on @out.
+type mailbox struct {
+	in  chan *BatchMessage
+	out chan *BatchMessage
+	// Accessed atomically
+	depth     int64
+	highWater int64
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{
+		in:  make(chan *BatchMessage),
+		out: make(chan *BatchMessage),
+	}
+}
+
+// Supposed to be used as an entry point for a go routine. Messages that are
+// still queued once the engine stops are dropped.
+func (box *mailbox) run(lifecycle *lifecycle) {
+	var queue []*BatchMessage
+	for {
+		// A nil channel (the queue is empty) is never selected
+		var out chan *BatchMessage
+		var next *BatchMessage
+		if len(queue) > 0 {
+			out, next = box.out, queue[0]
+		}
+		select {
+		case msg := <-box.in:
+			queue = append(queue, msg)
+			if depth := atomic.AddInt64(&box.depth, 1); depth > atomic.LoadInt64(&box.highWater) {
+				atomic.StoreInt64(&box.highWater, depth)
+			}
+		case out <- next:
+			queue[0] = nil
+			queue = queue[1:]
+			atomic.AddInt64(&box.depth, -1)
+		case <-lifecycle.done:
+			for _, msg := range queue {
+				lifecycle.drop(msg)
+			}
+			return
+		}
+	}
+}
+
+// Engine-wide credits, counted in records
+type flowControl struct {
+	mu       sync.Mutex
+	capacity int64
+	inFlight int64
+	// Closed (and replaced) whenever credits are returned
+	returned    chan struct{}
+	throttled   int64
+	maxInFlight int64
+}
+
+type FlowStats struct {
+	// Records that may be in flight at once
+	Capacity int64
+	// Records of batches whose tickets are not complete, including the
+	// records that exchanges sent on their behalf
+	InFlight int64
+	// Most records that have been in flight at once
+	MaxInFlight int64
+	// Batches that had to wait for credits
+	Throttled int64
+	// Deepest any partition's queue has been (in messages)
+	MaxQueueDepth int64
+	// Messages that the exchanges of the running partitions sent to peers,
+	// and batches that they coalesced into messages sent for earlier ones
+	ExchangeMessages int64
+	CoalescedBatches int64
+}
+
+func newFlowControl(capacity int64) *flowControl {
+	return &flowControl{
+		capacity: capacity,
+		returned: make(chan struct{}),
+	}
+}
+
+// Blocks until @count credits are available and returns the number acquired.
+// A batch larger than the capacity acquires all of it, hence it is admitted
+// once nothing else is in flight.
+func (fc *flowControl) acquire(ctx context.Context, count int64, done <-chan struct{}) (int64, error) {
+	throttled := false
+	for {
+		fc.mu.Lock()
+		if count > fc.capacity {
+			count = fc.capacity
+		}
+		if fc.inFlight+count <= fc.capacity {
+			fc.add(count)
+			fc.mu.Unlock()
+			return count, nil
+		}
+		if !throttled {
+			throttled = true
+			fc.throttled++
+		}
+		returned := fc.returned
+		fc.mu.Unlock()
+		select {
+		case <-returned:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-done:
+			return 0, ErrEngineStopped
+		}
+	}
+}
+
+// Charges @count credits without waiting for them (refer the top of the file)
+func (fc *flowControl) charge(count int64) {
+	fc.mu.Lock()
+	fc.add(count)
+	fc.mu.Unlock()
+}
+
+// Must be invoked with @fc.mu held
+func (fc *flowControl) add(count int64) {
+	fc.inFlight += count
+	if fc.inFlight > fc.maxInFlight {
+		fc.maxInFlight = fc.inFlight
+	}
+}
+
+func (fc *flowControl) release(count int64) {
+	if count == 0 {
+		return
+	}
+	fc.mu.Lock()
+	fc.inFlight -= count
+	close(fc.returned)
+	fc.returned = make(chan struct{})
+	fc.mu.Unlock()
+}
+
+func (fc *flowControl) setCapacity(capacity int64) {
+	fc.mu.Lock()
+	fc.capacity = capacity
+	close(fc.returned)
+	fc.returned = make(chan struct{})
+	fc.mu.Unlock()
+}
+
+// Bounds the number of records that may be in flight in the engine, across
+// partitions (DefaultFlowCapacity by default). Returns ErrInvalidArgument
+// unless @records is positive.
+func (engine *DataflowEngine) SetFlowCapacity(records int64) error {
+	if records <= 0 {
+		return fmt.Errorf("%w: flow capacity must be positive", ErrInvalidArgument)
+	}
+	engine.flow.setCapacity(records)
+	return nil
+}
+
+// Makes exchanges merge the batches they send to the same peer into messages
+// of up to @maxRecords records, which are sent at most @maxDelay later (refer
+// coalescing). Batches are sent as they are if @maxRecords is at most 1. Must
+// be invoked before the engine is started. Returns ErrInvalidArgument if
+// batches are to be merged but @maxDelay is not positive.
+func (engine *DataflowEngine) SetExchangeCoalescing(maxRecords int, maxDelay time.Duration) error {
+	if maxRecords <= 1 {
+		engine.coalescing = nil
+		return nil
+	}
+	if maxDelay <= 0 {
+		return fmt.Errorf("%w: coalescing delay must be positive", ErrInvalidArgument)
+	}
+	engine.coalescing = &coalescing{
+		maxRecords: maxRecords,
+		maxDelay:   maxDelay,
+	}
+	return nil
+}
+
+func (engine *DataflowEngine) GetFlowStats() FlowStats {
+	engine.flow.mu.Lock()
+	stats := FlowStats{
+		Capacity:    engine.flow.capacity,
+		InFlight:    engine.flow.inFlight,
+		MaxInFlight: engine.flow.maxInFlight,
+		Throttled:   engine.flow.throttled,
+	}
+	engine.flow.mu.Unlock()
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	for _, box := range engine.mailboxes {
+		if highWater := atomic.LoadInt64(&box.highWater); highWater > stats.MaxQueueDepth {
+			stats.MaxQueueDepth = highWater
+		}
+	}
+	for _, graph := range engine.graphs {
+		for _, node := range graph.nodes {
+			if exchangeOp, ok := node.(*ExchangeOperator); ok {
+				stats.ExchangeMessages += atomic.LoadInt64(&exchangeOp.sentMessages)
+				stats.CoalescedBatches += atomic.LoadInt64(&exchangeOp.coalescedBatches)
+			}
+		}
+	}
+	return stats
+}
@@ -1,5 +1,9 @@
 package dataflow
 
+import (
+  "sort"
+  "time"
+)
 
 type Graph struct {
   index uint64
@@ -9,6 +13,25 @@ type Graph struct {
 	edges map[int]*Edge
   inputs map[string]*InputOperator
   outputs []*MatViewOperator
+  // Set by the engine; used to deliver upqueries to the graph's goroutine
+  inbox chan<- *BatchMessage
+  // Set by the engine; nil if the graph is not run by one
+  lifecycle *lifecycle
+  // Partition whose exchange most recently forwarded the records being
+  // processed. Used by partial views to order updates w.r.t. upqueries.
+  viaPartition uint64
+  // Tickets of the message being processed; inherited by messages that
+  // exchanges send as a consequence
+  currentTickets []*Ticket
+  // Set by the engine; nil if the graph is not run by one
+  progress *progressTracker
+  // Set by the engine; runs the operators as pipeline stages (refer
+  // pipeline.go)
+  pipelined bool
+  pipeline *pipeline
+  // Indices are never reused, since nodes may be removed (refer migration.go)
+  nextNodeIndex int
+  nextEdgeIndex int
 }
 
 func NewGraph() *Graph{
@@ -40,11 +63,11 @@ func (graph *Graph) GetOutputs() []*MatViewOperator{
 }
 
 func (graph *Graph) MintNodeIndex() int {
-	return len(graph.nodes)
+	return graph.nextNodeIndex
 }
 
 func (graph *Graph) MintEdgeIndex() int {
-	return len(graph.edges)
+	return graph.nextEdgeIndex
 }
 
 func (graph *Graph) AddNodeMultipleParents(node Operator, parents []Operator, autoIndex bool) {
@@ -57,6 +80,9 @@ func (graph *Graph) AddNodeMultipleParents(node Operator, parents []Operator, au
   }
   node.GetCore().SetGraph(graph)
   graph.nodes[nodeIndex] = node
+  if nodeIndex >= graph.nextNodeIndex{
+    graph.nextNodeIndex = nodeIndex + 1
+  }
   for _,parent := range parents{
     graph.AddEdge(parent, node, false)
   }
@@ -82,6 +108,7 @@ func (graph *Graph) InsertNode(node Operator, parent Operator){
   node.GetCore().SetGraph(graph)
   nodeIndex := graph.MintNodeIndex()
   node.GetCore().SetIndex(nodeIndex)
+  graph.nextNodeIndex++
   // WARNING: Do not use @parent and @children directly. i.e. modifications made
   // to their internal state will not be reflected in @graph.nodes. This is
   // because the @Operator interface gets copied and not referenced.
@@ -112,6 +139,123 @@ func (graph *Graph) InsertNode(node Operator, parent Operator){
   // }
 }
 
+// Inserts @node on the edge from @child's parent at @position (among the
+// child's parents), which keeps its position; the parent's other children are
+// unaffected. Used by the engine to insert exchange operators.
+func (graph *Graph) InsertNodeOnEdge(node Operator, child Operator, position int){
+  childCore := graph.nodes[child.GetCore().GetIndex()].GetCore()
+  edge := childCore.Parents[position]
+  parent := edge.From()
+  // Detach the edge from the parent (by identity, since a node may feed both
+  // sides of a join)
+  parentCore := parent.GetCore()
+  for i, childEdge := range parentCore.Children{
+    if childEdge == edge{
+      parentCore.Children = append(parentCore.Children[:i:i], parentCore.Children[i+1:]...)
+      break
+    }
+  }
+  for edgeIndex, graphEdge := range graph.edges{
+    if graphEdge == edge{
+      delete(graph.edges, edgeIndex)
+    }
+  }
+
+  node.GetCore().SetIndex(graph.MintNodeIndex())
+  graph.AddNode(node, parent, false)
+  node.ComputeOutputSchema()
+  // Link @node and @child in place of the detached edge
+  edge = &Edge{
+    from: node,
+    to: graph.nodes[child.GetCore().GetIndex()],
+  }
+  graph.edges[graph.MintEdgeIndex()] = edge
+  graph.nextEdgeIndex++
+  childCore.Parents[position] = edge
+  node.GetCore().Children = append(node.GetCore().Children, edge)
+}
+
+func (graph *Graph) setMemoryBudget(budget *MemoryBudget){
+  for _, node := range graph.nodes{
+    if node.GetCore().memory != nil{
+      node.GetCore().memory.budget = budget
+    }
+  }
+}
+
+// Returns the shortest sweep interval among the outputs (0 if none has a TTL)
+func (graph *Graph) sweepInterval() time.Duration{
+  var interval time.Duration
+  for _, output := range graph.outputs{
+    if outputInterval := output.sweepInterval(); outputInterval > 0 && (interval == 0 || outputInterval < interval){
+      interval = outputInterval
+    }
+  }
+  return interval
+}
+
+// Returns the shortest delay by which the exchanges coalesce batches (0 if
+// none does)
+func (graph *Graph) flushInterval() time.Duration{
+  var interval time.Duration
+  for _, node := range graph.nodes{
+    if exchangeOp, ok := node.(*ExchangeOperator); ok && exchangeOp.coalescing != nil{
+      if delay := exchangeOp.coalescing.maxDelay; interval == 0 || delay < interval{
+        interval = delay
+      }
+    }
+  }
+  return interval
+}
+
+// Sends the messages that the exchanges are coalescing (refer exchange.go)
+func (graph *Graph) flushExchanges(){
+  for _, node := range graph.nodes{
+    if exchangeOp, ok := node.(*ExchangeOperator); ok{
+      exchangeOp.flush()
+    }
+  }
+}
+
+// Releases resources held by the operators' state (i.e. spill files)
+func (graph *Graph) releaseState(){
+  for _, node := range graph.nodes{
+    if node.GetCore().memory != nil{
+      node.GetCore().memory.closeSpill()
+    }
+  }
+}
+
+// Removes the node at @index, along with its edges; its children must have
+// been removed already
+func (graph *Graph) removeNode(index int){
+  node, ok := graph.nodes[index]
+  if !ok{
+    return
+  }
+  for _, parent := range node.GetCore().GetParents(){
+    parent.GetCore().deleteChildEdge(index)
+  }
+  for edgeIndex, edge := range graph.edges{
+    if edge.From() == node || edge.To() == node{
+      delete(graph.edges, edgeIndex)
+    }
+  }
+  delete(graph.nodes, index)
+  if view, ok := node.(*MatViewOperator); ok{
+    for i, output := range graph.outputs{
+      if output == view{
+        graph.outputs = append(graph.outputs[:i:i], graph.outputs[i+1:]...)
+        break
+      }
+    }
+    view.abortFills()
+  }
+  if node.GetCore().memory != nil{
+    node.GetCore().memory.closeSpill()
+  }
+}
+
 func (graph *Graph) RemoveEdgeFromNode(){
 
 }
@@ -144,22 +288,32 @@ func (graph *Graph) AddEdge(parent Operator, child Operator, appendStart bool){
   }
   edgeIndex := graph.MintEdgeIndex()
   graph.edges[edgeIndex] = edge
+  graph.nextEdgeIndex++
   child.GetCore().AddParent(parent, edge, appendStart)
 }
 
-func (graph *Graph) Process(entryIndex int, sourceIndex int, inputName string, records *[]*Record) bool {
-  inputNode := graph.inputs[inputName]
+// Returns a *ProcessError if any operator fails to process the batch, in which
+// case the batch is not forwarded past that operator
+func (graph *Graph) Process(entryIndex int, sourceIndex int, inputName string, records *[]*Record) error {
+  var err error
   if entryIndex != -1{
-    if !graph.nodes[entryIndex].GetCore().ProcessAndForward(sourceIndex, records){
-      return false
+    entryNode, ok := graph.nodes[entryIndex]
+    if !ok{
+      // The node was removed while the batch was in flight (refer
+      // migration.go), hence the batch only affected removed operators
+      return nil
     }
+    err = entryNode.GetCore().ProcessAndForward(sourceIndex, records)
+  } else if inputNode, ok := graph.inputs[inputName]; ok{
+    err = inputNode.GetCore().ProcessAndForward(-1, records)
   } else{
-    if !inputNode.GetCore().ProcessAndForward(-1, records){
-      return false
-    }
+    err = &ProcessError{NodeIndex: -1, Err: ErrUnknownInput}
   }
-
-  return true
+  if processErr, ok := err.(*ProcessError); ok{
+    processErr.Partition = graph.index
+    processErr.InputName = inputName
+  }
+  return err
 }
 
 func (graph *Graph) Clone(cloneIndex uint64) *Graph{
@@ -170,8 +324,9 @@ func (graph *Graph) Clone(cloneIndex uint64) *Graph{
     clone.AddInputOperator(inputOp.Clone().(*InputOperator), false)
   }
 
-  // Add nodes by index order
-  for i :=0; i < len(graph.nodes); i++{
+  // Add nodes parents first (the optimizer inserts nodes with higher indices
+  // than their children, refer optimizer.go)
+  for _, i := range graph.topologicalOrder(){
     op := graph.nodes[i]
     if _, ok := op.(*InputOperator); ok{
       continue
@@ -181,7 +336,7 @@ func (graph *Graph) Clone(cloneIndex uint64) *Graph{
     for _,parentOp := range op.GetCore().GetParents(){
       opIndex := parentOp.GetCore().GetIndex()
       // The parent node should have already been cloned since we are adding
-      // nodes by index order
+      // nodes in topological order
       cloneParents = append(cloneParents, clone.nodes[opIndex])
     }
     if _, ok:= op.(*MatViewOperator); ok{
@@ -198,22 +353,192 @@ func (graph *Graph) Clone(cloneIndex uint64) *Graph{
   //   }
   //   fmt.Printf("[Clone][Graph%d] Parent: %d, Children: %d\n", clone.GetIndex(), nodE.GetCore().GetIndex(), nodE.GetCore().GetChildren()[0].GetCore().GetIndex())
   // }
+  // Indices of removed nodes are not reused
+  clone.nextNodeIndex = graph.nextNodeIndex
+  return clone
+}
+
+// Returns the indices of the nodes, parents before their children and by index
+// otherwise. Exchanges get higher indices than their children, hence index
+// order alone doesn't do.
+func (graph *Graph) topologicalOrder() []int{
+  var indices []int
+  for i := range graph.nodes{
+    indices = append(indices, i)
+  }
+  sort.Ints(indices)
+  placed := make(map[int]bool)
+  var order []int
+  for len(order) < len(indices){
+    for _, i := range indices{
+      if placed[i]{
+        continue
+      }
+      ready := true
+      for _, parentOp := range graph.nodes[i].GetCore().GetParents(){
+        if !placed[parentOp.GetCore().GetIndex()]{
+          ready = false
+          break
+        }
+      }
+      if ready{
+        placed[i] = true
+        order = append(order, i)
+      }
+    }
+  }
+  return order
+}
+
+// Clones the graph of a running engine, exchanges included, for partition
+// @cloneIndex once the engine is rescaled. @exchange returns the exchange that
+// replaces the one at a node index.
+func (graph *Graph) cloneTopology(cloneIndex uint64, exchange func(index int) *ExchangeOperator) *Graph{
+  clone := NewGraph()
+  clone.SetIndex(cloneIndex)
+  for _, i := range graph.topologicalOrder(){
+    op := graph.nodes[i]
+    var cloneParents []Operator
+    for _, parentOp := range op.GetCore().GetParents(){
+      cloneParents = append(cloneParents, clone.nodes[parentOp.GetCore().GetIndex()])
+    }
+    switch op := op.(type){
+    case *InputOperator:
+      clone.AddInputOperator(op.Clone().(*InputOperator), false)
+    case *MatViewOperator:
+      clone.AddOutputOperator(op.Clone().(*MatViewOperator), cloneParents[0], false)
+    case *ExchangeOperator:
+      exchangeOp := exchange(i)
+      exchangeOp.GetCore().SetIndex(i)
+      clone.AddNodeMultipleParents(exchangeOp, cloneParents, false)
+    default:
+      clone.AddNodeMultipleParents(op.Clone(), cloneParents, false)
+    }
+  }
+  // Outputs keep their order (refer DataflowEngine.GetOutput)
+  clone.outputs = nil
+  for _, output := range graph.outputs{
+    clone.outputs = append(clone.outputs, clone.nodes[output.GetCore().GetIndex()].(*MatViewOperator))
+  }
+  clone.nextNodeIndex = graph.nextNodeIndex
+  clone.nextEdgeIndex = graph.nextEdgeIndex
   return clone
 }
 
 // Supposed to be used as an entry point for a go routine. It invokes Process
 // function as and when batches are received
 func (graph *Graph) Start(msgChan <-chan *BatchMessage, killChan <-chan bool){
+  // Expiry of view rows is driven by this goroutine so that it never races
+  // with Process. A nil channel (no view has a TTL) is never selected.
+  var sweepChan <-chan time.Time
+  var ticker *time.Ticker
+  // Invoked again once migrations change the outputs
+  resetSweep := func(){
+    if ticker != nil{
+      ticker.Stop()
+      ticker, sweepChan = nil, nil
+    }
+    if interval := graph.sweepInterval(); interval > 0{
+      ticker = time.NewTicker(interval)
+      sweepChan = ticker.C
+    }
+  }
+  resetSweep()
+  // Likewise, batches coalesced by exchanges are flushed periodically
+  var flushChan <-chan time.Time
+  var flushTicker *time.Ticker
+  resetFlush := func(){
+    if flushTicker != nil{
+      flushTicker.Stop()
+      flushTicker, flushChan = nil, nil
+    }
+    if interval := graph.flushInterval(); interval > 0{
+      flushTicker = time.NewTicker(interval)
+      flushChan = flushTicker.C
+    }
+  }
+  resetFlush()
+  if graph.pipelined{
+    graph.pipeline = graph.startPipeline()
+  }
+  defer func(){
+    if ticker != nil{
+      ticker.Stop()
+    }
+    if flushTicker != nil{
+      flushTicker.Stop()
+    }
+    if graph.pipeline != nil{
+      graph.pipeline.stop()
+      graph.pipeline = nil
+    }
+    for _, node := range graph.nodes{
+      if exchangeOp, ok := node.(*ExchangeOperator); ok{
+        exchangeOp.dropPending()
+      }
+    }
+  }()
   for{
     select{
+    case now := <- sweepChan:
+      if graph.pipeline != nil{
+        graph.pipeline.drain()
+      }
+      for _, output := range graph.outputs{
+        // Nothing waits on a periodic sweep: rows the spill file fails to
+        // expire are dropped once they are loaded back (refer reload)
+        output.Expire(now)
+      }
+    case <- flushChan:
+      graph.flushExchanges()
     case msg := <- msgChan:
-      if msg.EntryIndex !=-1{
-        graph.Process(msg.EntryIndex, msg.SourceIndex, "", msg.Records)
+      graph.currentTickets = msg.tickets()
+      var err error
+      batch := msg.migration == nil && msg.task == nil && msg.Upquery == nil && msg.Replay == nil
+      if !batch{
+        // The message is handled on this goroutine, once no stage runs, and
+        // observes every batch that was processed before it
+        if graph.pipeline != nil{
+          graph.pipeline.drain()
+        }
+        graph.flushExchanges()
+      }
+      if graph.pipeline != nil && batch{
+        err = graph.pipeline.dispatch(msg)
+      } else if msg.migration != nil{
+        graph.viaPartition = graph.index
+        err = graph.applyMigration(msg.migration)
+        resetSweep()
+        resetFlush()
+        if graph.pipeline != nil{
+          // Stages are added and removed along with the nodes
+          graph.pipeline.stop()
+          graph.pipeline = graph.startPipeline()
+        }
+      } else if msg.task != nil{
+        err = msg.task(graph)
+      } else if msg.Upquery != nil{
+        graph.answerUpquery(msg.Upquery)
+      } else if msg.Replay != nil{
+        graph.applyReplay(msg.Replay, msg.Records)
+      } else if msg.EntryIndex !=-1{
+        graph.viaPartition = msg.SourcePartition
+        err = graph.Process(msg.EntryIndex, msg.SourceIndex, "", msg.Records)
       } else{
-        if msg.InputName == ""{
-          panic("Input name not specified")
+        graph.viaPartition = graph.index
+        err = graph.Process(-1, -1, msg.InputName, msg.Records)
+      }
+      if !batch{
+        // i.e. the batches that migrations backfill views with
+        graph.flushExchanges()
+      }
+      // A failed batch is reported through its ticket; the partition carries on
+      // with the next one
+      for _, ticket := range msg.tickets(){
+        if err != nil{
+          ticket.fail(err)
         }
-        graph.Process(-1, -1, msg.InputName, msg.Records)
+        ticket.release(msg.location)
       }
     case signal := <- killChan:
       if signal{
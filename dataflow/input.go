@@ -1,28 +1,87 @@
 package dataflow
 
+import "fmt"
+
 type InputOperator struct {
 	Core OperatorCore
 	name string
+	// Base state: every record received by the input is retained so that
+	// upqueries can be answered without the records being sent again
+	state []*Record
+	// Indices over @state, built lazily the first time a column is upqueried
+	indices map[uint64]map[uint64][]*Record
+	// Keys whose records are replicated to every partition (refer skew.go)
+	replicated map[uint64]bool
+	// Set if every record is replicated to every partition (refer cost.go)
+	broadcast bool
 }
 
 func NewInputOperator(name string, schema *Schema) *InputOperator {
 	inputOp := &InputOperator{
-		name: name,
+		name:       name,
+		indices:    make(map[uint64]map[uint64][]*Record),
+		replicated: make(map[uint64]bool),
 	}
 	inputOpCore := OperatorCore{
 		opType:       INPUT,
 		opIface:      inputOp,
 		InputSchemas: []*Schema{schema},
 		OutputSchema: schema,
+		memory:       newMemoryState(ReportMiss),
 	}
+	inputOpCore.memory.retained = true
 	inputOp.SetCore(inputOpCore)
 	return inputOp
 }
-func (op *InputOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+
+// Checks that every record in the batch matches the input's schema
+func (op *InputOperator) Validate(records []*Record) error {
+	width := len(op.Core.OutputSchema.ColumnNames)
+	for i, record := range records {
+		if record == nil || len(record.Data) != width {
+			got := 0
+			if record != nil {
+				got = len(record.Data)
+			}
+			return fmt.Errorf("%w: record %d has %d values, expected %d", ErrMalformedRecord, i, got, width)
+		}
+	}
+	return nil
+}
+
+func (op *InputOperator) Process(source int, input *[]*Record, output *[]*Record) error {
+	// The batch is rejected as a whole so that none of it reaches the state
+	if err := op.Validate(*input); err != nil {
+		return err
+	}
 	for _, record := range *input {
+		op.state = append(op.state, record)
+		// The base state is accounted for but never evicted (nor counted against
+		// the engine's budget), since it is what evicted state downstream is
+		// recomputed from
+		op.Core.memory.charge(record.Size(), 0)
+		for column, index := range op.indices {
+			value := record.GetValue(column)
+			index[value] = append(index[value], record)
+		}
 		*output = append(*output, record)
 	}
-	return true
+	return nil
+}
+
+func (op *InputOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	index, ok := op.indices[column]
+	if !ok {
+		index = make(map[uint64][]*Record)
+		for _, record := range op.state {
+			key := record.GetValue(column)
+			index[key] = append(index[key], record)
+		}
+		op.indices[column] = index
+	}
+	var records []*Record
+	records = append(records, index[value]...)
+	return records, nil
 }
 
 func (op *InputOperator) GetCore() *OperatorCore {
@@ -43,7 +102,10 @@ func (op *InputOperator) GetName() string {
 
 func (op *InputOperator) Clone() Operator {
 	cloneOp := &InputOperator{
-		name: op.name,
+		name:       op.name,
+		indices:    make(map[uint64]map[uint64][]*Record),
+		replicated: make(map[uint64]bool),
+		broadcast:  op.broadcast,
 	}
 	cloneOpCore := OperatorCore{
 		opType:       INPUT,
@@ -51,6 +113,7 @@ func (op *InputOperator) Clone() Operator {
 		index:        op.GetCore().GetIndex(),
 		InputSchemas: op.GetCore().InputSchemas,
 		OutputSchema: op.GetCore().OutputSchema,
+		memory:       op.GetCore().memory.clone(),
 	}
 	cloneOp.SetCore(cloneOpCore)
 	return cloneOp
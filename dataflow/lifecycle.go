@@ -0,0 +1,139 @@
+package dataflow
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Coordinates the shutdown of the goroutines launched by an engine
+type lifecycle struct {
+	// Closed once the engine stops, or once the partitions are replaced (refer
+	// rescale.go); sends that are blocked at that point give up and drop their
+	// message
+	done chan struct{}
+	// Closed once the engine stops; shared by the lifecycles of the partitions
+	// that replace each other
+	stopped    chan struct{}
+	exchanges  sync.WaitGroup
+	mailboxes  sync.WaitGroup
+	partitions sync.WaitGroup
+	// Accessed atomically
+	droppedBatches int64
+	droppedRecords int64
+}
+
+type ShutdownReport struct {
+	// Tickets that were not complete when the engine stopped, i.e. the context
+	// passed to Stop expired before their batches were processed
+	UnfinishedTickets int
+	// Batches (and their records) that were dropped rather than processed
+	DroppedBatches int64
+	DroppedRecords int64
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Returns the lifecycle of the partitions that replace those run under @this
+func (this *lifecycle) next() *lifecycle {
+	return &lifecycle{
+		done:    make(chan struct{}),
+		stopped: this.stopped,
+	}
+}
+
+// Sends @msg on @channel, unless the engine stops first in which case the
+// message is dropped. Graphs that are not run by an engine have no lifecycle
+// (i.e. it is nil), hence the send simply blocks.
+func (this *lifecycle) send(channel chan<- *BatchMessage, msg *BatchMessage) bool {
+	if this == nil {
+		channel <- msg
+		return true
+	}
+	select {
+	case channel <- msg:
+		return true
+	case <-this.done:
+		this.drop(msg)
+		return false
+	}
+}
+
+func (this *lifecycle) drop(msg *BatchMessage) {
+	atomic.AddInt64(&this.droppedBatches, 1)
+	if msg.Records != nil {
+		atomic.AddInt64(&this.droppedRecords, int64(len(*msg.Records)))
+	}
+	for _, ticket := range msg.tickets() {
+		ticket.drop(msg.location)
+	}
+}
+
+func (this *lifecycle) isStopped() bool {
+	if this == nil {
+		return false
+	}
+	select {
+	case <-this.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stops the engine. New batches are refused, while batches that are in flight
+// are processed until @ctx expires; after that they are dropped. Returns ctx.Err() if the engine could not be drained in time.
+func (engine *DataflowEngine) Stop(ctx context.Context) (*ShutdownReport, error) {
+	// Waits for Process calls that are sending batches
+	engine.stateMu.Lock()
+	if engine.stopped {
+		engine.stateMu.Unlock()
+		return nil, ErrEngineStopped
+	}
+	engine.stopped = true
+	engine.stateMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		engine.tickets.flush()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	report := &ShutdownReport{
+		UnfinishedTickets: engine.tickets.count(),
+	}
+
+	close(engine.lifecycle.stopped)
+	engine.stopPartitions()
+	// Unblock anyone waiting on tickets whose batches were dropped
+	engine.tickets.abandonAll()
+	<-drained
+	for _, graph := range engine.graphs {
+		graph.releaseState()
+	}
+	report.DroppedBatches = atomic.LoadInt64(&engine.lifecycle.droppedBatches)
+	report.DroppedRecords = atomic.LoadInt64(&engine.lifecycle.droppedRecords)
+	return report, err
+}
+
+// Stops the goroutines of the partitions in order: first the exchanges'
+// listeners, then the partitions' mailboxes and last the partitions
+func (engine *DataflowEngine) stopPartitions() {
+	close(engine.lifecycle.done)
+	engine.lifecycle.exchanges.Wait()
+	engine.lifecycle.mailboxes.Wait()
+	for k := range engine.graphs {
+		engine.killChans[k] <- true
+	}
+	engine.lifecycle.partitions.Wait()
+}
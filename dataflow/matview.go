@@ -1,41 +1,273 @@
 package dataflow
 
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 type MatViewOperator struct {
 	Core OperatorCore
 	// Resorting to Key of length 1 for the prototype because a  slice cannot be
 	// used as a key for map in go since it does not implement equality operarations
 	// internally and there is not way to override thos for a custom struct
-	state map[uint64][]*Record
+	// Readable while the partition's goroutine applies batches to it
+	state *versionedState
 	key   uint64
+	// A partial view only holds keys that have been read. A miss is computed
+	// by upquerying the graph and records for absent keys are dropped.
+	partial bool
+	// Keys of a partial view that are waiting on an upquery
+	pending map[uint64]*pendingFill
+	// Lazily computed path to the state that answers upqueries for the view
+	route     *upqueryRoute
+	pendingMu sync.Mutex
+	// Set once the view is removed from a running engine (guarded by
+	// @pendingMu)
+	removed bool
+	// Set if rows expire (refer ttl.go)
+	ttl *ttlConfig
+	// Keys loaded back from the spill file by the batch being written, which
+	// remain spilled until the batch is published so that lookups find them
+	// in either place
+	reloaded map[uint64]bool
+	// Set if the view is read from every partition (refer scatter.go)
+	scatter *scatteredView
+	// Lookups answered and records received (accessed atomically), by which
+	// the planner chooses how the view is read
+	reads  int64
+	writes int64
 }
 
 func NewMatViewOperator(key uint64) *MatViewOperator {
 	matviewOp := &MatViewOperator{
-		state: make(map[uint64][]*Record),
-		key:   key,
+		state:   newVersionedState(),
+		key:     key,
+		pending: make(map[uint64]*pendingFill),
 	}
 	matviewOpCore := OperatorCore{
 		opType:  MATVIEW,
 		opIface: matviewOp,
+		memory:  newMemoryState(ReportMiss),
 	}
 	matviewOp.SetCore(matviewOpCore)
 	return matviewOp
 }
-func (op *MatViewOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+
+func NewPartialMatViewOperator(key uint64) *MatViewOperator {
+	matviewOp := NewMatViewOperator(key)
+	matviewOp.partial = true
+	matviewOp.Core.memory.mode = Recompute
+	return matviewOp
+}
+
+func (op *MatViewOperator) Process(source int, input *[]*Record, output *[]*Record) error {
+	// The batch becomes visible to lookups once it has been applied entirely
+	op.state.beginWrite()
+	defer op.state.publishThen(op.dropReloaded)
+	atomic.AddInt64(&op.writes, int64(len(*input)))
+	now := time.Now()
 	for _, record := range *input {
 		// fmt.Printf("[Graph%d][MATVIEW] Record: %v\n", op.GetCore().GetGraph().GetIndex(), record)
 		key := record.GetValue(op.key)
-		if _, ok := op.state[key]; ok {
-			op.state[key] = append(op.state[key], record)
-		} else {
-			op.state[key] = []*Record{record}
+		if op.Core.memory.isSpilled(stateKey{key: key}) {
+			if err := op.reload(key); err != nil {
+				return err
+			}
+		}
+		if _, ok := op.state.get(key); ok {
+			if !op.trackExpiry(key, record, now) {
+				continue
+			}
+			op.state.append(key, record)
+			op.Core.memory.charge(record.Size(), 0)
+			op.Core.memory.touch(stateKey{key: key})
+		} else if op.partial {
+			op.bufferIfPending(key, record)
+		} else if op.trackExpiry(key, record, now) {
+			op.Core.memory.clearEvicted(stateKey{key: key})
+			op.state.set(key, []*Record{record})
+			op.Core.memory.charge(record.Size()+keyOverhead, 1)
+			op.Core.memory.touch(stateKey{key: key})
 		}
 	}
-	return true
+	return op.enforceMemoryLimit()
 }
 
 func (op *MatViewOperator) Lookup(key uint64) []*Record {
-	return op.state[key]
+	records, _ := op.TryLookup(key)
+	return records
+}
+
+// Same as Lookup, but reports why the records of @key are unavailable, i.e.
+// ErrKeyEvicted if the key was evicted from a view that reports misses (in
+// which case the view no longer knows its records), or the error that failed
+// the upquery of a partial view. The records of a scattered view are gathered
+// from every partition (refer scatter.go).
+func (op *MatViewOperator) TryLookup(key uint64) ([]*Record, error) {
+	if op.scatter != nil && op.scatter.engine != nil {
+		return op.scatter.engine.LookupView(op, key)
+	}
+	atomic.AddInt64(&op.reads, 1)
+	return op.lookup(key)
+}
+
+// Same as TryLookup, but the lookup is not counted
+func (op *MatViewOperator) lookup(key uint64) ([]*Record, error) {
+	if records, ok := op.state.read(key); ok {
+		op.Core.memory.touch(stateKey{key: key})
+		return records, nil
+	}
+	if spill := op.Core.memory.spilled(); spill != nil {
+		// Loading the key back modifies the state, hence it is left to Process
+		records, ok, err := spill.find(stateKey{key: key}, op.Core.OutputSchema)
+		if ok || err != nil {
+			return records, err
+		}
+		// The key may have been loaded back and published since it was read
+		if records, ok := op.state.read(key); ok {
+			op.Core.memory.touch(stateKey{key: key})
+			return records, nil
+		}
+	}
+	if op.partial {
+		return op.fill(key)
+	}
+	if op.Core.memory.isEvicted(stateKey{key: key}) {
+		op.Core.memory.recordMiss()
+		return nil, ErrKeyEvicted
+	}
+	return nil, nil
+}
+
+// Drops @key from a partial view. Subsequent updates for the key are ignored
+// until it is read again. Full views return ErrUnsupportedOperator.
+func (op *MatViewOperator) Evict(key uint64) error {
+	if !op.partial {
+		return fmt.Errorf("%w: only partial views support eviction", ErrUnsupportedOperator)
+	}
+	op.state.beginWrite()
+	defer op.state.publish()
+	return op.evictKey(key)
+}
+
+// Returns the number of batches applied to the view; lookups reflect all of
+// them
+func (op *MatViewOperator) GetVersion() uint64 {
+	return op.state.getVersion()
+}
+
+// Bounds the memory used by the view (per partition) to @limit bytes. Partial
+// views may either recompute or spill evicted keys, while full views may
+// either spill them or report misses for them. Returns ErrUnsupportedOperator
+// for any other mode, or ErrInvalidArgument for an unknown policy.
+func (op *MatViewOperator) SetMemoryLimit(limit int64, policy EvictionPolicy, mode EvictionMode) error {
+	if (mode == Recompute && !op.partial) || (mode == ReportMiss && op.partial) {
+		return fmt.Errorf("%w: unsupported eviction mode %d for the view", ErrUnsupportedOperator, mode)
+	}
+	return op.Core.memory.configure(limit, policy, mode)
+}
+
+func (op *MatViewOperator) evictKey(key uint64) error {
+	records, ok := op.state.get(key)
+	if !ok {
+		return nil
+	}
+	memory := op.Core.memory
+	switch memory.mode {
+	case Spill:
+		// The records are only dropped once they are safely spilled
+		spill, err := memory.getSpill()
+		if err != nil {
+			return err
+		}
+		write := spill.write
+		// Set if the spilled records were loaded back by the same batch
+		replace := op.reloaded[key]
+		if replace {
+			write = spill.replace
+			delete(op.reloaded, key)
+		}
+		if err := write(stateKey{key: key}, records); err != nil {
+			return err
+		}
+		if op.ttl != nil {
+			op.ttl.spill(key, op.ttl.forget(records), replace)
+		}
+	case ReportMiss:
+		memory.markEvicted(stateKey{key: key})
+	}
+	if op.ttl != nil && memory.mode != Spill {
+		op.ttl.forget(records)
+	}
+	op.state.remove(key)
+	memory.remove(stateKey{key: key})
+	memory.charge(-(recordsSize(records) + keyOverhead), -1)
+	memory.recordEviction()
+	return nil
+}
+
+// Must be invoked by the view's writer; the key is dropped from the spill file
+// once the batch is published (refer dropReloaded), hence the batch must be
+// published through publishThen
+func (op *MatViewOperator) reload(key uint64) error {
+	records, err := op.Core.memory.spilled().read(stateKey{key: key}, op.Core.OutputSchema)
+	if err != nil {
+		return err
+	}
+	var expiries []int64
+	if op.ttl != nil {
+		expiries = op.ttl.spilledExpiries(key, records)
+		delete(op.ttl.spilled, key)
+	}
+	op.install(key, records, expiries)
+	if op.reloaded == nil {
+		op.reloaded = make(map[uint64]bool)
+	}
+	op.reloaded[key] = true
+	return nil
+}
+
+// Must be invoked by the view's writer, once the batch is published
+func (op *MatViewOperator) dropReloaded() {
+	for key := range op.reloaded {
+		op.Core.memory.spilled().drop(stateKey{key: key})
+		delete(op.reloaded, key)
+	}
+}
+
+func (op *MatViewOperator) enforceMemoryLimit() error {
+	for op.Core.memory.overLimit() {
+		victim, ok := op.Core.memory.victim()
+		if !ok {
+			return nil
+		}
+		if err := op.evictKey(victim.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *MatViewOperator) IsPartial() bool {
+	return op.partial
+}
+
+func (op *MatViewOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	if column == op.key {
+		return op.TryLookup(value)
+	}
+	// Only the keys currently held by the view are considered
+	var records []*Record
+	op.state.forEach(func(key uint64, keyRecords []*Record) {
+		for _, record := range keyRecords {
+			if record.GetValue(column) == value {
+				records = append(records, record)
+			}
+		}
+	})
+	return records, nil
 }
 
 func (op *MatViewOperator) ComputeOutputSchema() {
@@ -56,13 +288,20 @@ func (op *MatViewOperator) GetKey() uint64 {
 
 func (op *MatViewOperator) Clone() Operator {
 	cloneOp := &MatViewOperator{
-		state: make(map[uint64][]*Record),
-		key:   op.key,
+		state:   newVersionedState(),
+		key:     op.key,
+		partial: op.partial,
+		pending: make(map[uint64]*pendingFill),
+		scatter: op.scatter,
 	}
 	cloneOpCore := OperatorCore{
 		opType:  MATVIEW,
 		opIface: cloneOp,
 		index:   op.GetCore().GetIndex(),
+		memory:  op.GetCore().memory.clone(),
+	}
+	if op.ttl != nil {
+		cloneOp.ttl = op.ttl.clone()
 	}
 	cloneOp.SetCore(cloneOpCore)
 	return cloneOp
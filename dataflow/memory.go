@@ -0,0 +1,427 @@
+package dataflow
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type EvictionPolicy uint8
+
+const (
+	LRU EvictionPolicy = iota
+	LFU
+)
+
+// Defines what happens to the records of an evicted key
+type EvictionMode uint8
+
+const (
+	// The key is recomputed via an upquery the next time it is read (partial
+	// views only)
+	Recompute EvictionMode = iota
+	// The key's records are dropped and subsequent reads of it are reported as
+	// misses, until the key is written again. The key then holds the records
+	// written since, i.e. the dropped ones are not recovered.
+	ReportMiss
+	// The key's records are written to a spill file and loaded back when the
+	// key is accessed
+	Spill
+)
+
+// Approximate number of bytes used by a key, excluding its records
+const keyOverhead = 48
+
+// Engine-wide memory budget shared by the stateful operators of all
+// partitions. When it is exceeded, an operator that adds state evicts its own
+// keys until the engine is within budget again. The base state of inputs is
+// never evicted, hence it is not counted against the budget.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+}
+
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit: limit,
+	}
+}
+
+func (budget *MemoryBudget) GetLimit() int64 {
+	return budget.limit
+}
+
+func (budget *MemoryBudget) GetUsed() int64 {
+	return atomic.LoadInt64(&budget.used)
+}
+
+func (budget *MemoryBudget) exceeded() bool {
+	return budget.limit > 0 && budget.GetUsed() > budget.limit
+}
+
+// Memory accounting of a single operator's state
+type MemoryUsage struct {
+	Partition uint64
+	NodeIndex int
+	Type      OperatorType
+	Bytes     int64
+	Keys      int64
+	Evictions int64
+	Misses    int64
+}
+
+type MemoryReport struct {
+	Operators []MemoryUsage
+	// Bytes counted against the budget, i.e. of every operator but the inputs
+	TotalBytes int64
+	// Bytes of the inputs' base state
+	BaseBytes int64
+	// Engine-wide limit (0 if unbounded)
+	Budget int64
+}
+
+// Identifies a key of an operator's state; operators with multiple tables
+// (i.e. equijoin) use @table to distinguish between them
+type stateKey struct {
+	table uint8
+	key   uint64
+}
+
+type keyTracker interface {
+	touch(key stateKey)
+	remove(key stateKey)
+	// Returns the key that should be evicted next
+	victim() (stateKey, bool)
+}
+
+// Size accounting and eviction bookkeeping of a stateful operator
+type memoryState struct {
+	// Per-operator limit in bytes (0 if unbounded); applies to every
+	// partition's clone of the operator individually
+	limit  int64
+	policy EvictionPolicy
+	mode   EvictionMode
+	budget *MemoryBudget
+	// Set for the base state of inputs, which is never evicted, hence is not
+	// charged to @budget
+	retained bool
+	// Accessed atomically since they are read by GetMemoryReport
+	used      int64
+	keys      int64
+	evictions int64
+	misses    int64
+	// Keys evicted in ReportMiss mode that have not been written since
+	evicted map[stateKey]bool
+	// Created once a key is spilled (refer spilled)
+	spill   *spillStore
+	tracker keyTracker
+	// Guards @tracker, which is touched by reads as well, and @spill
+	mu sync.Mutex
+}
+
+func newMemoryState(mode EvictionMode) *memoryState {
+	return &memoryState{
+		mode:    mode,
+		evicted: make(map[stateKey]bool),
+		tracker: newLRUTracker(),
+	}
+}
+
+// Returns ErrInvalidArgument if @policy is unknown, in which case the
+// configuration is unchanged
+func (this *memoryState) configure(limit int64, policy EvictionPolicy, mode EvictionMode) error {
+	tracker := newKeyTracker(policy)
+	if tracker == nil {
+		return fmt.Errorf("%w: unknown eviction policy %d", ErrInvalidArgument, policy)
+	}
+	this.limit = limit
+	this.policy = policy
+	this.mode = mode
+	this.tracker = tracker
+	return nil
+}
+
+// Returns nil if @policy is unknown
+func newKeyTracker(policy EvictionPolicy) keyTracker {
+	switch policy {
+	case LRU:
+		return newLRUTracker()
+	case LFU:
+		return newLFUTracker()
+	}
+	return nil
+}
+
+// Returns true if @this and @other are configured alike (refer configure);
+// either may be nil for stateless operators
+func (this *memoryState) sameLimit(other *memoryState) bool {
+	if this == nil || other == nil {
+		return this == other
+	}
+	return this.limit == other.limit && this.policy == other.policy && this.mode == other.mode
+}
+
+// Returns an unused memoryState with the same configuration
+func (this *memoryState) clone() *memoryState {
+	clone := newMemoryState(this.mode)
+	clone.limit = this.limit
+	clone.policy = this.policy
+	clone.tracker = newKeyTracker(this.policy)
+	clone.budget = this.budget
+	clone.retained = this.retained
+	return clone
+}
+
+// Adds @bytes (which may be negative) to the operator's and (unless retained)
+// the engine's usage
+func (this *memoryState) charge(bytes int64, keys int64) {
+	atomic.AddInt64(&this.used, bytes)
+	atomic.AddInt64(&this.keys, keys)
+	if this.budget != nil && !this.retained {
+		atomic.AddInt64(&this.budget.used, bytes)
+	}
+}
+
+func (this *memoryState) overLimit() bool {
+	if this.limit > 0 && atomic.LoadInt64(&this.used) > this.limit {
+		return true
+	}
+	return this.budget != nil && this.budget.exceeded()
+}
+
+func (this *memoryState) touch(key stateKey) {
+	this.mu.Lock()
+	this.tracker.touch(key)
+	this.mu.Unlock()
+}
+
+func (this *memoryState) remove(key stateKey) {
+	this.mu.Lock()
+	this.tracker.remove(key)
+	this.mu.Unlock()
+}
+
+func (this *memoryState) victim() (stateKey, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.tracker.victim()
+}
+
+// Removes the operator's usage from the engine's budget, once its state has
+// been moved to another operator
+func (this *memoryState) discharge() {
+	this.charge(-atomic.LoadInt64(&this.used), -atomic.LoadInt64(&this.keys))
+}
+
+func (this *memoryState) recordEviction() {
+	atomic.AddInt64(&this.evictions, 1)
+}
+
+func (this *memoryState) recordMiss() {
+	atomic.AddInt64(&this.misses, 1)
+}
+
+func (this *memoryState) markEvicted(key stateKey) {
+	this.mu.Lock()
+	this.evicted[key] = true
+	this.mu.Unlock()
+}
+
+// Invoked once @key is written again after it was evicted (refer ReportMiss)
+func (this *memoryState) clearEvicted(key stateKey) {
+	this.mu.Lock()
+	delete(this.evicted, key)
+	this.mu.Unlock()
+}
+
+func (this *memoryState) isEvicted(key stateKey) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.evicted[key]
+}
+
+func (this *memoryState) hasEvicted() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.evicted) > 0
+}
+
+func (this *memoryState) evictedKeys() []stateKey {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var keys []stateKey
+	for key := range this.evicted {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Returns the spill store, which is created if no key has been spilled yet
+func (this *memoryState) getSpill() (*spillStore, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.spill == nil {
+		spill, err := newSpillStore()
+		if err != nil {
+			return nil, err
+		}
+		this.spill = spill
+	}
+	return this.spill, nil
+}
+
+// Returns the spill store, or nil if no key has been spilled yet; readers
+// (e.g. lookups of a view) access the store through it
+func (this *memoryState) spilled() *spillStore {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.spill
+}
+
+func (this *memoryState) isSpilled(key stateKey) bool {
+	spill := this.spilled()
+	return spill != nil && spill.contains(key)
+}
+
+func (this *memoryState) closeSpill() {
+	if spill := this.spilled(); spill != nil {
+		spill.close()
+	}
+}
+
+func (this *memoryState) usage(partition uint64, core *OperatorCore) MemoryUsage {
+	return MemoryUsage{
+		Partition: partition,
+		NodeIndex: core.GetIndex(),
+		Type:      core.opType,
+		Bytes:     atomic.LoadInt64(&this.used),
+		Keys:      atomic.LoadInt64(&this.keys),
+		Evictions: atomic.LoadInt64(&this.evictions),
+		Misses:    atomic.LoadInt64(&this.misses),
+	}
+}
+
+func recordsSize(records []*Record) int64 {
+	var size int64
+	for _, record := range records {
+		size += record.Size()
+	}
+	return size
+}
+
+type lruTracker struct {
+	order    *list.List
+	elements map[stateKey]*list.Element
+}
+
+func newLRUTracker() *lruTracker {
+	return &lruTracker{
+		order:    list.New(),
+		elements: make(map[stateKey]*list.Element),
+	}
+}
+
+func (this *lruTracker) touch(key stateKey) {
+	if element, ok := this.elements[key]; ok {
+		this.order.MoveToFront(element)
+		return
+	}
+	this.elements[key] = this.order.PushFront(key)
+}
+
+func (this *lruTracker) remove(key stateKey) {
+	if element, ok := this.elements[key]; ok {
+		this.order.Remove(element)
+		delete(this.elements, key)
+	}
+}
+
+func (this *lruTracker) victim() (stateKey, bool) {
+	if this.order.Len() == 0 {
+		return stateKey{}, false
+	}
+	return this.order.Back().Value.(stateKey), true
+}
+
+type lfuEntry struct {
+	key       stateKey
+	frequency uint64
+	// Breaks ties between equally frequent keys in LRU order
+	lastUsed  uint64
+	heapIndex int
+}
+
+// Min-heap of keys ordered by access frequency
+type lfuTracker struct {
+	entries []*lfuEntry
+	byKey   map[stateKey]*lfuEntry
+	clock   uint64
+}
+
+func newLFUTracker() *lfuTracker {
+	return &lfuTracker{
+		byKey: make(map[stateKey]*lfuEntry),
+	}
+}
+
+func (this *lfuTracker) Len() int {
+	return len(this.entries)
+}
+
+func (this *lfuTracker) Less(i, j int) bool {
+	if this.entries[i].frequency != this.entries[j].frequency {
+		return this.entries[i].frequency < this.entries[j].frequency
+	}
+	return this.entries[i].lastUsed < this.entries[j].lastUsed
+}
+
+func (this *lfuTracker) Swap(i, j int) {
+	this.entries[i], this.entries[j] = this.entries[j], this.entries[i]
+	this.entries[i].heapIndex = i
+	this.entries[j].heapIndex = j
+}
+
+func (this *lfuTracker) Push(x interface{}) {
+	entry := x.(*lfuEntry)
+	entry.heapIndex = len(this.entries)
+	this.entries = append(this.entries, entry)
+}
+
+func (this *lfuTracker) Pop() interface{} {
+	entry := this.entries[len(this.entries)-1]
+	this.entries = this.entries[:len(this.entries)-1]
+	return entry
+}
+
+func (this *lfuTracker) touch(key stateKey) {
+	this.clock++
+	if entry, ok := this.byKey[key]; ok {
+		entry.frequency++
+		entry.lastUsed = this.clock
+		heap.Fix(this, entry.heapIndex)
+		return
+	}
+	entry := &lfuEntry{
+		key:       key,
+		frequency: 1,
+		lastUsed:  this.clock,
+	}
+	this.byKey[key] = entry
+	heap.Push(this, entry)
+}
+
+func (this *lfuTracker) remove(key stateKey) {
+	if entry, ok := this.byKey[key]; ok {
+		heap.Remove(this, entry.heapIndex)
+		delete(this.byKey, key)
+	}
+}
+
+func (this *lfuTracker) victim() (stateKey, bool) {
+	if len(this.entries) == 0 {
+		return stateKey{}, false
+	}
+	return this.entries[0].key, true
+}
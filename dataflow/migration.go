@@ -0,0 +1,548 @@
+package dataflow
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Views can be added to (and removed from) a running engine. A migration is
+// applied by every partition on its own goroutine, in between batches:
+// (1) The engine plans the migration against the graph it was created with,
+// i.e. it decides where exchanges are needed and mints the node indices that
+// the partitions' graphs share.
+// (2) Every partition installs the new operators (or removes the old ones)
+// and waits until all partitions have done so. Hence no partition sends
+// records to an operator that a peer does not have yet.
+// (3) Every partition backfills the new operators from the state of the
+// existing operators they are attached to (i.e. the inputs' base state or
+// the join tables), and then carries on with the batches that follow.
+// Records that reach the new operators are therefore either part of the
+// backfill or processed after it, but never both. Batches are only held up
+// while the partitions install the migration.
+
+// Operators to add to a running engine (refer Commit)
+type Migration struct {
+	engine  *DataflowEngine
+	nodes   []Operator
+	parents [][]Operator
+}
+
+// Migration as applied by a partition (refer Graph.applyMigration)
+type migrationStep struct {
+	// Nodes to remove, children first
+	remove []int
+	// Nodes to add, parents first
+	nodes []plannedNode
+	// Edges from existing nodes to new ones, along which the new ones are
+	// backfilled
+	backfill []plannedEdge
+	budget   *MemoryBudget
+	// Done by every partition once it has installed the migration
+	installed sync.WaitGroup
+	// Closed once every partition has installed the migration
+	proceed chan struct{}
+}
+
+type plannedNode struct {
+	index   int
+	parents []int
+	// Operator passed to the migration, which every partition clones; nil for
+	// exchanges
+	base Operator
+	// Exchange of each partition
+	exchanges map[uint64]*ExchangeOperator
+}
+
+type plannedEdge struct {
+	from int
+	to   int
+}
+
+func (engine *DataflowEngine) NewMigration() *Migration {
+	return &Migration{
+		engine: engine,
+	}
+}
+
+// @parent is either an operator of the engine's graph (other than a view),
+// which is then shared with the existing operators, or an operator added to
+// the migration earlier
+func (migration *Migration) AddNode(node Operator, parent Operator) {
+	migration.AddNodeMultipleParents(node, []Operator{parent})
+}
+
+func (migration *Migration) AddNodeMultipleParents(node Operator, parents []Operator) {
+	migration.nodes = append(migration.nodes, node)
+	migration.parents = append(migration.parents, parents)
+}
+
+func (migration *Migration) AddOutputOperator(node *MatViewOperator, parent Operator) {
+	migration.AddNode(node, parent)
+}
+
+// Adds the migration's operators to every partition and blocks until they are
+// backfilled. The operators become part of the engine's graph, i.e. the views
+// are accessed through DataflowEngine.GetView. If backfilling fails the
+// operators are removed again (refer RemoveView) and the error is returned.
+func (migration *Migration) Commit() error {
+	engine := migration.engine
+	engine.stateMu.RLock()
+	defer engine.stateMu.RUnlock()
+	if engine.stopped {
+		return ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	restore, err := engine.translateColumns(migration)
+	if err != nil {
+		return err
+	}
+	step, err := engine.planMigration(migration)
+	if err != nil {
+		restore()
+		return err
+	}
+	// The engine's graph keeps track of the operators for later migrations
+	for i, node := range migration.nodes {
+		if _, ok := engine.shared[node]; ok {
+			continue
+		}
+		if view, ok := node.(*MatViewOperator); ok {
+			engine.baseGraph.AddOutputOperator(view, migration.parents[i][0], false)
+		} else {
+			engine.baseGraph.AddNodeMultipleParents(node, migration.parents[i], false)
+		}
+		if join, ok := node.(*EquiJoinOperator); ok && join.broadcast != nil {
+			engine.plan.joins[join.GetCore().GetIndex()] = join.broadcast
+		}
+	}
+	var added []*ExchangeOperator
+	for _, planned := range step.nodes {
+		for _, exchangeOp := range planned.exchanges {
+			added = append(added, exchangeOp)
+		}
+	}
+	if err := engine.applyMigration(step, added, nil); err != nil {
+		// Batches that reached the operators in the meantime are dropped
+		// along with them
+		for i := len(migration.nodes) - 1; i >= 0; i-- {
+			node := migration.nodes[i]
+			if _, ok := engine.shared[node]; ok {
+				continue
+			}
+			index := node.GetCore().GetIndex()
+			if engine.baseGraph.GetNode(index) == node && len(node.GetCore().GetChildren()) == 0 {
+				if removeErr := engine.removeNodes(index); removeErr != nil {
+					return removeErr
+				}
+			}
+		}
+		restore()
+		return err
+	}
+	return nil
+}
+
+// Removes @view (an output of the engine's graph) from every partition, along
+// with the operators upstream of it that no other operator depends on. Inputs
+// are never removed. Reads that are waiting for the view's partial state fail
+// with ErrViewRemoved.
+func (engine *DataflowEngine) RemoveView(view *MatViewOperator) error {
+	engine.stateMu.RLock()
+	defer engine.stateMu.RUnlock()
+	if engine.stopped {
+		return ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	if same, ok := engine.resolve(view).(*MatViewOperator); ok {
+		view = same
+	}
+	index := view.GetCore().GetIndex()
+	if engine.baseGraph.GetNode(index) != view {
+		return fmt.Errorf("%w: the view is not part of the engine", ErrInvalidMigration)
+	}
+	return engine.removeNodes(index)
+}
+
+// Removes the node at @index from every partition, along with the operators
+// upstream of it that no other operator depends on
+func (engine *DataflowEngine) removeNodes(index int) error {
+	// Exchanges are only part of the partitions' graphs, hence the nodes to
+	// remove are determined separately
+	step := &migrationStep{
+		remove: removableNodes(engine.graphs[0], index),
+	}
+	var removed []*ExchangeOperator
+	for _, graph := range engine.graphs {
+		for _, nodeIndex := range step.remove {
+			if exchangeOp, ok := graph.GetNode(nodeIndex).(*ExchangeOperator); ok {
+				removed = append(removed, exchangeOp)
+			}
+		}
+	}
+	for _, nodeIndex := range removableNodes(engine.baseGraph, index) {
+		engine.baseGraph.removeNode(nodeIndex)
+	}
+	return engine.applyMigration(step, nil, removed)
+}
+
+// Returns @index along with the nodes upstream of it that only feed removed
+// nodes, children first
+func removableNodes(graph *Graph, index int) []int {
+	removed := map[int]bool{index: true}
+	order := []int{index}
+	queue := []Operator{graph.GetNode(index)}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, parent := range node.GetCore().GetParents() {
+			parentIndex := parent.GetCore().GetIndex()
+			if _, ok := parent.(*InputOperator); ok || removed[parentIndex] {
+				continue
+			}
+			unused := true
+			for _, child := range parent.GetCore().GetChildren() {
+				unused = unused && removed[child.GetCore().GetIndex()]
+			}
+			if unused {
+				removed[parentIndex] = true
+				order = append(order, parentIndex)
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return order
+}
+
+// Sends @step to every partition and blocks until it is applied. The
+// listeners of the @added exchanges are launched, and those of the @removed
+// ones are stopped, once every partition has installed the step.
+func (engine *DataflowEngine) applyMigration(step *migrationStep, added []*ExchangeOperator, removed []*ExchangeOperator) error {
+	step.budget = engine.memoryBudget
+	step.proceed = make(chan struct{})
+	step.installed.Add(int(engine.partitionCount))
+	ticket := engine.tickets.issue(0)
+	engine.topologyMu.Lock()
+	for k := range engine.graphs {
+		ticket.add(engineLocation)
+		engine.lifecycle.send(engine.graphChans[k], &BatchMessage{
+			EntryIndex: -1,
+			Ticket:     ticket,
+			location:   engineLocation,
+			migration:  step,
+		})
+	}
+	step.installed.Wait()
+	engine.progress.computeUpstream(engine.graphs[0])
+	for _, exchangeOp := range added {
+		engine.exchanges = append(engine.exchanges, exchangeOp)
+		engine.launchExchange(exchangeOp)
+	}
+	// No partition sends to the removed exchanges anymore
+	for _, exchangeOp := range removed {
+		close(exchangeOp.stop)
+		for i := range engine.exchanges {
+			if engine.exchanges[i] == exchangeOp {
+				engine.exchanges = append(engine.exchanges[:i:i], engine.exchanges[i+1:]...)
+				break
+			}
+		}
+	}
+	engine.topologyMu.Unlock()
+	close(step.proceed)
+	ticket.release(engineLocation)
+	return ticket.Wait()
+}
+
+func (engine *DataflowEngine) planMigration(migration *Migration) (*migrationStep, error) {
+	step := &migrationStep{}
+	next := engine.graphs[0].MintNodeIndex()
+	added := make(map[Operator]bool)
+	// Partitioning of the added operators' outputs, along with their parents
+	// and widths, since they are not part of the engine's graph yet
+	partitionings := make(map[Operator]partitioning)
+	addedParents := make(map[Operator][]Operator)
+	widths := make(map[Operator]uint64)
+	partitioningOf := func(node Operator) partitioning {
+		if added[node] {
+			return partitionings[node]
+		}
+		return engine.partitioningOf(node)
+	}
+	parentsOf := func(node Operator) []Operator {
+		if added[node] {
+			return addedParents[node]
+		}
+		return node.GetCore().GetParents()
+	}
+	widthOf := func(node Operator) uint64 {
+		if added[node] {
+			return widths[node]
+		}
+		return uint64(len(node.GetCore().OutputSchema.ColumnNames))
+	}
+	model := engine.costModel()
+	var addedNodes []Operator
+	for i, node := range migration.nodes {
+		parents := migration.parents[i]
+		for j, parent := range parents {
+			parents[j] = engine.resolve(parent)
+		}
+		if err := engine.validateMigrationNode(node, parents, added); err != nil {
+			return nil, err
+		}
+		// Operators that compute the same records as an existing one are not
+		// added; their children are fed by the existing one instead
+		candidates := append(parents[0].GetCore().GetChildren(), addedNodes...)
+		if same := findSame(node, parents, candidates, parentsOf); same != nil {
+			engine.shared[node] = same
+			continue
+		}
+		required := requiredPartitioning(node)
+		// Joins may broadcast a side rather than shuffle (refer cost.go)
+		var strategy *broadcastJoin
+		if join, ok := node.(*EquiJoinOperator); ok {
+			var edges []edgeEstimate
+			for j, parent := range parents {
+				edges = append(edges, model.estimateEdge(parent, required[j], partitioningOf(parent), parentsOf))
+			}
+			strategy = model.chooseJoinStrategy(join, edges, widthOf(parents[0]))
+			join.broadcast = strategy
+		}
+		var parentIndices []int
+		var backfillFrom []int
+		for j, parent := range parents {
+			parentIndex := parent.GetCore().GetIndex()
+			entryIndex := parentIndex
+			current := partitioningOf(parent)
+			broadcast := strategy != nil && JoinSide(j) == strategy.replicated && !current.replicated
+			shuffle := strategy == nil && required != nil && !current.satisfies(required[j])
+			if broadcast || shuffle {
+				mode := exchangeRouting(current)
+				if broadcast {
+					mode = broadcastRouting
+				}
+				exchanges := engine.newExchanges(required[j], mode)
+				for _, exchangeOp := range exchanges {
+					exchangeOp.GetCore().SetIndex(next)
+				}
+				step.nodes = append(step.nodes, plannedNode{
+					index:     next,
+					parents:   []int{parentIndex},
+					exchanges: exchanges,
+				})
+				if !added[parent] {
+					step.backfill = append(step.backfill, plannedEdge{from: parentIndex, to: next})
+				}
+				entryIndex = next
+				next++
+			} else if !added[parent] {
+				backfillFrom = append(backfillFrom, parentIndex)
+			}
+			parentIndices = append(parentIndices, entryIndex)
+		}
+		node.GetCore().SetIndex(next)
+		step.nodes = append(step.nodes, plannedNode{
+			index:   next,
+			parents: parentIndices,
+			base:    node,
+		})
+		for _, from := range backfillFrom {
+			step.backfill = append(step.backfill, plannedEdge{from: from, to: next})
+		}
+		next++
+		added[node] = true
+		addedNodes = append(addedNodes, node)
+		partitionings[node] = mapPartitioning(node, partitioningOf(parents[0]))
+		addedParents[node] = parents
+		switch op := node.(type) {
+		case *ProjectOperator:
+			widths[node] = uint64(len(op.cids))
+		case *EquiJoinOperator:
+			// The right join column is not emitted
+			widths[node] = widthOf(parents[0]) + widthOf(parents[1]) - 1
+		default:
+			widths[node] = widthOf(parents[0])
+		}
+	}
+	return step, nil
+}
+
+// Maps the columns that the operators of @migration refer to from those of the
+// graph the engine was created with to those of the engine's graph, whose
+// output columns the optimizer may have renumbered (refer pruneJoinInput).
+// Views and joins are not added downstream of renumbered operators, since
+// their records would lack the columns that the optimizer dropped, nor are
+// operators that refer to dropped columns. Returns a function that restores
+// the columns, should the migration fail.
+func (engine *DataflowEngine) translateColumns(migration *Migration) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for _, undo := range restores {
+			undo()
+		}
+	}
+	// Renumbering of the outputs of added filters, which emit the columns of
+	// their parents
+	renumbered := make(map[Operator]map[uint64]uint64)
+	mappingOf := func(node Operator) map[uint64]uint64 {
+		if mapping, ok := renumbered[node]; ok {
+			return mapping
+		}
+		return engine.renumbered[engine.resolve(node)]
+	}
+	translate := func(columns []uint64, mapping map[uint64]uint64) ([]uint64, error) {
+		translated := make([]uint64, len(columns))
+		for i, column := range columns {
+			var ok bool
+			if translated[i], ok = mapping[column]; !ok {
+				return nil, fmt.Errorf("%w: column %d was dropped by the optimizer (refer SetLogicalOptimization)", ErrInvalidMigration, column)
+			}
+		}
+		return translated, nil
+	}
+	for i, node := range migration.nodes {
+		var mapping map[uint64]uint64
+		for _, parent := range migration.parents[i] {
+			if parentMapping := mappingOf(parent); parentMapping != nil {
+				mapping = parentMapping
+			}
+		}
+		if mapping == nil {
+			continue
+		}
+		switch op := node.(type) {
+		case *FilterOperator:
+			cids, err := translate(op.cids, mapping)
+			if err != nil {
+				restore()
+				return nil, err
+			}
+			original := op.cids
+			op.cids = cids
+			restores = append(restores, func() { op.cids = original })
+			renumbered[node] = mapping
+		case *ProjectOperator:
+			cids, err := translate(op.cids, mapping)
+			if err != nil {
+				restore()
+				return nil, err
+			}
+			original := op.cids
+			op.cids = cids
+			restores = append(restores, func() { op.cids = original })
+		default:
+			restore()
+			return nil, fmt.Errorf("%w: the optimizer dropped columns of the parent of a %v (refer SetLogicalOptimization)", ErrInvalidMigration, node.GetCore().opType)
+		}
+	}
+	return restore, nil
+}
+
+// Returns the operator among @candidates that computes the same records as
+// @node would from @parents, or nil if there is none
+func findSame(node Operator, parents []Operator, candidates []Operator, parentsOf parentsFunc) Operator {
+	for _, candidate := range candidates {
+		if sameParents(parentsOf(candidate), parents) && sameParameters(candidate, node) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (engine *DataflowEngine) validateMigrationNode(node Operator, parents []Operator, added map[Operator]bool) error {
+	if node.GetCore().GetGraph() != nil || added[node] {
+		return fmt.Errorf("%w: node is already part of a graph", ErrInvalidMigration)
+	}
+	expected := 1
+	switch node.(type) {
+	case *FilterOperator, *ProjectOperator, *MatViewOperator:
+	case *EquiJoinOperator:
+		expected = 2
+	default:
+		return fmt.Errorf("%w: %v can't be added to a running engine", ErrUnsupportedOperator, node.GetCore().opType)
+	}
+	if len(parents) != expected {
+		return fmt.Errorf("%w: %v expects %d parent(s)", ErrInvalidMigration, node.GetCore().opType, expected)
+	}
+	for _, parent := range parents {
+		if _, ok := parent.(*MatViewOperator); ok {
+			return fmt.Errorf("%w: views can't be parents", ErrInvalidMigration)
+		}
+		if !added[parent] && (parent.GetCore().GetGraph() != engine.baseGraph || engine.baseGraph.GetNode(parent.GetCore().GetIndex()) != parent) {
+			return fmt.Errorf("%w: parent is not part of the engine", ErrInvalidMigration)
+		}
+		if engine.splitNodes[parent.GetCore().GetIndex()] {
+			return fmt.Errorf("%w: parent routes keys split across partitions", ErrInvalidMigration)
+		}
+	}
+	return nil
+}
+
+// Invoked on the partition's goroutine (refer migration.go)
+func (graph *Graph) applyMigration(step *migrationStep) error {
+	for _, index := range step.remove {
+		graph.removeNode(index)
+	}
+	for _, planned := range step.nodes {
+		var node Operator
+		if planned.base != nil {
+			node = planned.base.Clone()
+		} else {
+			node = planned.exchanges[graph.index]
+		}
+		var parents []Operator
+		for _, parentIndex := range planned.parents {
+			parents = append(parents, graph.GetNode(parentIndex))
+		}
+		if view, ok := node.(*MatViewOperator); ok {
+			graph.AddOutputOperator(view, parents[0], false)
+		} else {
+			graph.AddNodeMultipleParents(node, parents, false)
+		}
+	}
+	graph.setMemoryBudget(step.budget)
+	step.installed.Done()
+	<-step.proceed
+
+	for _, edge := range step.backfill {
+		records, err := snapshot(graph.GetNode(edge.from))
+		if err == nil {
+			err = graph.GetNode(edge.to).GetCore().ProcessAndForward(edge.from, &records)
+		}
+		if err != nil {
+			if processErr, ok := err.(*ProcessError); ok {
+				processErr.Partition = graph.index
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the records emitted by @node so far, computed from the state of the
+// operators upstream of it
+func snapshot(node Operator) ([]*Record, error) {
+	switch op := node.(type) {
+	case *InputOperator:
+		return append([]*Record(nil), op.state...), nil
+	case *FilterOperator, *ProjectOperator:
+		records, err := snapshot(node.GetCore().GetParents()[0])
+		if err != nil {
+			return nil, err
+		}
+		var output []*Record
+		if err := node.Process(-1, &records, &output); err != nil {
+			return nil, err
+		}
+		return output, nil
+	case *EquiJoinOperator:
+		return op.snapshot()
+	}
+	return nil, &ProcessError{
+		NodeIndex: node.GetCore().GetIndex(),
+		Type:      node.GetCore().opType,
+		Err:       fmt.Errorf("%w: can't be backfilled from", ErrUnsupportedOperator),
+	}
+}
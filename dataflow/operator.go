@@ -1,8 +1,11 @@
 package dataflow
 
 type Operator interface {
-	Process(source int, input *[]*Record, output *[]*Record) bool
+	Process(source int, input *[]*Record, output *[]*Record) error
 	GetCore() *OperatorCore
 	ComputeOutputSchema()
 	Clone() Operator
+	// Recomputes, from upstream state, the records emitted by the operator
+	// whose value at @column (w.r.t. the output schema) equals @value
+	Upquery(column uint64, value uint64) ([]*Record, error)
 }
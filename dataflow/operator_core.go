@@ -1,5 +1,7 @@
 package dataflow
 
+import "fmt"
+
 type OperatorType uint8
 
 const (
@@ -11,6 +13,24 @@ const (
 	EXCHANGE
 )
 
+func (opType OperatorType) String() string {
+	switch opType {
+	case FILTER:
+		return "Filter"
+	case INPUT:
+		return "Input"
+	case MATVIEW:
+		return "MatView"
+	case PROJECT:
+		return "Project"
+	case EQUIJOIN:
+		return "EquiJoin"
+	case EXCHANGE:
+		return "Exchange"
+	}
+	return fmt.Sprintf("OperatorType(%d)", uint8(opType))
+}
+
 // This struct is used in the form of type composition since golang does not
 // support extending/inheriting structs
 type OperatorCore struct {
@@ -22,8 +42,11 @@ type OperatorCore struct {
 	Children     []*Edge
 	Parents      []*Edge
 	graph        *Graph
-	// Used by the engine for graph traversal
-	IsVisited bool
+	// Size accounting and eviction state; nil for stateless operators
+	memory *memoryState
+	// Message processed by the operator's pipeline stage (refer pipeline.go);
+	// nil while the operator runs on the partition's goroutine
+	current *BatchMessage
 }
 
 func (this *OperatorCore) AddParent(parent Operator, edge *Edge, appendStart bool) {
@@ -46,19 +69,57 @@ func (this *OperatorCore) AddParent(parent Operator, edge *Edge, appendStart boo
 	// edge.To().ComputeOutputSchema()
 }
 
-func (this *OperatorCore) ProcessAndForward(sourceIndex int, records *[]*Record) bool {
+// Returns a *ProcessError identifying the operator that failed (the partition
+// and input are filled in by Graph.Process)
+func (this *OperatorCore) ProcessAndForward(sourceIndex int, records *[]*Record) error {
 	var output []*Record
 	// fmt.Printf("[Proc][Graph%d] Index: %d; Type: %d; #records: %d\n", this.GetGraph().GetIndex(), this.GetIndex(), this.opType, len(*records))
-	if !this.opIface.Process(sourceIndex, records, &output) {
-		return false
+	if err := this.process(sourceIndex, records, &output); err != nil {
+		return &ProcessError{
+			NodeIndex: this.GetIndex(),
+			Type:      this.opType,
+			Err:       err,
+		}
 	}
 	for _, edge := range this.Children {
+		if this.opType == EXCHANGE {
+			// Records forwarded locally by an exchange originate from this partition
+			this.graph.viaPartition = this.graph.GetIndex()
+		}
 		child := edge.To()
-		if !child.GetCore().ProcessAndForward(this.GetIndex(), &output) {
-			return false
+		if err := child.GetCore().ProcessAndForward(this.GetIndex(), &output); err != nil {
+			return err
 		}
 	}
-	return true
+	return nil
+}
+
+// Tickets of the batch being processed; inherited by messages that exchanges
+// send as a consequence
+func (this *OperatorCore) currentTickets() []*Ticket {
+	if this.current != nil {
+		return this.current.tickets()
+	}
+	return this.graph.currentTickets
+}
+
+// Partition whose exchange most recently forwarded the records being processed
+func (this *OperatorCore) viaPartition() uint64 {
+	if this.current != nil {
+		return this.current.SourcePartition
+	}
+	return this.graph.viaPartition
+}
+
+// Invokes the operator's Process, converting a panic into an error so that a
+// bad batch doesn't bring down the partition
+func (this *OperatorCore) process(sourceIndex int, records *[]*Record, output *[]*Record) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrOperatorPanic, r)
+		}
+	}()
+	return this.opIface.Process(sourceIndex, records, output)
 }
 
 func (this *OperatorCore) GetParents() []Operator {
@@ -81,6 +142,15 @@ func (this *OperatorCore) DeleteChildEdges() {
 	this.Children = nil
 }
 
+func (this *OperatorCore) deleteChildEdge(toIndex int) {
+	for i, edge := range this.Children {
+		if edge.To().GetCore().GetIndex() == toIndex {
+			this.Children = append(this.Children[:i:i], this.Children[i+1:]...)
+			return
+		}
+	}
+}
+
 func (this *OperatorCore) DeleteParentEdge(fromIndex int) {
 	index := this.getEdgeIndex(fromIndex, this.Parents)
 	this.Parents = append(this.Parents[:index], this.Parents[index+1:]...)
@@ -113,3 +183,15 @@ func (this *OperatorCore) SetIndex(idx int) {
 func (this *OperatorCore) GetIndex() int {
 	return this.index
 }
+
+// Returns the memory accounting of the operator, or false if it is stateless
+func (this *OperatorCore) GetMemoryUsage() (MemoryUsage, bool) {
+	if this.memory == nil {
+		return MemoryUsage{}, false
+	}
+	var partition uint64
+	if this.graph != nil {
+		partition = this.graph.GetIndex()
+	}
+	return this.memory.usage(partition, this), true
+}
@@ -0,0 +1,572 @@
+package dataflow
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Before the physical plan is made (refer planner.go), the engine rewrites
+// its copy of the graph into an equivalent one that keeps less state and sends
+// fewer records (refer DataflowEngine.SetLogicalOptimization):
+// (a) Operators that compute the same records, i.e. operators of the same type
+// with the same parameters and the same parents, are merged into one that
+// feeds all of their children (refer shareSubplans). Views are never merged.
+// (b) A filter that is the only child of a join is pushed below the join,
+// onto the side(s) that own the columns it tests. Conditions on the left join
+// column apply to both sides, since the right join column holds the same
+// values. Filters that are the only child of a projection are pushed below it.
+// (c) Adjacent filters are merged into one, and so are adjacent projections.
+// (d) Columns of a join's parent that no operator downstream of the join uses
+// (views use all of their input's columns) are dropped by a projection in
+// front of the join, so that neither the join's state nor the exchanges that
+// feed it hold them. The operators downstream refer to the join's output
+// columns by their new positions.
+// Operators that are rewritten away are detached from the copy, and the
+// columns of the operators that remain may be renumbered. Migrations refer to
+// columns as numbered by the graph the engine was created with, which the
+// engine maps to the rewritten graph (refer translateColumns). Operators that
+// were merged into another one may still be passed to migrations and to
+// SplitJoinKey, which refer to the one that replaced them; migrations merge
+// the operators they add likewise (refer planMigration).
+
+// Rewrites the graph until none of the rewrites applies. Returns the
+// operators that were merged into another one (refer shareSubplans), and the
+// renumbering of the output columns of the operators whose columns were
+// renumbered (refer pruneJoinInput).
+func (graph *Graph) optimize() (map[Operator]Operator, map[Operator]map[uint64]uint64) {
+	shared := make(map[Operator]Operator)
+	renumbered := make(map[Operator]map[uint64]uint64)
+	graph.recomputeSchemas()
+	for graph.shareSubplans(shared) || graph.pushDownFilter() || graph.mergeAdjacent() || graph.pruneJoinInput(renumbered) {
+		graph.recomputeSchemas()
+	}
+	return shared, renumbered
+}
+
+// Returns true if @a and @b compute the same records from the same parents
+func sameOperator(a Operator, b Operator) bool {
+	return sameParents(a.GetCore().GetParents(), b.GetCore().GetParents()) && sameParameters(a, b)
+}
+
+func sameParents(a []Operator, b []Operator) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if @a and @b are operators of the same type that compute the
+// same records from the same input, and bound their memory alike
+func sameParameters(a Operator, b Operator) bool {
+	if !a.GetCore().memory.sameLimit(b.GetCore().memory) {
+		return false
+	}
+	switch aOp := a.(type) {
+	case *FilterOperator:
+		bOp, ok := b.(*FilterOperator)
+		return ok && equalColumns(aOp.cids, bOp.cids) && equalColumns(aOp.vals, bOp.vals) && fmt.Sprint(aOp.ops) == fmt.Sprint(bOp.ops)
+	case *ProjectOperator:
+		bOp, ok := b.(*ProjectOperator)
+		return ok && equalColumns(aOp.cids, bOp.cids)
+	case *EquiJoinOperator:
+		bOp, ok := b.(*EquiJoinOperator)
+		return ok && aOp.leftID == bOp.leftID && aOp.rightID == bOp.rightID
+	}
+	// Inputs are distinct by name, and every view is an output of its own
+	return false
+}
+
+func equalColumns(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges every operator into an earlier one (in topological order) that it
+// is the same as, which feeds its children in its place; records the merged
+// operators in @shared. Since parents are merged before their children, whole
+// subgraphs are merged. Returns false if no operator was merged.
+func (graph *Graph) shareSubplans(shared map[Operator]Operator) bool {
+	merged := false
+	var kept []Operator
+	for _, index := range graph.topologicalOrder() {
+		node := graph.nodes[index]
+		var same Operator
+		for _, candidate := range kept {
+			if sameOperator(candidate, node) {
+				same = candidate
+				break
+			}
+		}
+		if same == nil {
+			kept = append(kept, node)
+			continue
+		}
+		graph.replaceNode(node, same)
+		shared[node] = same
+		for duplicate, original := range shared {
+			if original == node {
+				shared[duplicate] = same
+			}
+		}
+		merged = true
+	}
+	return merged
+}
+
+// Removes @node from the graph; @replacement feeds its children in its place
+// (at the same positions among their parents)
+func (graph *Graph) replaceNode(node Operator, replacement Operator) {
+	core := node.GetCore()
+	for _, outgoing := range core.Children {
+		outgoing.SetFrom(replacement)
+		replacement.GetCore().Children = append(replacement.GetCore().Children, outgoing)
+	}
+	core.Children = nil
+	graph.removeNode(core.GetIndex())
+	core.Parents = nil
+}
+
+// Recomputes the schemas of the operators, parents first
+func (graph *Graph) recomputeSchemas() {
+	for _, index := range graph.topologicalOrder() {
+		node := graph.nodes[index]
+		if _, ok := node.(*InputOperator); ok {
+			continue
+		}
+		core := node.GetCore()
+		core.InputSchemas = nil
+		for _, parent := range core.GetParents() {
+			core.InputSchemas = append(core.InputSchemas, parent.GetCore().OutputSchema)
+		}
+		node.ComputeOutputSchema()
+	}
+}
+
+// Returns the number of columns that @node emits
+func width(node Operator) uint64 {
+	return uint64(len(node.GetCore().OutputSchema.ColumnNames))
+}
+
+// Returns the node's only child, if it has exactly one
+func onlyChild(node Operator) (Operator, bool) {
+	if children := node.GetCore().GetChildren(); len(children) == 1 {
+		return children[0], true
+	}
+	return nil, false
+}
+
+// Pushes one filter below its parent join or projection; returns false if no
+// filter can be pushed
+func (graph *Graph) pushDownFilter() bool {
+	for _, index := range graph.topologicalOrder() {
+		filter, ok := graph.nodes[index].(*FilterOperator)
+		if !ok || len(filter.cids) != len(filter.ops) || len(filter.ops) != len(filter.vals) {
+			continue
+		}
+		parent := filter.GetCore().GetParents()[0]
+		if child, ok := onlyChild(parent); !ok || child != Operator(filter) {
+			continue
+		}
+		switch op := parent.(type) {
+		case *EquiJoinOperator:
+			if graph.pushBelowJoin(filter, op) {
+				return true
+			}
+		case *ProjectOperator:
+			if graph.pushBelowProject(filter, op) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conditions of a filter
+type conditions struct {
+	cids []uint64
+	ops  []CompOp
+	vals []uint64
+}
+
+func (this *conditions) add(cid uint64, op CompOp, val uint64) {
+	this.cids = append(this.cids, cid)
+	this.ops = append(this.ops, op)
+	this.vals = append(this.vals, val)
+}
+
+func (graph *Graph) pushBelowJoin(filter *FilterOperator, join *EquiJoinOperator) bool {
+	leftWidth := width(join.GetCore().GetParents()[0])
+	rightWidth := width(join.GetCore().GetParents()[1])
+	var sides [2]conditions
+	for i, cid := range filter.cids {
+		switch {
+		case cid < leftWidth:
+			sides[LeftSide].add(cid, filter.ops[i], filter.vals[i])
+			if cid == join.leftID {
+				sides[RightSide].add(join.rightID, filter.ops[i], filter.vals[i])
+			}
+		case cid < leftWidth+rightWidth-1:
+			// The right join column is not emitted (refer emitRecord)
+			rightColumn := cid - leftWidth
+			if rightColumn >= join.rightID {
+				rightColumn++
+			}
+			sides[RightSide].add(rightColumn, filter.ops[i], filter.vals[i])
+		default:
+			// The filter fails once records are processed
+			return false
+		}
+	}
+	for _, side := range []JoinSide{LeftSide, RightSide} {
+		if len(sides[side].cids) > 0 {
+			pushed := NewFilterOperator(sides[side].cids, sides[side].ops, sides[side].vals)
+			graph.InsertNodeOnEdge(pushed, join, int(side))
+		}
+	}
+	graph.bypassNode(filter)
+	return true
+}
+
+func (graph *Graph) pushBelowProject(filter *FilterOperator, project *ProjectOperator) bool {
+	var pushed conditions
+	for i, cid := range filter.cids {
+		if cid >= uint64(len(project.cids)) {
+			return false
+		}
+		pushed.add(project.cids[cid], filter.ops[i], filter.vals[i])
+	}
+	graph.InsertNodeOnEdge(NewFilterOperator(pushed.cids, pushed.ops, pushed.vals), project, 0)
+	graph.bypassNode(filter)
+	return true
+}
+
+// Merges one filter (or projection) into its parent filter (or projection);
+// returns false if there is none to merge
+func (graph *Graph) mergeAdjacent() bool {
+	for _, index := range graph.topologicalOrder() {
+		node := graph.nodes[index]
+		parents := node.GetCore().GetParents()
+		if len(parents) != 1 {
+			continue
+		}
+		if child, ok := onlyChild(parents[0]); !ok || child != node {
+			continue
+		}
+		switch op := node.(type) {
+		case *FilterOperator:
+			parent, ok := parents[0].(*FilterOperator)
+			if !ok {
+				continue
+			}
+			// The filters' conditions are conjunctions
+			parent.cids = append(append([]uint64(nil), parent.cids...), op.cids...)
+			parent.ops = append(append([]CompOp(nil), parent.ops...), op.ops...)
+			parent.vals = append(append([]uint64(nil), parent.vals...), op.vals...)
+			graph.bypassNode(node)
+			return true
+		case *ProjectOperator:
+			parent, ok := parents[0].(*ProjectOperator)
+			if !ok {
+				continue
+			}
+			var cids []uint64
+			for _, cid := range op.cids {
+				if cid >= uint64(len(parent.cids)) {
+					cids = nil
+					break
+				}
+				cids = append(cids, parent.cids[cid])
+			}
+			if cids == nil {
+				continue
+			}
+			parent.cids = cids
+			graph.bypassNode(node)
+			return true
+		}
+	}
+	return false
+}
+
+// Removes @node, which has a single parent, from the graph: its parent feeds
+// its children in its place (at the same positions among their parents)
+func (graph *Graph) bypassNode(node Operator) {
+	core := node.GetCore()
+	incoming := core.Parents[0]
+	parent := incoming.From()
+	var children []*Edge
+	for _, edge := range parent.GetCore().Children {
+		if edge != incoming {
+			children = append(children, edge)
+			continue
+		}
+		for _, outgoing := range core.Children {
+			outgoing.SetFrom(parent)
+			children = append(children, outgoing)
+		}
+	}
+	parent.GetCore().Children = children
+	for edgeIndex, edge := range graph.edges {
+		if edge == incoming {
+			delete(graph.edges, edgeIndex)
+		}
+	}
+	delete(graph.nodes, core.GetIndex())
+	core.Parents, core.Children = nil, nil
+}
+
+// Returns the columns of each node's output that the operators downstream of
+// it use, by node index
+func (graph *Graph) usedColumns() map[int]map[uint64]bool {
+	used := make(map[int]map[uint64]bool)
+	order := graph.topologicalOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		node := graph.nodes[order[i]]
+		columns := make(map[uint64]bool)
+		if len(node.GetCore().Children) == 0 {
+			addAll(columns, width(node))
+		}
+		for _, edge := range node.GetCore().Children {
+			for column := range edgeColumns(edge, used) {
+				columns[column] = true
+			}
+		}
+		used[order[i]] = columns
+	}
+	return used
+}
+
+// Returns the columns of @edge's source that its destination uses, given the
+// columns used of the destination's output (@used)
+func edgeColumns(edge *Edge, used map[int]map[uint64]bool) map[uint64]bool {
+	columns := make(map[uint64]bool)
+	child := edge.To()
+	childUsed := used[child.GetCore().GetIndex()]
+	switch op := child.(type) {
+	case *FilterOperator:
+		for column := range childUsed {
+			columns[column] = true
+		}
+		for _, cid := range op.cids {
+			columns[cid] = true
+		}
+	case *ProjectOperator:
+		for _, cid := range op.cids {
+			columns[cid] = true
+		}
+	case *EquiJoinOperator:
+		leftWidth := width(op.GetCore().GetParents()[0])
+		if op.GetCore().Parents[0] == edge {
+			columns[op.leftID] = true
+			for column := range childUsed {
+				if column < leftWidth {
+					columns[column] = true
+				}
+			}
+		} else {
+			columns[op.rightID] = true
+			for column := range childUsed {
+				if column < leftWidth {
+					continue
+				}
+				rightColumn := column - leftWidth
+				if rightColumn >= op.rightID {
+					rightColumn++
+				}
+				columns[rightColumn] = true
+			}
+		}
+	default:
+		// Views emit every column of their input
+		addAll(columns, width(edge.From()))
+	}
+	return columns
+}
+
+func addAll(columns map[uint64]bool, count uint64) {
+	var column uint64
+	for column = 0; column < count; column++ {
+		columns[column] = true
+	}
+}
+
+// Drops the unused columns of one of a join's parents by a projection in front
+// of the join; returns false if no join has a parent with unused columns.
+// Adds the renumbering of the operators downstream of the join to
+// @renumbered, which maps the columns that the graph was built with.
+func (graph *Graph) pruneJoinInput(renumbered map[Operator]map[uint64]uint64) bool {
+	used := graph.usedColumns()
+	order := graph.topologicalOrder()
+	// Joins downstream first, so that their projections are in place when the
+	// columns used upstream of them are determined
+	for i := len(order) - 1; i >= 0; i-- {
+		join, ok := graph.nodes[order[i]].(*EquiJoinOperator)
+		if !ok {
+			continue
+		}
+		for position, edge := range join.GetCore().Parents {
+			columns := edgeColumns(edge, used)
+			parentWidth := width(edge.From())
+			if uint64(len(columns)) >= parentWidth {
+				continue
+			}
+			var kept []uint64
+			for column := range columns {
+				if column >= parentWidth {
+					// Operators downstream refer to columns that don't exist, which
+					// fails once records are processed
+					kept = nil
+					break
+				}
+				kept = append(kept, column)
+			}
+			if kept == nil {
+				continue
+			}
+			sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+			project := NewProjectOperator(kept)
+			graph.InsertNodeOnEdge(project, join, position)
+			mapping := make(map[uint64]uint64)
+			for newColumn, column := range kept {
+				mapping[column] = uint64(newColumn)
+			}
+			for node, renumbering := range graph.renumberDownstream(project, mapping) {
+				if node != Operator(project) {
+					renumbered[node] = composeMapping(renumbered[node], renumbering.mapping)
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Renumbering of the columns of an operator's output
+type renumbering struct {
+	// Maps old columns to new ones; unused columns are absent
+	mapping map[uint64]uint64
+	width   uint64
+}
+
+// Rewrites the columns that the operators downstream of @source refer to,
+// once @source's output columns are renumbered by @mapping. Must be invoked
+// before the schemas are recomputed, since the operators' input schemas give
+// the widths before the renumbering. Returns the renumbering of the output of
+// every operator whose output columns were renumbered.
+func (graph *Graph) renumberDownstream(source Operator, mapping map[uint64]uint64) map[Operator]*renumbering {
+	renumbered := map[Operator]*renumbering{
+		source: {mapping: mapping, width: width(source)},
+	}
+	for _, index := range graph.topologicalOrder() {
+		node := graph.nodes[index]
+		if node == source {
+			continue
+		}
+		core := node.GetCore()
+		inputs := make([]*renumbering, len(core.Parents))
+		changed := false
+		for position, edge := range core.Parents {
+			if input, ok := renumbered[edge.From()]; ok {
+				inputs[position], changed = input, true
+			}
+		}
+		if !changed {
+			continue
+		}
+		switch op := node.(type) {
+		case *FilterOperator:
+			op.cids = renumberAll(op.cids, inputs[0].mapping)
+			renumbered[node] = inputs[0]
+		case *ProjectOperator:
+			op.cids = renumberAll(op.cids, inputs[0].mapping)
+		case *MatViewOperator:
+			op.key = inputs[0].mapping[op.key]
+		case *EquiJoinOperator:
+			renumbered[node] = op.renumber(inputs)
+		}
+	}
+	return renumbered
+}
+
+// Returns @second applied after @first (nil if the columns were not
+// renumbered before)
+func composeMapping(first map[uint64]uint64, second map[uint64]uint64) map[uint64]uint64 {
+	if first == nil {
+		return second
+	}
+	composed := make(map[uint64]uint64)
+	for column, renumbered := range first {
+		if again, ok := second[renumbered]; ok {
+			composed[column] = again
+		}
+	}
+	return composed
+}
+
+func renumberAll(columns []uint64, mapping map[uint64]uint64) []uint64 {
+	renumbered := make([]uint64, len(columns))
+	for i, column := range columns {
+		renumbered[i] = mapping[column]
+	}
+	return renumbered
+}
+
+// Renumbers the join columns once the columns of its parents are renumbered by
+// @inputs (nil for a parent whose columns are unchanged); returns the
+// renumbering of the join's output
+func (op *EquiJoinOperator) renumber(inputs []*renumbering) *renumbering {
+	sides := make([]*renumbering, 2)
+	for side := range sides {
+		sides[side] = inputs[side]
+		if sides[side] == nil {
+			// The input schemas give the widths before the renumbering
+			count := uint64(len(op.GetCore().InputSchemas[side].ColumnNames))
+			sides[side] = &renumbering{mapping: make(map[uint64]uint64), width: count}
+			var column uint64
+			for column = 0; column < count; column++ {
+				sides[side].mapping[column] = column
+			}
+		}
+	}
+	oldLeftWidth := uint64(len(op.GetCore().InputSchemas[0].ColumnNames))
+	oldRightWidth := uint64(len(op.GetCore().InputSchemas[1].ColumnNames))
+	oldRightID := op.rightID
+	op.leftID = sides[LeftSide].mapping[op.leftID]
+	op.rightID = sides[RightSide].mapping[op.rightID]
+	output := &renumbering{
+		mapping: make(map[uint64]uint64),
+		width:   sides[LeftSide].width + sides[RightSide].width - 1,
+	}
+	for column, renumbered := range sides[LeftSide].mapping {
+		output.mapping[column] = renumbered
+	}
+	var column uint64
+	for column = 0; column < oldRightWidth; column++ {
+		renumbered, ok := sides[RightSide].mapping[column]
+		if column == oldRightID || !ok {
+			continue
+		}
+		oldOutput := oldLeftWidth + column
+		if column > oldRightID {
+			oldOutput--
+		}
+		newOutput := sides[LeftSide].width + renumbered
+		if renumbered > op.rightID {
+			newOutput--
+		}
+		output.mapping[oldOutput] = newOutput
+	}
+	return output
+}
@@ -0,0 +1,217 @@
+package dataflow
+
+import "fmt"
+
+// The planner tracks how the records emitted by each operator are partitioned
+// as a physical property, in terms of the operator's own output schema:
+// (a) Inputs are partitioned by the column that the planner sets for them
+// (refer physicalPlan.inputPartition); until it does, their partitioning is
+// undecided. Broadcast inputs are replicated to every partition instead
+// (refer cost.go).
+// (b) Filters preserve the partitioning of their input. Projections map the
+// partitioning column to its position in their output, and drop the
+// partitioning altogether if they drop the column.
+// (c) Joins emit records partitioned by the left join column (which keeps its
+// position in the output schema), and exchanges by their partitioning column.
+// Joins that broadcast a side emit records partitioned as their other side
+// (refer cost.go), and the records of broadcasting exchanges are replicated.
+// An operator that requires its parents to be partitioned by some column
+// (refer requiredPartitioning) is fed through an exchange exactly when its
+// parent's partitioning differs from the requirement. An undecided
+// partitioning is decided at the inputs instead, which needs no exchange.
+// Replicated records are partitioned by an exchange that keeps the records
+// each partition owns (refer localRouting), which sends none.
+// An input may feed several operators that require it partitioned by
+// different columns (e.g. a join and a view keyed by another column). Since an
+// input has a single partitioning column, the planner partitions it by the
+// column that most of them require before planning them (refer
+// partitionSharedInputs), and the others are fed through exchanges. Once
+// planned, every requirement is checked (refer checkPartitioning).
+
+type partitioning struct {
+	// Unset while the records come from inputs whose partitioning is yet to be
+	// decided
+	decided bool
+	// Set if the records are hash partitioned by @column; unset if no column
+	// determines their partition
+	keyed  bool
+	column uint64
+	// Set if every partition receives every record
+	replicated bool
+}
+
+func keyedBy(column uint64) partitioning {
+	return partitioning{
+		decided: true,
+		keyed:   true,
+		column:  column,
+	}
+}
+
+// Returns true if records partitioned as @this are partitioned by @column
+func (this partitioning) satisfies(column uint64) bool {
+	return this.decided && this.keyed && this.column == column
+}
+
+// Returns the partitioning column that each of @node's parents must provide
+// (nil if the node can process records however they are partitioned)
+func requiredPartitioning(node Operator) []uint64 {
+	switch op := node.(type) {
+	case *EquiJoinOperator:
+		return []uint64{op.GetLeftPartitionColumn(), op.GetRightPartitionColumn()}
+	case *MatViewOperator:
+		return []uint64{op.GetKey()}
+	}
+	return nil
+}
+
+// Returns the partitioning of the records emitted by @node, an operator of
+// the engine's graph (or of a partition's graph)
+func (engine *DataflowEngine) partitioningOf(node Operator) partitioning {
+	return engine.plan.partitioningOf(node, engine.splitJoins)
+}
+
+// Returns the partitioning of the records emitted by @node under the plan.
+// The output of the joins in @splitJoins comes out of every partition (refer
+// skew.go).
+func (plan *physicalPlan) partitioningOf(node Operator, splitJoins map[int]bool) partitioning {
+	switch op := node.(type) {
+	case *InputOperator:
+		if plan.broadcastInputs[op.GetName()] {
+			return partitioning{decided: true, replicated: true}
+		}
+		if column, ok := plan.inputPartition[op.GetName()]; ok {
+			return keyedBy(column)
+		}
+		return partitioning{}
+	case *EquiJoinOperator:
+		if splitJoins[op.GetCore().GetIndex()] {
+			return partitioning{decided: true}
+		}
+		if strategy, ok := plan.joins[op.GetCore().GetIndex()]; ok {
+			return strategy.output
+		}
+	}
+	var input partitioning
+	if parents := node.GetCore().GetParents(); len(parents) > 0 {
+		input = plan.partitioningOf(parents[0], splitJoins)
+	}
+	return mapPartitioning(node, input)
+}
+
+// Returns the partitioning of the records that @node emits for records of
+// its first parent partitioned as @input. Joins whose strategy the plan holds
+// are mapped by physicalPlan.partitioningOf instead.
+func mapPartitioning(node Operator, input partitioning) partitioning {
+	switch op := node.(type) {
+	case *FilterOperator:
+		return input
+	case *ProjectOperator:
+		if input.keyed {
+			input.column, input.keyed = op.mapColumn(input.column)
+		}
+		return input
+	case *EquiJoinOperator:
+		if op.broadcast != nil {
+			return op.broadcast.output
+		}
+		// Both sides are partitioned by their join columns once planned
+		return keyedBy(op.GetParitionColumn())
+	case *ExchangeOperator:
+		if op.routing.mode == broadcastRouting {
+			return partitioning{decided: true, replicated: true}
+		}
+		return keyedBy(op.partitionColumn)
+	case *MatViewOperator:
+		if op.scatter != nil {
+			// The view keeps its records where its parent emits them
+			return input
+		}
+		return keyedBy(op.GetKey())
+	}
+	return partitioning{decided: true}
+}
+
+// Returns how an exchange partitions records that are partitioned as
+// @current by its column
+func exchangeRouting(current partitioning) routingMode {
+	if current.replicated {
+		return localRouting
+	}
+	return hashRouting
+}
+
+// Reports the column of the input that every operator downstream of @node
+// requires its records partitioned by, as long as only filters and
+// projections separate it from the input. @source maps the columns of
+// @node's output to those of the input.
+func collectDemand(node Operator, source func(column uint64) (uint64, bool), report func(column uint64)) {
+	for _, child := range node.GetCore().GetChildren() {
+		switch op := child.(type) {
+		case *FilterOperator:
+			collectDemand(child, source, report)
+		case *ProjectOperator:
+			collectDemand(child, func(column uint64) (uint64, bool) {
+				if column >= uint64(len(op.cids)) {
+					return 0, false
+				}
+				return source(op.cids[column])
+			}, report)
+		default:
+			required := requiredPartitioning(child)
+			for position, parent := range child.GetCore().GetParents() {
+				if parent != node || position >= len(required) {
+					continue
+				}
+				if column, ok := source(required[position]); ok {
+					report(column)
+				}
+			}
+		}
+	}
+}
+
+// Returns a *ProcessError wrapping ErrPartitioningConflict if an operator of
+// @graph (a partition's graph) receives records that are not partitioned as it
+// requires
+func (engine *DataflowEngine) checkPartitioning(graph *Graph) error {
+	for _, index := range graph.topologicalOrder() {
+		node := graph.GetNode(index)
+		required := requiredPartitioning(node)
+		if required == nil {
+			continue
+		}
+		var broadcast *broadcastJoin
+		var scatter *scatteredView
+		switch op := node.(type) {
+		case *EquiJoinOperator:
+			broadcast = op.broadcast
+		case *MatViewOperator:
+			scatter = op.scatter
+		}
+		for position, parent := range node.GetCore().GetParents() {
+			current := engine.partitioningOf(parent)
+			var valid bool
+			switch {
+			case scatter != nil:
+				// Rescaling places the view's records by the column
+				valid = current.satisfies(scatter.column)
+			case broadcast == nil:
+				valid = current.satisfies(required[position])
+			case JoinSide(position) == broadcast.replicated:
+				valid = current.replicated
+			default:
+				valid = current.decided && !current.replicated
+			}
+			if !valid {
+				return &ProcessError{
+					NodeIndex: index,
+					Type:      node.GetCore().opType,
+					Err: fmt.Errorf("%w: parent %d emits records %s rather than partitioned by column %d",
+						ErrPartitioningConflict, position, describePartitioning(current), required[position]),
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package dataflow
+
+import "sync"
+
+// In pipelined mode (refer DataflowEngine.SetPipelined), the operators of a
+// partition run as pipeline stages rather than on the partition's goroutine:
+// every operator has a worker that processes the batches queued at its stage
+// one at a time, and queues its output at the stages of its children. The
+// partition's goroutine merely dispatches batches to the stages at which they
+// enter the graph, hence a partition keeps as many cores busy as its graph has
+// operators with work queued.
+// A stage processes its queue in order, hence the batches sent along an edge
+// are processed in the order in which they were sent, as when the graph runs
+// on a single goroutine; per-key ordering is thus preserved. Only operators
+// with several parents (i.e. joins) may see their parents' batches
+// interleaved differently, which a symmetric hash join doesn't depend on.
+// Any other message (upqueries, replays, migrations, tasks and expiry) reads
+// or changes the state of several operators, hence the partition's goroutine
+// waits for the stages to become idle before handling it on its own, as when
+// not pipelined.
+// A batch queued at a stage is accounted at the stage's node by its ticket, so
+// that progress frontiers advance as batches move down the pipeline.
+
+type pipeline struct {
+	graph  *Graph
+	stages map[int]*stage
+	// Counts the batches queued at or processed by the stages
+	busy    sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+type stage struct {
+	node   Operator
+	mu     sync.Mutex
+	ready  *sync.Cond
+	queue  []*BatchMessage
+	closed bool
+}
+
+// Launches a worker for each of the graph's nodes
+func (graph *Graph) startPipeline() *pipeline {
+	p := &pipeline{
+		graph:  graph,
+		stages: make(map[int]*stage),
+	}
+	for index, node := range graph.nodes {
+		s := &stage{node: node}
+		s.ready = sync.NewCond(&s.mu)
+		p.stages[index] = s
+	}
+	for _, s := range p.stages {
+		p.workers.Add(1)
+		go p.run(s)
+	}
+	return p
+}
+
+// Hands the batch of @msg to the stage at which it enters the graph. The
+// caller releases @msg's ticket as usual.
+func (p *pipeline) dispatch(msg *BatchMessage) error {
+	graph := p.graph
+	entry := &BatchMessage{
+		InputName:       msg.InputName,
+		SourceIndex:     msg.SourceIndex,
+		Records:         msg.Records,
+		SourcePartition: msg.SourcePartition,
+		Ticket:          msg.Ticket,
+		coalesced:       msg.coalesced,
+	}
+	if msg.EntryIndex != -1 {
+		if _, ok := graph.nodes[msg.EntryIndex]; !ok {
+			// The node was removed while the batch was in flight (refer
+			// Graph.Process)
+			return nil
+		}
+		p.push(msg.EntryIndex, entry)
+	} else if inputNode, ok := graph.inputs[msg.InputName]; ok {
+		entry.SourceIndex = -1
+		entry.SourcePartition = graph.index
+		p.push(inputNode.GetCore().GetIndex(), entry)
+	} else {
+		return &ProcessError{
+			Partition: graph.index,
+			NodeIndex: -1,
+			InputName: msg.InputName,
+			Err:       ErrUnknownInput,
+		}
+	}
+	return nil
+}
+
+// Queues @msg at the stage of node @index
+func (p *pipeline) push(index int, msg *BatchMessage) {
+	msg.EntryIndex = index
+	msg.location = index
+	for _, ticket := range msg.tickets() {
+		ticket.add(index)
+	}
+	p.busy.Add(1)
+	s := p.stages[index]
+	s.mu.Lock()
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+	s.ready.Signal()
+}
+
+// Blocks until a batch is queued at the stage; returns false once the stage is
+// closed
+func (s *stage) pop() (*BatchMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 && !s.closed {
+		s.ready.Wait()
+	}
+	if s.closed {
+		return nil, false
+	}
+	msg := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return msg, true
+}
+
+// Supposed to be used as an entry point for a stage's worker
+func (p *pipeline) run(s *stage) {
+	defer p.workers.Done()
+	core := s.node.GetCore()
+	for {
+		msg, ok := s.pop()
+		if !ok {
+			return
+		}
+		var output []*Record
+		core.current = msg
+		err := core.process(msg.SourceIndex, msg.Records, &output)
+		core.current = nil
+		if err != nil {
+			failure := &ProcessError{
+				Partition: p.graph.index,
+				NodeIndex: core.GetIndex(),
+				Type:      core.opType,
+				InputName: msg.InputName,
+				Err:       err,
+			}
+			for _, ticket := range msg.tickets() {
+				ticket.fail(failure)
+			}
+		} else {
+			via := msg.SourcePartition
+			if core.opType == EXCHANGE {
+				// Records forwarded locally by an exchange originate from this
+				// partition
+				via = p.graph.index
+			}
+			for _, edge := range core.Children {
+				p.push(edge.To().GetCore().GetIndex(), &BatchMessage{
+					InputName:       msg.InputName,
+					SourceIndex:     core.GetIndex(),
+					Records:         &output,
+					SourcePartition: via,
+					Ticket:          msg.Ticket,
+					coalesced:       msg.coalesced,
+				})
+			}
+		}
+		for _, ticket := range msg.tickets() {
+			ticket.release(msg.location)
+		}
+		p.busy.Done()
+	}
+}
+
+// Blocks until no batch is queued at or processed by a stage, after which the
+// partition's goroutine has exclusive access to the operators' state
+func (p *pipeline) drain() {
+	p.busy.Wait()
+}
+
+// Stops the workers; batches that are still queued are dropped
+func (p *pipeline) stop() {
+	for _, s := range p.stages {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		s.ready.Broadcast()
+	}
+	p.workers.Wait()
+	for _, s := range p.stages {
+		for _, msg := range s.queue {
+			p.graph.lifecycle.drop(msg)
+		}
+		s.queue = nil
+	}
+}
@@ -0,0 +1,316 @@
+package dataflow
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Planning separates the logical graph, i.e. the operators that the user
+// connects (refer Graph), from the physical plan that the partitions run:
+// (1) Once started, the engine copies the graph it was created with, and
+// rewrites the copy (refer optimizer.go). The graph itself is only read, hence
+// it may back several engines, or be changed and started again.
+// (2) A planner decides, for the copy, how every input is partitioned, how
+// every join receives the records of its parents, how every view is read, and
+// which edges need exchanges (refer partitioning.go, cost.go and scatter.go). It only reads the graph, and
+// records its decisions in a physicalPlan.
+// (3) The engine instantiates the plan: it clones the copy for every
+// partition, and inserts the plan's exchanges into the clones.
+// Migrations extend the engine's plan (refer planMigration). Operators of the
+// graph the engine was created with are mapped to their copies wherever the
+// engine is passed one (refer DataflowEngine.resolve).
+
+// Decisions of the planner for a logical graph
+type physicalPlan struct {
+	// Partitioning column of each input, by name
+	inputPartition map[string]uint64
+	// Inputs replicated to every partition, by name
+	broadcastInputs map[string]bool
+	// Joins that broadcast a side, by node index
+	joins map[int]*broadcastJoin
+	// Views read from every partition, by node index
+	scatteredViews map[int]*scatteredView
+	// Exchanges to insert, in the order in which they were planned
+	exchanges []plannedExchange
+}
+
+// Exchange on the edge from the parent at @position (among its parents) of
+// the node at @child
+type plannedExchange struct {
+	child    int
+	position int
+	column   uint64
+	mode     routingMode
+}
+
+func newPhysicalPlan() *physicalPlan {
+	return &physicalPlan{
+		inputPartition:  make(map[string]uint64),
+		broadcastInputs: make(map[string]bool),
+		joins:           make(map[int]*broadcastJoin),
+		scatteredViews:  make(map[int]*scatteredView),
+	}
+}
+
+type planner struct {
+	graph *Graph
+	model costModel
+	// Inputs to replicate to every partition (refer BroadcastInput)
+	broadcastInputs map[string]bool
+	plan            *physicalPlan
+	visited         map[int]bool
+}
+
+func newPlanner(graph *Graph, model costModel, broadcastInputs map[string]bool) *planner {
+	return &planner{
+		graph:           graph,
+		model:           model,
+		broadcastInputs: broadcastInputs,
+		plan:            newPhysicalPlan(),
+		visited:         make(map[int]bool),
+	}
+}
+
+// Returns the plan of the planner's graph, or an error if the graph can't be
+// partitioned
+func (planner *planner) planGraph() (*physicalPlan, error) {
+	// Inputs are visited in the order in which they were added, so that the
+	// plan doesn't depend on the order of map iteration
+	var inputs []*InputOperator
+	for _, op := range planner.graph.GetInputs() {
+		inputs = append(inputs, op)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].GetCore().GetIndex() < inputs[j].GetCore().GetIndex()
+	})
+	// Hinted inputs are replicated before any operator is planned, so that
+	// joins plan against them (refer cost.go)
+	for name := range planner.broadcastInputs {
+		input, ok := planner.graph.GetInputs()[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q can't be broadcast", ErrUnknownInput, name)
+		}
+		planner.replicateInputs(input)
+	}
+	planner.partitionSharedInputs(inputs)
+	for _, op := range inputs {
+		if err := planner.visitNode(op); err != nil {
+			return nil, err
+		}
+	}
+	for name := range planner.graph.GetInputs() {
+		if _, ok := planner.plan.inputPartition[name]; !ok {
+			// Process partitions by the 0th column by default
+			planner.plan.inputPartition[name] = 0
+		}
+	}
+	return planner.plan, nil
+}
+
+func (planner *planner) partitioningOf(node Operator) partitioning {
+	return planner.plan.partitioningOf(node, nil)
+}
+
+func (planner *planner) visitNode(node Operator) error {
+	if planner.visited[node.GetCore().GetIndex()] {
+		return nil
+	}
+	fmt.Printf("[VISIT] Node: %d of Type: %d\n", node.GetCore().GetIndex(), node.GetCore().opType)
+	planner.visited[node.GetCore().GetIndex()] = true
+	switch op := node.(type) {
+	case *InputOperator:
+		// The initial partitioning column will be decided later (based on join
+		// matview... etc). An input operator by default is partitioned by 0th column.
+		// (semantically could be partitioned by the record key as well)
+	case *FilterOperator:
+	case *ProjectOperator:
+		// These operators don't require any shuffle
+	case *MatViewOperator:
+		// The parent is partitioned as the view requires, at the inputs if
+		// possible and by an exchange otherwise (refer partitioning.go),
+		// unless reading the view from every partition is cheaper (refer
+		// scatter.go)
+		if !planner.scatterView(op) {
+			planner.requirePartitioning(node, 0, op.GetKey())
+		}
+	case *EquiJoinOperator:
+		// Both sides are partitioned by the join key, unless broadcasting one
+		// of them is cheaper (refer cost.go)
+		planner.planJoin(op)
+	default:
+		return &ProcessError{
+			NodeIndex: node.GetCore().GetIndex(),
+			Type:      node.GetCore().opType,
+			Err:       fmt.Errorf("%w: cannot be partitioned", ErrUnsupportedOperator),
+		}
+	}
+	// An operator may feed several children (i.e. the graph is a DAG), each of
+	// which decides on the partitioning of its own incoming edges
+	for _, child := range node.GetCore().GetChildren() {
+		if err := planner.visitNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes the records that @node receives from its parent at @position (among
+// its parents) partitioned by @column: at the inputs if the parent's
+// partitioning is undecided, or else by an exchange unless they already are
+func (planner *planner) requirePartitioning(node Operator, position int, column uint64) {
+	parent := node.GetCore().GetParents()[position]
+	current := planner.partitioningOf(parent)
+	if !current.decided {
+		planner.partitionInputs(parent, column)
+	} else if !current.satisfies(column) {
+		planner.addExchange(node, position, column, exchangeRouting(current))
+	}
+}
+
+func (planner *planner) addExchange(node Operator, position int, column uint64, mode routingMode) {
+	planner.plan.exchanges = append(planner.plan.exchanges, plannedExchange{
+		child:    node.GetCore().GetIndex(),
+		position: position,
+		column:   column,
+		mode:     mode,
+	})
+}
+
+// Plans how @join receives the records of its parents
+func (planner *planner) planJoin(join *EquiJoinOperator) {
+	required := requiredPartitioning(join)
+	parents := join.GetCore().GetParents()
+	var edges []edgeEstimate
+	for side, parent := range parents {
+		edges = append(edges, planner.model.estimateEdge(parent, required[side], planner.partitioningOf(parent), graphParents))
+	}
+	leftWidth := uint64(len(parents[0].GetCore().OutputSchema.ColumnNames))
+	strategy := planner.model.chooseJoinStrategy(join, edges, leftWidth)
+	if strategy == nil {
+		for position, column := range required {
+			planner.requirePartitioning(join, position, column)
+		}
+		return
+	}
+	switch current := edges[strategy.replicated].current; {
+	case current.replicated:
+		// Every partition holds the side's records already
+	case !current.decided:
+		planner.replicateInputs(parents[strategy.replicated])
+	default:
+		planner.addExchange(join, int(strategy.replicated), 0, broadcastRouting)
+	}
+	if local := 1 - strategy.replicated; !edges[local].current.decided {
+		planner.partitionInputs(parents[local], required[local])
+	}
+	planner.plan.joins[join.GetCore().GetIndex()] = strategy
+}
+
+// Keeps @view partitioned as its parent's records are, if its parent's
+// partitioning is decided and differs from the view's key and reading the view
+// from every partition is cheaper than an exchange. Returns true if it does.
+func (planner *planner) scatterView(view *MatViewOperator) bool {
+	parent := view.GetCore().GetParents()[0]
+	current := planner.partitioningOf(parent)
+	if !current.decided || !current.keyed || current.replicated || current.satisfies(view.GetKey()) {
+		return false
+	}
+	edge := planner.model.estimateEdge(parent, view.GetKey(), current, graphParents)
+	strategy := planner.model.chooseViewReads(view, edge)
+	if strategy == nil {
+		return false
+	}
+	planner.plan.scatteredViews[view.GetCore().GetIndex()] = strategy
+	return true
+}
+
+// Partitions the inputs that @node's records come from such that the records
+// are partitioned by @column of @node's output. @node's partitioning must be
+// undecided, i.e. only filters and projections separate it from its input.
+func (planner *planner) partitionInputs(node Operator, column uint64) {
+	switch op := node.(type) {
+	case *InputOperator:
+		planner.plan.inputPartition[op.GetName()] = column
+	case *FilterOperator:
+		planner.partitionInputs(op.GetCore().GetParents()[0], column)
+	case *ProjectOperator:
+		planner.partitionInputs(op.GetCore().GetParents()[0], op.cids[column])
+	}
+}
+
+// Replicates the inputs that @node's records come from to every partition.
+// @node's partitioning must be undecided (refer partitionInputs).
+func (planner *planner) replicateInputs(node Operator) {
+	switch op := node.(type) {
+	case *InputOperator:
+		planner.plan.broadcastInputs[op.GetName()] = true
+	case *FilterOperator, *ProjectOperator:
+		planner.replicateInputs(op.GetCore().GetParents()[0])
+	}
+}
+
+// Partitions every input that operators require partitioned by different
+// columns (through filters and projections only) by the column that most of
+// them require, the first one found on ties
+func (planner *planner) partitionSharedInputs(inputs []*InputOperator) {
+	for _, input := range inputs {
+		if planner.plan.broadcastInputs[input.GetName()] {
+			continue
+		}
+		var columns []uint64
+		demand := make(map[uint64]int)
+		collectDemand(input, func(column uint64) (uint64, bool) { return column, true }, func(column uint64) {
+			if demand[column] == 0 {
+				columns = append(columns, column)
+			}
+			demand[column]++
+		})
+		if len(columns) < 2 {
+			// Planned as the operators are visited
+			continue
+		}
+		chosen := columns[0]
+		for _, column := range columns {
+			if demand[column] > demand[chosen] {
+				chosen = column
+			}
+		}
+		planner.plan.inputPartition[input.GetName()] = chosen
+	}
+}
+
+// Makes the engine run @plan, which the planner made for the engine's graph:
+// clones the graph for every partition and inserts the plan's exchanges
+func (engine *DataflowEngine) instantiate(plan *physicalPlan) {
+	engine.plan = plan
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		graph := engine.baseGraph.Clone(i)
+		for name := range plan.broadcastInputs {
+			graph.GetInputs()[name].broadcast = true
+		}
+		for index, strategy := range plan.joins {
+			graph.GetNode(index).(*EquiJoinOperator).broadcast = strategy
+		}
+		for index, strategy := range plan.scatteredViews {
+			strategy.engine = engine
+			graph.GetNode(index).(*MatViewOperator).scatter = strategy
+		}
+		engine.attachGraph(i, graph)
+		fmt.Printf("[ENGINE] Cloned: Graph%d\n", i)
+	}
+	for _, planned := range plan.exchanges {
+		engine.addExchangeBefore(planned.child, planned.position, planned.column, planned.mode)
+	}
+}
+
+// Replaces the engine's graph with a copy that the engine may rewrite (and
+// migrate), and maps the operators of the graph it was created with to their
+// copies
+func (engine *DataflowEngine) copyGraph() {
+	graph := engine.baseGraph
+	engine.baseGraph = graph.Clone(0)
+	for index, node := range graph.nodes {
+		engine.copies[node] = engine.baseGraph.GetNode(index)
+	}
+}
@@ -0,0 +1,209 @@
+package dataflow
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// Every batch passed to DataflowEngine.Process is assigned a logical
+// timestamp, in the order the batches are admitted (starting at 1). Progress
+// is tracked in the style of timely dataflow: a pointstamp (location,
+// timestamp) counts the messages of a batch that are yet to be processed at a
+// location, i.e. the node that the message enters a partition's graph at.
+// Counts are aggregated across partitions, since node indices are shared by
+// the graphs' clones.
+//
+// A message's count is decremented only after the messages it caused (sent by
+// exchanges) have been counted, hence a timestamp can't be mistaken for
+// complete while its effects are still travelling between partitions. The
+// frontier of an operator is the greatest timestamp T such that no
+// pointstamp at or before T remains at the operator or upstream of it. All
+// inputs up to T are then reflected in the operator; batches after T may be
+// partially reflected.
+
+// Location of the batch while it is being sent by DataflowEngine.Process; it
+// precedes every operator
+const engineLocation = -1
+
+type pointstamp struct {
+	location  int
+	timestamp uint64
+}
+
+type progressTracker struct {
+	mu     sync.Mutex
+	counts map[pointstamp]int
+	// Timestamp of the last batch admitted
+	latest uint64
+	// Maps a node index to the locations that can result in records at the
+	// node (the node itself and its ancestors)
+	upstream map[int]map[int]bool
+	// Closed (and replaced) whenever a pointstamp is retired
+	changed chan struct{}
+}
+
+type OperatorProgress struct {
+	NodeIndex int
+	Type      OperatorType
+	// Inputs up to Frontier are reflected in the operator (refer progress.go)
+	Frontier uint64
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{
+		counts:   make(map[pointstamp]int),
+		upstream: make(map[int]map[int]bool),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Must be invoked once the engine's graphs are planned (and again after each
+// migration); @graph is any of them
+func (tracker *progressTracker) computeUpstream(graph *Graph) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.upstream = make(map[int]map[int]bool)
+	var visit func(node Operator, locations map[int]bool)
+	visit = func(node Operator, locations map[int]bool) {
+		if locations[node.GetCore().GetIndex()] {
+			return
+		}
+		locations[node.GetCore().GetIndex()] = true
+		for _, parent := range node.GetCore().GetParents() {
+			visit(parent, locations)
+		}
+	}
+	for index, node := range graph.nodes {
+		locations := make(map[int]bool)
+		visit(node, locations)
+		tracker.upstream[index] = locations
+	}
+}
+
+// Assigns the next timestamp; the batch is located at the engine until it has
+// been sent
+func (tracker *progressTracker) issue() uint64 {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.latest++
+	tracker.counts[pointstamp{engineLocation, tracker.latest}]++
+	return tracker.latest
+}
+
+func (tracker *progressTracker) update(location int, timestamp uint64, delta int) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	stamp := pointstamp{location, timestamp}
+	tracker.counts[stamp] += delta
+	if tracker.counts[stamp] == 0 {
+		delete(tracker.counts, stamp)
+		close(tracker.changed)
+		tracker.changed = make(chan struct{})
+	}
+}
+
+// Must be invoked with @tracker.mu held
+func (tracker *progressTracker) frontierAt(nodeIndex int) uint64 {
+	frontier := tracker.latest
+	upstream := tracker.upstream[nodeIndex]
+	for stamp := range tracker.counts {
+		if stamp.location != engineLocation && !upstream[stamp.location] {
+			continue
+		}
+		if stamp.timestamp <= frontier {
+			frontier = stamp.timestamp - 1
+		}
+	}
+	return frontier
+}
+
+func (tracker *progressTracker) frontier(nodeIndex int) uint64 {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.frontierAt(nodeIndex)
+}
+
+// Blocks until the frontier of @nodeIndex reaches @timestamp,
+// or the engine stops (i.e. @stopped is closed)
+func (tracker *progressTracker) wait(ctx context.Context, nodeIndex int, timestamp uint64, stopped <-chan struct{}) error {
+	for {
+		tracker.mu.Lock()
+		if tracker.frontierAt(nodeIndex) >= timestamp {
+			tracker.mu.Unlock()
+			return nil
+		}
+		changed := tracker.changed
+		tracker.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopped:
+			return ErrEngineStopped
+		}
+	}
+}
+
+// Returns the greatest timestamp such that every input batch up to it is
+// reflected in the view (across partitions). Views of a graph that is not run
+// by an engine process batches synchronously, hence they have no frontier and
+// 0 is returned.
+func (op *MatViewOperator) GetFrontier() uint64 {
+	graph := op.GetCore().GetGraph()
+	if graph.progress == nil {
+		return 0
+	}
+	return graph.progress.frontier(op.GetCore().GetIndex())
+}
+
+// Blocks until every input batch up to @timestamp is reflected in the view
+func (op *MatViewOperator) WaitFor(ctx context.Context, timestamp uint64) error {
+	graph := op.GetCore().GetGraph()
+	if graph.progress == nil {
+		return nil
+	}
+	return graph.progress.wait(ctx, op.GetCore().GetIndex(), timestamp, graph.lifecycle.stopped)
+}
+
+// Same as TryLookup, but first waits for @timestamp (refer WaitFor)
+func (op *MatViewOperator) LookupAt(ctx context.Context, key uint64, timestamp uint64) ([]*Record, error) {
+	if err := op.WaitFor(ctx, timestamp); err != nil {
+		return nil, err
+	}
+	return op.TryLookup(key)
+}
+
+// Same as MatViewOperator.GetFrontier, where @view is an output of the graph
+// the engine was created with
+func (engine *DataflowEngine) GetFrontier(view *MatViewOperator) uint64 {
+	return engine.progress.frontier(view.GetCore().GetIndex())
+}
+
+func (engine *DataflowEngine) WaitForFrontier(ctx context.Context, view *MatViewOperator, timestamp uint64) error {
+	engine.topologyMu.RLock()
+	stopped := engine.lifecycle.stopped
+	engine.topologyMu.RUnlock()
+	return engine.progress.wait(ctx, view.GetCore().GetIndex(), timestamp, stopped)
+}
+
+// Returns the frontier of every operator (of the partitioned graphs, hence
+// including exchanges), ordered by node index
+func (engine *DataflowEngine) GetProgress() []OperatorProgress {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	var progress []OperatorProgress
+	engine.progress.mu.Lock()
+	defer engine.progress.mu.Unlock()
+	for index, node := range engine.graphs[0].nodes {
+		progress = append(progress, OperatorProgress{
+			NodeIndex: index,
+			Type:      node.GetCore().opType,
+			Frontier:  engine.progress.frontierAt(index),
+		})
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].NodeIndex < progress[j].NodeIndex
+	})
+	return progress
+}
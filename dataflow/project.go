@@ -17,7 +17,7 @@ func NewProjectOperator(cids []uint64) *ProjectOperator {
 	return projectOp
 }
 
-func (op *ProjectOperator) Process(source int, input *[]*Record, output *[]*Record) bool {
+func (op *ProjectOperator) Process(source int, input *[]*Record, output *[]*Record) error {
 	for _, record := range *input {
 		outRecord := &Record{
 			Data:   record.GetValues(op.cids),
@@ -25,7 +25,20 @@ func (op *ProjectOperator) Process(source int, input *[]*Record, output *[]*Reco
 		}
 		*output = append(*output, outRecord)
 	}
-	return true
+	return nil
+}
+
+func (op *ProjectOperator) Upquery(column uint64, value uint64) ([]*Record, error) {
+	// Map @column to the parent's schema before upquerying it
+	parentRecords, err := op.GetCore().GetParents()[0].Upquery(op.cids[column], value)
+	if err != nil {
+		return nil, err
+	}
+	var output []*Record
+	if err := op.Process(-1, &parentRecords, &output); err != nil {
+		return nil, err
+	}
+	return output, nil
 }
 
 func (op *ProjectOperator) GetCore() *OperatorCore {
@@ -38,8 +51,14 @@ func (op *ProjectOperator) SetCore(core OperatorCore) {
 
 func (op *ProjectOperator) ComputeOutputSchema() {
 	var outputColNames []string
-	for cid := range op.cids {
-		outputColNames = append(outputColNames, op.Core.InputSchemas[0].GetColumnName(uint64(cid)))
+	inputColNames := op.Core.InputSchemas[0].ColumnNames
+	for _, cid := range op.cids {
+		// A column that the input lacks fails once records are processed
+		var colName string
+		if cid < uint64(len(inputColNames)) {
+			colName = inputColNames[cid]
+		}
+		outputColNames = append(outputColNames, colName)
 	}
 	op.GetCore().OutputSchema = &Schema{
 		ColumnNames: outputColNames,
@@ -58,3 +77,14 @@ func (op *ProjectOperator) Clone() Operator {
 	cloneOp.SetCore(cloneOpCore)
 	return cloneOp
 }
+
+// Returns the output column that corresponds to @column of the input, or
+// false if it is projected away
+func (op *ProjectOperator) mapColumn(column uint64) (uint64, bool) {
+	for i, cid := range op.cids {
+		if cid == column {
+			return uint64(i), true
+		}
+	}
+	return 0, false
+}
@@ -1,5 +1,8 @@
 package dataflow
 
+// Approximate number of bytes used by a record, excluding its data
+const recordOverhead = 48
+
 type Record struct {
 	// Supports data of type int for now
 	Data   []uint64
@@ -37,3 +40,8 @@ func (this *Record) GetValues(indices []uint64) []uint64 {
 func (this *Record) GetAllValues() []uint64 {
 	return this.Data
 }
+
+// Approximate number of bytes used by the record; used for memory accounting
+func (this *Record) Size() int64 {
+	return recordOverhead + 8*int64(len(this.Data))
+}
@@ -0,0 +1,418 @@
+package dataflow
+
+import "fmt"
+
+// The number of partitions can be changed while the engine runs:
+// (1) Batches are held back (i.e. Process blocks) and the batches in flight
+// are processed, so that the operators' state reflects every batch admitted
+// so far and nothing else.
+// (2) Every partition collects its operators' keyed state on its own
+// goroutine, after which the partitions' goroutines are stopped.
+// (3) A graph is cloned for each of the new partitions (exchanges included,
+// connected to each other anew), and the state is moved to the partition that
+// now owns it. Input records are owned by the partition of the column their
+// input is partitioned by, while join rows and view keys are owned by the
+// partition of their key, since that is what exchanges route them by. The
+// records of scattered views (refer scatter.go) are owned by the partition of
+// the column their parent is partitioned by instead.
+// Split keys (refer skew.go) are merged back into the partition that owns
+// them, i.e. the copies of their replicated records are dropped. The side that
+// a join broadcasts (refer cost.go) is copied to every new partition instead,
+// and so are the records of broadcast inputs.
+// (4) The new partitions are launched, and the batches that were held back are
+// admitted.
+// Every record is hence moved exactly once, and inputs are not replayed.
+// Spilled keys are loaded back as part of the move, and evicted again once the
+// new partitions are over their limits. Views that were obtained from the old
+// partitions (i.e. through GetView) are detached from the engine: they keep
+// their state as of the move, and their fills fail with ErrViewRemoved.
+
+// Keyed state of an operator, moved to the partition that owns @key
+type movedKey struct {
+	// Table of an equijoin
+	table   uint8
+	key     uint64
+	records []*Record
+	// Set for keys evicted in ReportMiss mode, which remain evicted
+	evicted bool
+	// Set for the table of a join's broadcast side and for the records of
+	// broadcast inputs, which every partition adopts
+	replicated bool
+	// Set if the records are owned by the partition of @placement rather than
+	// @key's (refer EquiJoinOperator.collectState)
+	placed    bool
+	placement uint64
+}
+
+// State collected from a partition's operators, by node index
+type partitionState struct {
+	keys map[int][]movedKey
+	// Rows that expire, of views that have a TTL
+	expiries map[int][]expiryEntry
+}
+
+// Moves the engine's state to @partitionCount partitions. Blocks until the
+// new partitions run; Process blocks in the meantime. Returns an error
+// (leaving the engine as it was) if the state could not be collected.
+func (engine *DataflowEngine) Rescale(partitionCount uint64) error {
+	if partitionCount == 0 {
+		return fmt.Errorf("%w: an engine needs at least one partition", ErrInvalidPartitionCount)
+	}
+	// Holds batches back until the new partitions run
+	engine.stateMu.Lock()
+	defer engine.stateMu.Unlock()
+	if engine.stopped {
+		return ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	if len(engine.graphs) == 0 {
+		// The engine has not been started
+		engine.partitionCount = partitionCount
+		return nil
+	}
+	if partitionCount == engine.partitionCount {
+		return nil
+	}
+	// Failed batches have been reported through their tickets
+	engine.tickets.flush()
+	states, err := engine.collectState()
+	if err != nil {
+		return err
+	}
+
+	engine.topologyMu.Lock()
+	defer engine.topologyMu.Unlock()
+	oldGraphs := engine.graphs
+	for _, graph := range oldGraphs {
+		for _, output := range graph.outputs {
+			output.abortFills()
+		}
+	}
+	engine.stopPartitions()
+
+	engine.partitionCount = partitionCount
+	engine.lifecycle = engine.lifecycle.next()
+	engine.graphs = make(map[uint64]*Graph)
+	engine.graphChans = make(map[uint64]chan *BatchMessage)
+	engine.mailboxes = make(map[uint64]*mailbox)
+	engine.killChans = make(map[uint64]chan bool)
+	engine.makeMailboxes()
+	exchanges := make(map[int]map[uint64]*ExchangeOperator)
+	engine.exchanges = nil
+	for index, node := range oldGraphs[0].nodes {
+		if exchangeOp, ok := node.(*ExchangeOperator); ok {
+			exchanges[index] = engine.newExchanges(exchangeOp.partitionColumn, exchangeOp.routing.mode)
+			for _, newExchange := range exchanges[index] {
+				engine.exchanges = append(engine.exchanges, newExchange)
+			}
+		}
+	}
+	var i uint64
+	for i = 0; i < partitionCount; i++ {
+		partition := i
+		engine.attachGraph(i, oldGraphs[0].cloneTopology(i, func(index int) *ExchangeOperator {
+			return exchanges[index][partition]
+		}))
+	}
+	for _, state := range states {
+		engine.moveState(state)
+	}
+	engine.makeRouters()
+	// The moved state is charged to the new operators
+	for _, graph := range oldGraphs {
+		for _, node := range graph.nodes {
+			if memory := node.GetCore().memory; memory != nil {
+				memory.discharge()
+				memory.closeSpill()
+			}
+		}
+	}
+	engine.progress.computeUpstream(engine.graphs[0])
+	engine.launch()
+	return nil
+}
+
+// Collects the state of every partition, on the partitions' goroutines
+func (engine *DataflowEngine) collectState() ([]*partitionState, error) {
+	states := make([]*partitionState, len(engine.graphs))
+	ticket := engine.tickets.issue(0)
+	for k := range engine.graphs {
+		k := k
+		ticket.add(engineLocation)
+		engine.lifecycle.send(engine.graphChans[k], &BatchMessage{
+			EntryIndex: -1,
+			Ticket:     ticket,
+			location:   engineLocation,
+			task: func(graph *Graph) error {
+				state, err := graph.collectState(engine.plan.inputPartition, engine.partitionCount)
+				states[k] = state
+				return err
+			},
+		})
+	}
+	ticket.release(engineLocation)
+	if err := ticket.Wait(); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Adds @state to the operators of the partitions that own it; must be invoked
+// before the partitions are launched
+func (engine *DataflowEngine) moveState(state *partitionState) {
+	for index, keys := range state.keys {
+		byPartition := make(map[uint64][]movedKey)
+		for _, moved := range keys {
+			if moved.replicated {
+				for partition := range engine.graphs {
+					byPartition[partition] = append(byPartition[partition], moved)
+				}
+				continue
+			}
+			owner := moved.key
+			if moved.placed {
+				owner = moved.placement
+			}
+			partition := owner % engine.partitionCount
+			byPartition[partition] = append(byPartition[partition], moved)
+		}
+		for partition, moved := range byPartition {
+			switch op := engine.graphs[partition].GetNode(index).(type) {
+			case *InputOperator:
+				op.adoptState(moved)
+			case *EquiJoinOperator:
+				op.adoptState(moved)
+			case *MatViewOperator:
+				op.adoptState(moved)
+			}
+		}
+	}
+	for index, entries := range state.expiries {
+		for _, entry := range entries {
+			owner := entry.key
+			if scatter := engine.graphs[0].GetNode(index).(*MatViewOperator).scatter; scatter != nil {
+				owner = entry.record.GetValue(scatter.column)
+			}
+			view := engine.graphs[owner%engine.partitionCount].GetNode(index).(*MatViewOperator)
+			view.ttl.track(entry)
+		}
+	}
+}
+
+// Invoked on the partition's goroutine. @inputPartition holds the columns by
+// which inputs are partitioned (the 0th column if absent), and @count is the
+// number of partitions the state is collected from.
+func (graph *Graph) collectState(inputPartition map[string]uint64, count uint64) (*partitionState, error) {
+	state := &partitionState{
+		keys:     make(map[int][]movedKey),
+		expiries: make(map[int][]expiryEntry),
+	}
+	for index, node := range graph.nodes {
+		var keys []movedKey
+		var err error
+		switch op := node.(type) {
+		case *InputOperator:
+			keys = op.collectState(inputPartition[op.GetName()], graph.index, count)
+		case *EquiJoinOperator:
+			keys, err = op.collectState(graph.index, count)
+		case *MatViewOperator:
+			keys, state.expiries[index], err = op.collectState()
+		}
+		if err != nil {
+			return nil, &ProcessError{
+				NodeIndex: index,
+				Type:      node.GetCore().opType,
+				Partition: graph.index,
+				Err:       err,
+			}
+		}
+		state.keys[index] = keys
+	}
+	return state, nil
+}
+
+func evictedKeys(memory *memoryState) []movedKey {
+	var keys []movedKey
+	for _, key := range memory.evictedKeys() {
+		keys = append(keys, movedKey{table: key.table, key: key.key, evicted: true})
+	}
+	return keys
+}
+
+// Replicated records are only collected from the partition that owns them,
+// and those of a broadcast input from the first partition
+func (op *InputOperator) collectState(column uint64, partition uint64, count uint64) []movedKey {
+	if op.broadcast {
+		if partition != 0 {
+			return nil
+		}
+		keys := make([]movedKey, 0, len(op.state))
+		for _, record := range op.state {
+			keys = append(keys, movedKey{key: record.GetValue(column), records: []*Record{record}, replicated: true})
+		}
+		return keys
+	}
+	keys := make([]movedKey, 0, len(op.state))
+	for _, record := range op.state {
+		key := record.GetValue(column)
+		if op.replicated[key] && key%count != partition {
+			continue
+		}
+		keys = append(keys, movedKey{key: key, records: []*Record{record}})
+	}
+	return keys
+}
+
+func (op *InputOperator) adoptState(keys []movedKey) {
+	for _, moved := range keys {
+		op.state = append(op.state, moved.records...)
+		op.Core.memory.charge(recordsSize(moved.records), 0)
+	}
+}
+
+// Spilled keys are read without being loaded back, so that the join is left as
+// it was if rescaling fails. Replicated records are only collected from the
+// partition that owns them. When the join broadcasts a side, the other side's
+// records are owned by the partition of the column that side is partitioned
+// by, since that is where its records keep arriving.
+func (op *EquiJoinOperator) collectState(partition uint64, count uint64) ([]movedKey, error) {
+	var keys []movedKey
+	for _, table := range []uint8{leftTable, rightTable} {
+		for key, records := range op.table(table) {
+			if !op.isReplica(table, key, partition, count) {
+				keys = append(keys, movedKey{table: table, key: key, records: records})
+			}
+		}
+	}
+	memory := op.Core.memory
+	if memory.spill != nil {
+		for _, key := range memory.spill.keys() {
+			if op.isReplica(key.table, key.key, partition, count) {
+				continue
+			}
+			schema := op.GetCore().GetParents()[key.table].GetCore().OutputSchema
+			records, err := memory.spill.read(key, schema)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, movedKey{table: key.table, key: key.key, records: records})
+		}
+	}
+	for _, moved := range evictedKeys(memory) {
+		if !op.isReplica(moved.table, moved.key, partition, count) {
+			keys = append(keys, moved)
+		}
+	}
+	if op.broadcast == nil {
+		return keys, nil
+	}
+	var placed []movedKey
+	for _, moved := range keys {
+		if moved.table == uint8(op.broadcast.replicated) {
+			moved.replicated = true
+			placed = append(placed, moved)
+			continue
+		}
+		if !op.broadcast.local.keyed || moved.evicted {
+			placed = append(placed, moved)
+			continue
+		}
+		for _, record := range moved.records {
+			placed = append(placed, movedKey{
+				table:     moved.table,
+				key:       moved.key,
+				records:   []*Record{record},
+				placed:    true,
+				placement: record.GetValue(op.broadcast.local.column),
+			})
+		}
+	}
+	return placed, nil
+}
+
+// Returns true if the records of @key in @table are a replica, i.e. they are
+// held by every partition but owned by another one: the broadcast side's are
+// owned by the first partition, and those of split keys by the key's
+// partition
+func (op *EquiJoinOperator) isReplica(table uint8, key uint64, partition uint64, count uint64) bool {
+	if op.broadcast != nil && uint8(op.broadcast.replicated) == table {
+		return partition != 0
+	}
+	replicated, ok := op.splits[key]
+	return ok && uint8(replicated) == table && key%count != partition
+}
+
+func (op *EquiJoinOperator) adoptState(keys []movedKey) {
+	memory := op.Core.memory
+	for _, moved := range keys {
+		key := stateKey{moved.table, moved.key}
+		if moved.evicted {
+			memory.markEvicted(key)
+			continue
+		}
+		records, ok := op.table(moved.table)[moved.key]
+		if !ok {
+			memory.charge(keyOverhead, 1)
+		}
+		op.table(moved.table)[moved.key] = append(records, moved.records...)
+		memory.charge(recordsSize(moved.records), 0)
+		memory.touch(key)
+	}
+}
+
+// Also returns the expiry of every row, if the view has a TTL
+func (op *MatViewOperator) collectState() ([]movedKey, []expiryEntry, error) {
+	var keys []movedKey
+	var expiries []expiryEntry
+	op.state.forEach(func(key uint64, records []*Record) {
+		keys = append(keys, movedKey{key: key, records: records})
+	})
+	if op.ttl != nil {
+		expiries = op.ttl.heldEntries()
+	}
+	memory := op.Core.memory
+	if spill := memory.spilled(); spill != nil {
+		for _, key := range spill.keys() {
+			records, err := spill.read(key, op.Core.OutputSchema)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, movedKey{key: key.key, records: records})
+			if op.ttl != nil {
+				// Spilled rows keep their expiry (refer reload)
+				spilled := op.ttl.spilledExpiries(key.key, records)
+				for i := 0; i < len(records) && i < len(spilled); i++ {
+					expiries = append(expiries, expiryEntry{expiresAt: spilled[i], key: key.key, record: records[i]})
+				}
+			}
+		}
+	}
+	keys = append(keys, evictedKeys(memory)...)
+	if op.scatter != nil {
+		return op.scatterState(keys), expiries, nil
+	}
+	return keys, expiries, nil
+}
+
+// Expiries are moved separately (refer moveState)
+func (op *MatViewOperator) adoptState(keys []movedKey) {
+	op.state.beginWrite()
+	defer op.state.publish()
+	memory := op.Core.memory
+	for _, moved := range keys {
+		if moved.evicted {
+			memory.markEvicted(stateKey{key: moved.key})
+			continue
+		}
+		records, ok := op.state.get(moved.key)
+		if !ok {
+			memory.charge(keyOverhead, 1)
+		}
+		adopted := make([]*Record, 0, len(records)+len(moved.records))
+		adopted = append(append(adopted, records...), moved.records...)
+		op.state.set(moved.key, adopted)
+		memory.charge(recordsSize(moved.records), 0)
+		memory.touch(stateKey{key: moved.key})
+	}
+}
@@ -0,0 +1,186 @@
+package dataflow
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// Position of a scan in a view's key order (ascending). The zero value starts
+// a scan from the first key.
+type ScanCursor struct {
+	started bool
+	lastKey uint64
+}
+
+type ScanEntry struct {
+	Key     uint64
+	Records []*Record
+}
+
+type ScanPage struct {
+	Entries []ScanEntry
+	// Cursor for the next page
+	Next ScanCursor
+	// Set if there are no keys after the page
+	Done bool
+}
+
+type ViewSummary struct {
+	Keys    int64
+	Records int64
+	// Bytes used by keys that are in memory (refer MemoryUsage)
+	Bytes       int64
+	SpilledKeys int64
+	// Rows dropped since their TTL elapsed
+	Expired int64
+}
+
+func (cursor ScanCursor) admits(key uint64) bool {
+	return !cursor.started || key > cursor.lastKey
+}
+
+// Max-heap of entries, used to retain the smallest keys of a view
+type entryHeap []ScanEntry
+
+func (this entryHeap) Len() int            { return len(this) }
+func (this entryHeap) Less(i, j int) bool  { return this[i].Key > this[j].Key }
+func (this entryHeap) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *entryHeap) Push(x interface{}) { *this = append(*this, x.(ScanEntry)) }
+func (this *entryHeap) Pop() interface{} {
+	entry := (*this)[len(*this)-1]
+	*this = (*this)[:len(*this)-1]
+	return entry
+}
+
+func (this *entryHeap) offer(entry ScanEntry, capacity int) {
+	if len(*this) < capacity {
+		heap.Push(this, entry)
+	} else if entry.Key < (*this)[0].Key {
+		(*this)[0] = entry
+		heap.Fix(this, 0)
+	}
+}
+
+// Returns up to @limit keys following @cursor. Records of a page reflect a
+// single batch (refer versionedState); consecutive pages may not. Partial
+// views only return the keys they hold, while spilled keys are returned.
+// Returns ErrInvalidArgument unless @limit is positive.
+func (op *MatViewOperator) Scan(cursor ScanCursor, limit int) (*ScanPage, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w: scan limit must be positive", ErrInvalidArgument)
+	}
+	// One extra entry is retained to determine whether the scan is done
+	entries := &entryHeap{}
+	held := make(map[uint64]bool)
+	op.state.forEach(func(key uint64, records []*Record) {
+		held[key] = true
+		if cursor.admits(key) {
+			entries.offer(ScanEntry{Key: key, Records: records}, limit+1)
+		}
+	})
+	if spill := op.Core.memory.spilled(); spill != nil {
+		for _, key := range spill.keys() {
+			// Keys loaded back remain spilled until they are published
+			if key.table == 0 && !held[key.key] && cursor.admits(key.key) {
+				records, err := spill.read(key, op.Core.OutputSchema)
+				if err != nil {
+					return nil, err
+				}
+				entries.offer(ScanEntry{Key: key.key, Records: records}, limit+1)
+			}
+		}
+	}
+	sorted := []ScanEntry(*entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+	return makeScanPage(sorted, cursor, limit), nil
+}
+
+func makeScanPage(sorted []ScanEntry, cursor ScanCursor, limit int) *ScanPage {
+	page := &ScanPage{
+		Done: len(sorted) <= limit,
+		Next: cursor,
+	}
+	if !page.Done {
+		sorted = sorted[:limit]
+	}
+	page.Entries = sorted
+	if len(sorted) > 0 {
+		page.Next = ScanCursor{started: true, lastKey: sorted[len(sorted)-1].Key}
+	}
+	return page
+}
+
+func (op *MatViewOperator) Summary() ViewSummary {
+	var summary ViewSummary
+	held := make(map[uint64]bool)
+	op.state.forEach(func(key uint64, records []*Record) {
+		held[key] = true
+		summary.Keys++
+		summary.Records += int64(len(records))
+	})
+	if spill := op.Core.memory.spilled(); spill != nil {
+		for _, key := range spill.keys() {
+			// Keys loaded back remain spilled until they are published
+			if !held[key.key] {
+				summary.SpilledKeys++
+			}
+		}
+	}
+	usage, _ := op.Core.GetMemoryUsage()
+	summary.Bytes = usage.Bytes
+	summary.Expired = op.GetExpiredCount()
+	return summary
+}
+
+// Same as MatViewOperator.Scan, but across all partitions. Records of a key
+// that is held by multiple partitions are concatenated.
+func (engine *DataflowEngine) ScanView(view *MatViewOperator, cursor ScanCursor, limit int) (*ScanPage, error) {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	var entries []ScanEntry
+	partitionsDone := true
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		page, err := engine.viewOf(i, view).Scan(cursor, limit)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, page.Entries...)
+		partitionsDone = partitionsDone && page.Done
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	var merged []ScanEntry
+	for _, entry := range entries {
+		if len(merged) > 0 && merged[len(merged)-1].Key == entry.Key {
+			last := &merged[len(merged)-1]
+			last.Records = append(append([]*Record{}, last.Records...), entry.Records...)
+			continue
+		}
+		merged = append(merged, entry)
+	}
+	page := makeScanPage(merged, cursor, limit)
+	// A partition may have more keys even if the merged entries fit the page
+	page.Done = page.Done && partitionsDone
+	return page, nil
+}
+
+func (engine *DataflowEngine) SummarizeView(view *MatViewOperator) ViewSummary {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	var total ViewSummary
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		summary := engine.viewOf(i, view).Summary()
+		total.Keys += summary.Keys
+		total.Records += summary.Records
+		total.Bytes += summary.Bytes
+		total.SpilledKeys += summary.SpilledKeys
+		total.Expired += summary.Expired
+	}
+	return total
+}
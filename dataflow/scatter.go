@@ -0,0 +1,136 @@
+package dataflow
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A view whose parent emits records partitioned by a column other than the
+// view's key is read in either of two ways:
+// (a) An exchange partitions the records by the view's key before the view,
+// hence a lookup is answered by the partition that owns the key. Every record
+// that the view receives is sent across partitions with a probability of
+// (n-1)/n for n partitions.
+// (b) The view is scattered, i.e. it keeps its records where its parent emits
+// them, and a lookup is answered by every partition, whose records of the key
+// are gathered (refer DataflowEngine.LookupView). Nothing is sent when the
+// view is written to, but each lookup is sent to the other n-1 partitions.
+// The planner chooses between the two by the lookups that the view answered
+// and the records it received (refer OperatorStatistics), i.e. scattering pays
+// off for views that are written to more than n times as often as they are
+// read. Ties go to the exchange, which is what an engine without statistics of
+// the view always chooses. Views added by migrations are read through an
+// exchange, since no statistics are known for them.
+// Reading a scattered view from a single partition (e.g. through GetView)
+// gathers the records of the key as well. Rescaling places
+// the records of a scattered view by the column that its parent is
+// partitioned by.
+
+// A view read from every partition
+type scatteredView struct {
+	// Partitioning column of the view's records
+	column uint64
+	// Estimated lookups sent across partitions when scattering, and records
+	// sent across partitions by an exchange instead
+	cost         float64
+	exchangeCost float64
+	// Engine that runs the view; set once the plan is instantiated
+	engine *DataflowEngine
+}
+
+// Returns how @view is read if its parent emits records partitioned as
+// described by @edge (by a column other than the view's key), or nil if the
+// view is to be read through an exchange (refer the top of the file)
+func (model costModel) chooseViewReads(view *MatViewOperator, edge edgeEstimate) *scatteredView {
+	stats, ok := model.statistics.operator(view.GetCore().GetIndex())
+	if !ok || stats.Type != MATVIEW {
+		return nil
+	}
+	n := float64(model.partitions)
+	writes := float64(stats.Writes)
+	if writes == 0 {
+		writes = edge.rows
+	}
+	cost := float64(stats.Reads) * (n - 1)
+	exchangeCost := writes * (n - 1) / n
+	if cost >= exchangeCost {
+		return nil
+	}
+	return &scatteredView{
+		column:       edge.current.column,
+		cost:         cost,
+		exchangeCost: exchangeCost,
+	}
+}
+
+// Returns the records of @key in @view (an output of the graph the engine was
+// created with), as answered by the partition that owns the key, or gathered
+// from every partition if the view is scattered (refer the top of the file).
+// Errors are those of MatViewOperator.TryLookup (the first one, if several
+// partitions fail), or ErrViewRemoved if the view has been removed.
+func (engine *DataflowEngine) LookupView(view *MatViewOperator, key uint64) ([]*Record, error) {
+	engine.topologyMu.RLock()
+	if len(engine.graphs) == 0 {
+		engine.topologyMu.RUnlock()
+		return nil, ErrNotStarted
+	}
+	views := make([]*MatViewOperator, engine.partitionCount)
+	var i uint64
+	for i = 0; i < engine.partitionCount; i++ {
+		views[i] = engine.viewOf(i, view)
+	}
+	// Fills of partial views block until their partition answers, hence the
+	// views are read without holding the lock
+	engine.topologyMu.RUnlock()
+	owner := views[key%uint64(len(views))]
+	if owner == nil {
+		return nil, ErrViewRemoved
+	}
+	if owner.scatter == nil {
+		return owner.TryLookup(key)
+	}
+	// The lookup is counted once, by the partition that owns the key
+	atomic.AddInt64(&owner.reads, 1)
+	gathered := make([][]*Record, len(views))
+	errs := make([]error, len(views))
+	var wg sync.WaitGroup
+	for partition, partitionView := range views {
+		wg.Add(1)
+		go func(partition int, partitionView *MatViewOperator) {
+			defer wg.Done()
+			gathered[partition], errs[partition] = partitionView.lookup(key)
+		}(partition, partitionView)
+	}
+	wg.Wait()
+	var records []*Record
+	for partition := range views {
+		if errs[partition] != nil {
+			return nil, errs[partition]
+		}
+		records = append(records, gathered[partition]...)
+	}
+	return records, nil
+}
+
+// Returns the state of a scattered view to move, one record at a time, since
+// the records of a key are owned by the partitions of their own columns.
+// Evicted keys remain evicted in every partition.
+func (op *MatViewOperator) scatterState(keys []movedKey) []movedKey {
+	var scattered []movedKey
+	for _, moved := range keys {
+		if moved.evicted {
+			moved.replicated = true
+			scattered = append(scattered, moved)
+			continue
+		}
+		for _, record := range moved.records {
+			scattered = append(scattered, movedKey{
+				key:       moved.key,
+				records:   []*Record{record},
+				placed:    true,
+				placement: record.GetValue(op.scatter.column),
+			})
+		}
+	}
+	return scattered
+}
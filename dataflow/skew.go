@@ -0,0 +1,586 @@
+package dataflow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Records are routed to partitions by the value of a column (modulo the
+// partition count), both by the engine's inputs and by exchanges. Every
+// router tracks the load it routes, i.e. the records sent to each partition
+// and the most frequent keys, so that skew can be reported (refer
+// GetSkewReport).
+// A hot join key can be split across partitions (refer SplitJoinKey): the
+// records of one side of the join are spread across all partitions, while
+// those of the other side are replicated to all of them. Every partition then
+// joins its share of the spread side with the whole replicated side, hence
+// each match is emitted exactly once, by one of the partitions. Since the
+// join's output for the key no longer comes out of a single partition, keys
+// can only be split if the join's output goes through an exchange before it
+// reaches a stateful operator. Likewise, the routers feeding the join must
+// only feed the join, since the other consumers would receive the split
+// records.
+
+// Keys whose load is tracked by a router
+const hotKeyCapacity = 64
+
+type JoinSide uint8
+
+const (
+	LeftSide JoinSide = iota
+	RightSide
+)
+
+type splitMode uint8
+
+const (
+	spreadKey splitMode = iota + 1
+	replicateKey
+)
+
+// Approximates the most frequent keys in bounded memory (the Space-Saving
+// algorithm): once @hotKeyCapacity keys are tracked, a new key replaces the
+// least frequent one and inherits its count. Counts are hence overestimated
+// by at most the count of the key they replaced. The keys are kept in buckets
+// of equal counts, ordered by count (a stream summary), hence both counting a
+// key and finding the least frequent one take constant time.
+type keyLoad struct {
+	mu         sync.Mutex
+	counts     map[uint64]*countBucket
+	total      int64
+	partitions map[uint64]int64
+	// Bucket of the least frequent keys
+	min *countBucket
+}
+
+// Keys counted @count times
+type countBucket struct {
+	count int64
+	keys  map[uint64]bool
+	// Buckets of the next smaller and greater counts
+	prev *countBucket
+	next *countBucket
+}
+
+func newKeyLoad() *keyLoad {
+	return &keyLoad{
+		counts:     make(map[uint64]*countBucket),
+		partitions: make(map[uint64]int64),
+	}
+}
+
+// Must be invoked with @this.mu held
+func (this *keyLoad) observe(key uint64) {
+	this.total++
+	if bucket, ok := this.counts[key]; ok {
+		this.increment(key, bucket)
+		return
+	}
+	if len(this.counts) < hotKeyCapacity {
+		if this.min == nil || this.min.count != 1 {
+			this.min = &countBucket{count: 1, keys: make(map[uint64]bool), next: this.min}
+			if this.min.next != nil {
+				this.min.next.prev = this.min
+			}
+		}
+		this.min.keys[key] = true
+		this.counts[key] = this.min
+		return
+	}
+	// The key takes the place of any of the least frequent ones
+	bucket := this.min
+	for victim := range bucket.keys {
+		delete(bucket.keys, victim)
+		delete(this.counts, victim)
+		break
+	}
+	bucket.keys[key] = true
+	this.counts[key] = bucket
+	this.increment(key, bucket)
+}
+
+// Moves @key from @bucket to the bucket of the next greater count
+func (this *keyLoad) increment(key uint64, bucket *countBucket) {
+	next := bucket.next
+	if next == nil || next.count != bucket.count+1 {
+		next = &countBucket{count: bucket.count + 1, keys: make(map[uint64]bool), prev: bucket, next: bucket.next}
+		if bucket.next != nil {
+			bucket.next.prev = next
+		}
+		bucket.next = next
+	}
+	delete(bucket.keys, key)
+	next.keys[key] = true
+	this.counts[key] = next
+	if len(bucket.keys) > 0 {
+		return
+	}
+	if bucket.prev != nil {
+		bucket.prev.next = next
+	} else {
+		this.min = next
+	}
+	next.prev = bucket.prev
+}
+
+// How a router distributes the records it routes among partitions
+type routingMode uint8
+
+const (
+	// By the value of the partitioning column
+	hashRouting routingMode = iota
+	// Every record to every partition (refer cost.go)
+	broadcastRouting
+	// As hashRouting, but the records are replicated to every partition
+	// already (e.g. those of a broadcast input, refer cost.go): every
+	// partition keeps the records it would route to itself, and sends none
+	localRouting
+)
+
+// Routes records by @column, modulo @count, unless their key is split or the
+// router broadcasts every record to all partitions (refer cost.go)
+type router struct {
+	column uint64
+	count  uint64
+	mode   routingMode
+	// Modified while no records are routed (refer SplitJoinKey)
+	splits map[uint64]splitMode
+	// Advanced for every record of a spread key (accessed atomically)
+	next uint64
+	load *keyLoad
+}
+
+func newRouter(column uint64, count uint64) *router {
+	return &router{
+		column: column,
+		count:  count,
+		splits: make(map[uint64]splitMode),
+		load:   newKeyLoad(),
+	}
+}
+
+func (this *router) route(records *[]*Record) map[uint64]*[]*Record {
+	// Performs a modulous parition; in pelton we can use a hash based one
+	recordsByPartition := make(map[uint64]*[]*Record)
+	add := func(partition uint64, record *Record) {
+		if _, ok := recordsByPartition[partition]; ok {
+			*recordsByPartition[partition] = append(*recordsByPartition[partition], record)
+		} else {
+			tempRecords := []*Record{record}
+			recordsByPartition[partition] = &tempRecords
+		}
+	}
+	if this.mode == broadcastRouting {
+		// Every partition gets a slice of its own, since exchanges append to the
+		// batches they coalesce
+		var partition uint64
+		for partition = 0; partition < this.count; partition++ {
+			replica := append([]*Record(nil), *records...)
+			recordsByPartition[partition] = &replica
+		}
+	} else {
+		for _, record := range *records {
+			key := record.GetValue(this.column)
+			switch this.splits[key] {
+			case spreadKey:
+				add(atomic.AddUint64(&this.next, 1)%this.count, record)
+			case replicateKey:
+				var partition uint64
+				for partition = 0; partition < this.count; partition++ {
+					add(partition, record)
+				}
+			default:
+				add(key%this.count, record)
+			}
+		}
+	}
+	this.record(records, recordsByPartition)
+	return recordsByPartition
+}
+
+// Adds the load of a routed batch
+func (this *router) record(records *[]*Record, recordsByPartition map[uint64]*[]*Record) {
+	this.load.mu.Lock()
+	defer this.load.mu.Unlock()
+	for partition, partitionRecords := range recordsByPartition {
+		this.load.partitions[partition] += int64(len(*partitionRecords))
+	}
+	if this.mode == broadcastRouting {
+		return
+	}
+	for _, record := range *records {
+		this.load.observe(record.GetValue(this.column))
+	}
+}
+
+// Routers of the engine's inputs; must be invoked once inputs are assigned
+// their partitioning columns
+func (engine *DataflowEngine) makeRouters() {
+	engine.routers = make(map[string]*router)
+	for name := range engine.baseGraph.GetInputs() {
+		// By default partition by 0th column; in pelton this would translate to
+		// partitioning by record's key
+		engine.routers[name] = newRouter(engine.plan.inputPartition[name], engine.partitionCount)
+		if engine.plan.broadcastInputs[name] {
+			engine.routers[name].mode = broadcastRouting
+		}
+	}
+	engine.splitKeys = make(map[routedKey]bool)
+	engine.splitNodes = make(map[int]bool)
+	engine.splitJoins = make(map[int]bool)
+}
+
+type HotKey struct {
+	// Input or exchange (of the partitioned graphs) that routes the key
+	NodeIndex int
+	Type      OperatorType
+	Key       uint64
+	// Records routed for the key (an overestimate, refer keyLoad)
+	Records int64
+	// Share of the records routed by the node
+	Share float64
+	// Partition that owns the key
+	Partition uint64
+	// Set if the key is split across partitions
+	Split bool
+}
+
+type SkewReport struct {
+	// Records routed to each partition, by inputs and exchanges
+	PartitionLoad []int64
+	// Greatest partition load over the mean one (1 if the load is balanced)
+	Imbalance float64
+	// Keys that account for more than a partition's share (i.e. 1 /
+	// partitionCount) of the records routed by their node, most loaded first
+	HotKeys []HotKey
+}
+
+// Identifies a key routed by an input or exchange, or a key of a join
+type routedKey struct {
+	nodeIndex int
+	key       uint64
+}
+
+// Reports the load routed since the engine was started (or last rescaled)
+func (engine *DataflowEngine) GetSkewReport() SkewReport {
+	engine.topologyMu.RLock()
+	defer engine.topologyMu.RUnlock()
+	report := SkewReport{
+		PartitionLoad: make([]int64, engine.partitionCount),
+	}
+	// Exchanges are aggregated across partitions
+	routers := make(map[int][]*router)
+	types := make(map[int]OperatorType)
+	for _, input := range engine.baseGraph.GetInputs() {
+		routers[input.GetCore().GetIndex()] = []*router{engine.routers[input.GetName()]}
+		types[input.GetCore().GetIndex()] = INPUT
+	}
+	for _, graph := range engine.graphs {
+		for index, node := range graph.nodes {
+			if exchangeOp, ok := node.(*ExchangeOperator); ok {
+				routers[index] = append(routers[index], exchangeOp.routing)
+				types[index] = EXCHANGE
+			}
+		}
+	}
+	for index, nodeRouters := range routers {
+		counts := make(map[uint64]int64)
+		var total int64
+		for _, nodeRouter := range nodeRouters {
+			nodeRouter.load.mu.Lock()
+			for key, bucket := range nodeRouter.load.counts {
+				counts[key] += bucket.count
+			}
+			for partition, count := range nodeRouter.load.partitions {
+				report.PartitionLoad[partition] += count
+			}
+			total += nodeRouter.load.total
+			nodeRouter.load.mu.Unlock()
+		}
+		for key, count := range counts {
+			share := float64(count) / float64(total)
+			if share*float64(engine.partitionCount) <= 1 {
+				continue
+			}
+			report.HotKeys = append(report.HotKeys, HotKey{
+				NodeIndex: index,
+				Type:      types[index],
+				Key:       key,
+				Records:   count,
+				Share:     share,
+				Partition: key % engine.partitionCount,
+				Split:     engine.splitKeys[routedKey{index, key}],
+			})
+		}
+	}
+	sort.Slice(report.HotKeys, func(i, j int) bool {
+		if report.HotKeys[i].Records != report.HotKeys[j].Records {
+			return report.HotKeys[i].Records > report.HotKeys[j].Records
+		}
+		return report.HotKeys[i].NodeIndex < report.HotKeys[j].NodeIndex
+	})
+	var total, max int64
+	for _, load := range report.PartitionLoad {
+		total += load
+		if load > max {
+			max = load
+		}
+	}
+	report.Imbalance = 1
+	if total > 0 {
+		report.Imbalance = float64(max) * float64(engine.partitionCount) / float64(total)
+	}
+	return report
+}
+
+// Path from a join's side up to the input or exchange that routes its records
+type splitChain struct {
+	// Nodes between the router and the join (the router included)
+	nodes  []int
+	router Operator
+	// Column of the router's records that holds the join key
+	column uint64
+}
+
+// Walks up from @side of the join at @joinIndex in @graph (a partition's
+// graph) through stateless operators that only feed the join
+func findSplitChain(graph *Graph, joinIndex int, side JoinSide) (*splitChain, error) {
+	join := graph.GetNode(joinIndex).(*EquiJoinOperator)
+	chain := &splitChain{
+		column: join.leftID,
+	}
+	if side == RightSide {
+		chain.column = join.rightID
+	}
+	node := join.GetCore().GetParents()[side]
+	for {
+		if len(node.GetCore().Children) != 1 {
+			return nil, fmt.Errorf("%w: node %d feeds other operators than the join", ErrInvalidSplit, node.GetCore().GetIndex())
+		}
+		chain.nodes = append(chain.nodes, node.GetCore().GetIndex())
+		switch op := node.(type) {
+		case *FilterOperator:
+		case *ProjectOperator:
+			chain.column = op.cids[chain.column]
+		case *InputOperator, *ExchangeOperator:
+			chain.router = node
+			return chain, nil
+		default:
+			return nil, fmt.Errorf("%w: node %d is stateful", ErrInvalidSplit, node.GetCore().GetIndex())
+		}
+		node = node.GetCore().GetParents()[0]
+	}
+}
+
+// Checks that the output of @node (a join) goes through an exchange before it
+// reaches a stateful operator
+func checkSplitOutput(node Operator) error {
+	for _, child := range node.GetCore().GetChildren() {
+		switch child.(type) {
+		case *ExchangeOperator:
+		case *FilterOperator, *ProjectOperator:
+			if err := checkSplitOutput(child); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: node %d relies on the join's partitioning", ErrInvalidSplit, child.GetCore().GetIndex())
+		}
+	}
+	return nil
+}
+
+// Splits @key of @join (an operator of the engine's graph) across all
+// partitions: the records of @spread are spread across them, and those of the
+// other side are replicated to them. The replicated side's records of the key
+// that are already held by the join are copied to every partition. Blocks
+// until the split applies; Process blocks in the meantime. Rescaling merges
+// split keys back into their partition.
+func (engine *DataflowEngine) SplitJoinKey(join *EquiJoinOperator, key uint64, spread JoinSide) error {
+	engine.stateMu.Lock()
+	defer engine.stateMu.Unlock()
+	if engine.stopped {
+		return ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	if same, ok := engine.resolve(join).(*EquiJoinOperator); ok {
+		join = same
+	}
+	index := join.GetCore().GetIndex()
+	if engine.baseGraph.GetNode(index) != join {
+		return fmt.Errorf("%w: the join is not part of the engine", ErrInvalidSplit)
+	}
+	if len(engine.graphs) == 0 {
+		return fmt.Errorf("%w: the engine has not been started", ErrInvalidSplit)
+	}
+	if _, ok := engine.plan.joins[index]; ok {
+		// Every partition already holds the broadcast side's records
+		return fmt.Errorf("%w: the join broadcasts a side", ErrInvalidSplit)
+	}
+	graph := engine.graphs[0]
+	if err := checkSplitOutput(graph.GetNode(index)); err != nil {
+		return err
+	}
+	replicated := LeftSide
+	if spread == LeftSide {
+		replicated = RightSide
+	}
+	spreadChain, err := findSplitChain(graph, index, spread)
+	if err != nil {
+		return err
+	}
+	replicatedChain, err := findSplitChain(graph, index, replicated)
+	if err != nil {
+		return err
+	}
+	for _, chain := range []*splitChain{spreadChain, replicatedChain} {
+		if engine.routerOf(graph, chain.router).column != chain.column {
+			return fmt.Errorf("%w: node %d does not route by the join key", ErrInvalidSplit, chain.router.GetCore().GetIndex())
+		}
+	}
+	if engine.splitKeys[routedKey{index, key}] {
+		return nil
+	}
+	// The batches in flight are processed before the routing changes
+	engine.tickets.flush()
+
+	// Copy the records of the replicated side that the owner holds
+	owner := key % engine.partitionCount
+	var held []movedKey
+	err = engine.runTask([]uint64{owner}, func(graph *Graph) error {
+		join := graph.GetNode(index).(*EquiJoinOperator)
+		records, err := join.probe(uint8(replicated), key)
+		if len(records) > 0 {
+			held = append(held, movedKey{table: uint8(replicated), key: key, records: append([]*Record(nil), records...)})
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var partitions []uint64
+	for partition := range engine.graphs {
+		partitions = append(partitions, partition)
+	}
+	engine.topologyMu.Lock()
+	defer engine.topologyMu.Unlock()
+	err = engine.runTask(partitions, func(graph *Graph) error {
+		join := graph.GetNode(index).(*EquiJoinOperator)
+		if graph.GetIndex() != owner {
+			join.adoptState(held)
+		}
+		join.splits[key] = replicated
+		if input, ok := graph.GetNode(replicatedChain.router.GetCore().GetIndex()).(*InputOperator); ok {
+			input.replicated[key] = true
+		}
+		for _, chain := range []*splitChain{spreadChain, replicatedChain} {
+			if exchangeOp, ok := graph.GetNode(chain.router.GetCore().GetIndex()).(*ExchangeOperator); ok {
+				exchangeOp.routing.splits[key] = chain.mode(spreadChain)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, chain := range []*splitChain{spreadChain, replicatedChain} {
+		if input, ok := chain.router.(*InputOperator); ok {
+			engine.routers[input.GetName()].splits[key] = chain.mode(spreadChain)
+		}
+		engine.splitKeys[routedKey{chain.router.GetCore().GetIndex(), key}] = true
+		for _, nodeIndex := range chain.nodes {
+			engine.splitNodes[nodeIndex] = true
+		}
+	}
+	engine.splitKeys[routedKey{index, key}] = true
+	engine.splitJoins[index] = true
+	return nil
+}
+
+func (chain *splitChain) mode(spreadChain *splitChain) splitMode {
+	if chain == spreadChain {
+		return spreadKey
+	}
+	return replicateKey
+}
+
+// Returns the router of @node (an input or exchange of @graph)
+func (engine *DataflowEngine) routerOf(graph *Graph, node Operator) *router {
+	if input, ok := node.(*InputOperator); ok {
+		return engine.routers[input.GetName()]
+	}
+	return node.(*ExchangeOperator).routing
+}
+
+// Splits the hot keys (refer GetSkewReport) that account for at least
+// @minShare of the records routed by their node, if the node feeds a join
+// that allows it. The side of the join that the node feeds is spread. Returns
+// the keys that were split.
+func (engine *DataflowEngine) MitigateSkew(minShare float64) ([]HotKey, error) {
+	var split []HotKey
+	for _, hotKey := range engine.GetSkewReport().HotKeys {
+		if hotKey.Split || hotKey.Share < minShare {
+			continue
+		}
+		engine.topologyMu.RLock()
+		join, side, ok := engine.joinFedBy(hotKey.NodeIndex)
+		// The other side of the join may have been split already
+		ok = ok && !engine.splitKeys[routedKey{join.GetCore().GetIndex(), hotKey.Key}]
+		engine.topologyMu.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := engine.SplitJoinKey(join, hotKey.Key, side); err != nil {
+			if errors.Is(err, ErrInvalidSplit) {
+				continue
+			}
+			return split, err
+		}
+		hotKey.Split = true
+		split = append(split, hotKey)
+	}
+	return split, nil
+}
+
+// Returns the join (of the engine's graph) that the node at @index feeds
+// through stateless operators, along with the side it feeds; must be invoked
+// with @engine.topologyMu held
+func (engine *DataflowEngine) joinFedBy(index int) (*EquiJoinOperator, JoinSide, bool) {
+	node := engine.graphs[0].GetNode(index)
+	for node != nil && len(node.GetCore().Children) == 1 {
+		child := node.GetCore().GetChildren()[0]
+		switch child.(type) {
+		case *FilterOperator, *ProjectOperator:
+			node = child
+		case *EquiJoinOperator:
+			join, ok := engine.baseGraph.GetNode(child.GetCore().GetIndex()).(*EquiJoinOperator)
+			side := LeftSide
+			if child.GetCore().GetParents()[1] == node {
+				side = RightSide
+			}
+			return join, side, ok
+		default:
+			return nil, LeftSide, false
+		}
+	}
+	return nil, LeftSide, false
+}
+
+// Runs @task on the goroutines of @partitions and blocks until it completes
+func (engine *DataflowEngine) runTask(partitions []uint64, task func(graph *Graph) error) error {
+	ticket := engine.tickets.issue(0)
+	for _, partition := range partitions {
+		ticket.add(engineLocation)
+		engine.lifecycle.send(engine.graphChans[partition], &BatchMessage{
+			EntryIndex: -1,
+			Ticket:     ticket,
+			location:   engineLocation,
+			task:       task,
+		})
+	}
+	ticket.release(engineLocation)
+	return ticket.Wait()
+}
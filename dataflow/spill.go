@@ -0,0 +1,152 @@
+package dataflow
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+type spillExtent struct {
+	offset int64
+	length int64
+}
+
+// File backed store for the records of evicted keys. Space in the file is not
+// reclaimed when keys are loaded back, it is released when the store is closed.
+type spillStore struct {
+	file    *os.File
+	size    int64
+	extents map[stateKey][]spillExtent
+	closed  bool
+	// Spilled keys of a view may be read by lookups
+	mu sync.Mutex
+}
+
+func newSpillStore() (*spillStore, error) {
+	file, err := ioutil.TempFile("", "dataflow-spill-")
+	if err != nil {
+		return nil, spillError(err)
+	}
+	return &spillStore{
+		file:    file,
+		extents: make(map[stateKey][]spillExtent),
+	}, nil
+}
+
+func (this *spillStore) contains(key stateKey) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, ok := this.extents[key]
+	return ok
+}
+
+// Appends @records to the ones already spilled for @key
+func (this *spillStore) write(key stateKey, records []*Record) error {
+	return this.store(key, records, false)
+}
+
+// Same as write, but replaces the records spilled for @key, which readers then
+// find either before or after the replacement
+func (this *spillStore) replace(key stateKey, records []*Record) error {
+	return this.store(key, records, true)
+}
+
+func (this *spillStore) store(key stateKey, records []*Record, replace bool) error {
+	var buf []byte
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, record := range records {
+		n := binary.PutUvarint(varint, uint64(len(record.Data)))
+		buf = append(buf, varint[:n]...)
+		for _, value := range record.Data {
+			n = binary.PutUvarint(varint, value)
+			buf = append(buf, varint[:n]...)
+		}
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.closed {
+		return spillError(ErrEngineStopped)
+	}
+	if _, err := this.file.WriteAt(buf, this.size); err != nil {
+		return spillError(err)
+	}
+	extent := spillExtent{offset: this.size, length: int64(len(buf))}
+	if replace {
+		this.extents[key] = []spillExtent{extent}
+	} else {
+		this.extents[key] = append(this.extents[key], extent)
+	}
+	this.size += int64(len(buf))
+	return nil
+}
+
+// Returns the records spilled for @key; the decoded records are assigned
+// @schema since it is not spilled
+func (this *spillStore) read(key stateKey, schema *Schema) ([]*Record, error) {
+	records, _, err := this.find(key, schema)
+	return records, err
+}
+
+// Same as read, but also returns whether @key is spilled
+func (this *spillStore) find(key stateKey, schema *Schema) ([]*Record, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var records []*Record
+	if this.closed {
+		// The engine has stopped, hence the spilled records are gone
+		return records, false, nil
+	}
+	extents, ok := this.extents[key]
+	for _, extent := range extents {
+		buf := make([]byte, extent.length)
+		if _, err := this.file.ReadAt(buf, extent.offset); err != nil {
+			return nil, false, spillError(err)
+		}
+		for len(buf) > 0 {
+			width, n := binary.Uvarint(buf)
+			buf = buf[n:]
+			data := make([]uint64, width)
+			for i := range data {
+				data[i], n = binary.Uvarint(buf)
+				buf = buf[n:]
+			}
+			records = append(records, &Record{Data: data, Schema: schema})
+		}
+	}
+	return records, ok, nil
+}
+
+// Same as read, but also drops @key from the store (unless it can't be read)
+func (this *spillStore) take(key stateKey, schema *Schema) ([]*Record, error) {
+	records, err := this.read(key, schema)
+	if err != nil {
+		return nil, err
+	}
+	this.drop(key)
+	return records, nil
+}
+
+func (this *spillStore) drop(key stateKey) {
+	this.mu.Lock()
+	delete(this.extents, key)
+	this.mu.Unlock()
+}
+
+func (this *spillStore) keys() []stateKey {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var keys []stateKey
+	for key := range this.extents {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (this *spillStore) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.closed = true
+	this.file.Close()
+	os.Remove(this.file.Name())
+}
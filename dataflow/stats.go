@@ -0,0 +1,228 @@
+package dataflow
+
+import "sync/atomic"
+
+// The planner estimates the cost of its choices (refer cost.go) from
+// statistics of the data: the cardinality of every input along with the
+// distribution of the values of its columns, and the cardinality of the
+// state held by every join and view along with the distribution of its keys.
+// Views are also described by the lookups they answered and the records
+// they received (refer scatter.go).
+// Statistics are either collected from a running engine (refer
+// CollectStatistics), which later migrations then plan with, or provided
+// before the engine is started (refer SetStatistics), e.g. those collected by
+// an earlier run. An engine without statistics plans as if every input were
+// large and evenly distributed.
+
+// Distribution of the values of a column
+type ColumnStatistics struct {
+	// Distinct values of the column
+	Distinct int64
+	// Records that hold the most frequent value
+	MaxFrequency int64
+}
+
+type InputStatistics struct {
+	Rows int64
+	// Statistics of each column, by position
+	Columns []ColumnStatistics
+}
+
+// Statistics of the state of a join (both tables) or a view, across
+// partitions
+type OperatorStatistics struct {
+	NodeIndex int
+	Type      OperatorType
+	Rows      int64
+	// Distinct keys, i.e. join keys or view keys
+	Keys int64
+	// Rows of the key that holds the most
+	MaxKeyRows int64
+	// Lookups answered and records received since the partitions were started
+	// or rescaled (views only)
+	Reads  int64
+	Writes int64
+}
+
+type Statistics struct {
+	// By input name
+	Inputs map[string]*InputStatistics
+	// By node index (of the engine's graph)
+	Operators map[int]*OperatorStatistics
+}
+
+// Statistics of a partition's state, merged across partitions by
+// CollectStatistics
+type partitionStatistics struct {
+	// Records by value, for each column of each input
+	inputs map[string][]map[uint64]int64
+	// Rows by key, for each join and view
+	operators map[int]map[uint64]int64
+	types     map[int]OperatorType
+	// Lookups answered and records received, for each view
+	reads  map[int]int64
+	writes map[int]int64
+}
+
+// Makes the planner use @stats, both when the engine is started and for later
+// migrations (until statistics are collected)
+func (engine *DataflowEngine) SetStatistics(stats *Statistics) {
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	engine.statistics = stats
+}
+
+// Collects the statistics of the state of every partition, which later
+// migrations are planned with. Records that are replicated to several
+// partitions (refer skew.go and cost.go) are counted once; spilled state is
+// not counted.
+func (engine *DataflowEngine) CollectStatistics() (*Statistics, error) {
+	engine.stateMu.RLock()
+	defer engine.stateMu.RUnlock()
+	if engine.stopped {
+		return nil, ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	if len(engine.graphs) == 0 {
+		return nil, ErrNotStarted
+	}
+	collected := make([]*partitionStatistics, engine.partitionCount)
+	var partitions []uint64
+	for partition := range engine.graphs {
+		partitions = append(partitions, partition)
+	}
+	err := engine.runTask(partitions, func(graph *Graph) error {
+		collected[graph.GetIndex()] = graph.collectStatistics(engine.plan.inputPartition, engine.partitionCount)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := &Statistics{
+		Inputs:    make(map[string]*InputStatistics),
+		Operators: make(map[int]*OperatorStatistics),
+	}
+	inputs := make(map[string][]map[uint64]int64)
+	operators := make(map[int]map[uint64]int64)
+	for _, partition := range collected {
+		for name, columns := range partition.inputs {
+			if _, ok := inputs[name]; !ok {
+				inputs[name] = make([]map[uint64]int64, len(columns))
+				for i := range columns {
+					inputs[name][i] = make(map[uint64]int64)
+				}
+			}
+			for i, counts := range columns {
+				for value, count := range counts {
+					inputs[name][i][value] += count
+				}
+			}
+		}
+		for index, counts := range partition.operators {
+			if _, ok := operators[index]; !ok {
+				operators[index] = make(map[uint64]int64)
+				stats.Operators[index] = &OperatorStatistics{
+					NodeIndex: index,
+					Type:      partition.types[index],
+				}
+			}
+			for key, count := range counts {
+				operators[index][key] += count
+			}
+		}
+		for index, reads := range partition.reads {
+			stats.Operators[index].Reads += reads
+			stats.Operators[index].Writes += partition.writes[index]
+		}
+	}
+	for name, columns := range inputs {
+		input := &InputStatistics{}
+		for i, counts := range columns {
+			column := distribution(counts)
+			if i == 0 {
+				input.Rows = column.rows
+			}
+			input.Columns = append(input.Columns, ColumnStatistics{
+				Distinct:     column.distinct,
+				MaxFrequency: column.max,
+			})
+		}
+		stats.Inputs[name] = input
+	}
+	for index, counts := range operators {
+		keys := distribution(counts)
+		operator := stats.Operators[index]
+		operator.Rows, operator.Keys, operator.MaxKeyRows = keys.rows, keys.distinct, keys.max
+	}
+	engine.statistics = stats
+	return stats, nil
+}
+
+type valueDistribution struct {
+	rows     int64
+	distinct int64
+	max      int64
+}
+
+func distribution(counts map[uint64]int64) valueDistribution {
+	var result valueDistribution
+	for _, count := range counts {
+		result.rows += count
+		if count > result.max {
+			result.max = count
+		}
+	}
+	result.distinct = int64(len(counts))
+	return result
+}
+
+// Invoked on the partition's goroutine; @inputPartition and @count are as for
+// collectState
+func (graph *Graph) collectStatistics(inputPartition map[string]uint64, count uint64) *partitionStatistics {
+	stats := &partitionStatistics{
+		inputs:    make(map[string][]map[uint64]int64),
+		operators: make(map[int]map[uint64]int64),
+		types:     make(map[int]OperatorType),
+		reads:     make(map[int]int64),
+		writes:    make(map[int]int64),
+	}
+	for index, node := range graph.nodes {
+		switch op := node.(type) {
+		case *InputOperator:
+			columns := make([]map[uint64]int64, len(op.Core.OutputSchema.ColumnNames))
+			for i := range columns {
+				columns[i] = make(map[uint64]int64)
+			}
+			for _, moved := range op.collectState(inputPartition[op.GetName()], graph.index, count) {
+				for _, record := range moved.records {
+					for i := range columns {
+						columns[i][record.GetValue(uint64(i))]++
+					}
+				}
+			}
+			stats.inputs[op.GetName()] = columns
+		case *EquiJoinOperator:
+			keys := make(map[uint64]int64)
+			for _, table := range []uint8{leftTable, rightTable} {
+				for key, records := range op.table(table) {
+					if !op.isReplica(table, key, graph.index, count) {
+						keys[key] += int64(len(records))
+					}
+				}
+			}
+			stats.operators[index] = keys
+			stats.types[index] = EQUIJOIN
+		case *MatViewOperator:
+			keys := make(map[uint64]int64)
+			op.state.forEach(func(key uint64, records []*Record) {
+				keys[key] += int64(len(records))
+			})
+			stats.operators[index] = keys
+			stats.types[index] = MATVIEW
+			stats.reads[index] = atomic.LoadInt64(&op.reads)
+			stats.writes[index] = atomic.LoadInt64(&op.writes)
+		}
+	}
+	return stats
+}
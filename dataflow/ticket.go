@@ -0,0 +1,238 @@
+package dataflow
+
+import (
+	"sort"
+	"sync"
+)
+
+// Tracks a batch passed to DataflowEngine.Process, along with every batch it
+// causes exchanges to send, until all of them have been applied to the graphs
+// (and hence are reflected in their outputs).
+type Ticket struct {
+	mu        sync.Mutex
+	pending   int
+	completed bool
+	// Set if any of the ticket's messages were dropped by the engine stopping
+	abandoned bool
+	// Errors of the ticket's batches that failed, in the order they failed
+	errs []error
+	// Flow control credits held until the ticket completes
+	credits int64
+	flow    *flowControl
+	// Logical timestamp of the batch (refer progress.go)
+	timestamp uint64
+	progress  *progressTracker
+	done      chan struct{}
+	// Invoked once the ticket is complete
+	onDone func(ticket *Ticket)
+}
+
+// The ticket is created with a pending count of 1, which the issuer releases
+// once it has sent all of the ticket's messages. This prevents the ticket from
+// completing before the last of them has been sent.
+func newTicket(onDone func(ticket *Ticket)) *Ticket {
+	return &Ticket{
+		pending: 1,
+		done:    make(chan struct{}),
+		onDone:  onDone,
+	}
+}
+
+// Must be invoked before sending a message that carries the ticket, where
+// @location is the node the message enters the graph at
+func (ticket *Ticket) add(location int) {
+	ticket.updateProgress(location, 1)
+	ticket.mu.Lock()
+	ticket.pending++
+	ticket.mu.Unlock()
+}
+
+// Must be invoked once a message that carries the ticket has been processed
+func (ticket *Ticket) release(location int) {
+	ticket.updateProgress(location, -1)
+	ticket.mu.Lock()
+	ticket.pending--
+	ticket.completeIf(ticket.pending == 0)
+}
+
+// Invoked when a message that carries the ticket is dropped
+func (ticket *Ticket) drop(location int) {
+	ticket.updateProgress(location, -1)
+	ticket.mu.Lock()
+	ticket.abandoned = true
+	ticket.pending--
+	ticket.completeIf(ticket.pending == 0)
+}
+
+func (ticket *Ticket) updateProgress(location int, delta int) {
+	if ticket.progress != nil {
+		ticket.progress.update(location, ticket.timestamp, delta)
+	}
+}
+
+// Returns the logical timestamp assigned to the batch
+func (ticket *Ticket) Timestamp() uint64 {
+	return ticket.timestamp
+}
+
+// Charges @count credits for records that the ticket's batches caused, which
+// are returned along with the ticket's own once it completes
+func (ticket *Ticket) charge(count int64) {
+	if ticket.flow == nil || count == 0 {
+		return
+	}
+	ticket.mu.Lock()
+	defer ticket.mu.Unlock()
+	// An abandoned ticket has returned its credits already
+	if ticket.completed {
+		return
+	}
+	ticket.credits += count
+	ticket.flow.charge(count)
+}
+
+// Records that one of the ticket's batches failed; the message must still be
+// released
+func (ticket *Ticket) fail(err error) {
+	ticket.mu.Lock()
+	ticket.errs = append(ticket.errs, err)
+	ticket.mu.Unlock()
+}
+
+// Completes the ticket regardless of its pending messages
+func (ticket *Ticket) abandon() {
+	ticket.mu.Lock()
+	ticket.abandoned = true
+	ticket.completeIf(true)
+}
+
+// Must be invoked with @ticket.mu held, which it releases
+func (ticket *Ticket) completeIf(complete bool) {
+	if !complete || ticket.completed {
+		ticket.mu.Unlock()
+		return
+	}
+	ticket.completed = true
+	ticket.mu.Unlock()
+	if ticket.onDone != nil {
+		ticket.onDone(ticket)
+	}
+	close(ticket.done)
+}
+
+// Returns true if the engine was stopped before the ticket's batches were
+// processed in their entirety (valid once the ticket is done)
+func (ticket *Ticket) Abandoned() bool {
+	ticket.mu.Lock()
+	defer ticket.mu.Unlock()
+	return ticket.abandoned
+}
+
+// Returns every error of the ticket's batches (valid once the ticket is done).
+// A failed batch is not applied past the operator that failed, while the
+// batches sent to other partitions are unaffected.
+func (ticket *Ticket) Errors() []error {
+	ticket.mu.Lock()
+	defer ticket.mu.Unlock()
+	return append([]error(nil), ticket.errs...)
+}
+
+// Returns the first error of the ticket's batches, or ErrEngineStopped if the
+// ticket was abandoned (valid once the ticket is done)
+func (ticket *Ticket) Err() error {
+	ticket.mu.Lock()
+	defer ticket.mu.Unlock()
+	if len(ticket.errs) > 0 {
+		return ticket.errs[0]
+	}
+	if ticket.abandoned {
+		return ErrEngineStopped
+	}
+	return nil
+}
+
+// Blocks until the batch and everything it triggered have been processed and
+// returns Err
+func (ticket *Ticket) Wait() error {
+	<-ticket.done
+	return ticket.Err()
+}
+
+func (ticket *Ticket) Done() <-chan struct{} {
+	return ticket.done
+}
+
+// Keeps track of an engine's incomplete tickets
+type ticketTracker struct {
+	mu          sync.Mutex
+	outstanding map[*Ticket]bool
+	flow        *flowControl
+	progress    *progressTracker
+}
+
+func newTicketTracker(flow *flowControl, progress *progressTracker) *ticketTracker {
+	return &ticketTracker{
+		outstanding: make(map[*Ticket]bool),
+		flow:        flow,
+		progress:    progress,
+	}
+}
+
+// @credits are returned to the flow control once the ticket completes. The
+// issuer's hold on the ticket is located at engineLocation.
+func (tracker *ticketTracker) issue(credits int64) *Ticket {
+	ticket := newTicket(tracker.complete)
+	ticket.credits = credits
+	ticket.flow = tracker.flow
+	ticket.progress = tracker.progress
+	ticket.timestamp = tracker.progress.issue()
+	tracker.mu.Lock()
+	tracker.outstanding[ticket] = true
+	tracker.mu.Unlock()
+	return ticket
+}
+
+func (tracker *ticketTracker) complete(ticket *Ticket) {
+	tracker.mu.Lock()
+	delete(tracker.outstanding, ticket)
+	tracker.mu.Unlock()
+	tracker.flow.release(ticket.credits)
+}
+
+func (tracker *ticketTracker) count() int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return len(tracker.outstanding)
+}
+
+// Returns the incomplete tickets in the order they were issued
+func (tracker *ticketTracker) pending() []*Ticket {
+	tracker.mu.Lock()
+	tickets := make([]*Ticket, 0, len(tracker.outstanding))
+	for ticket := range tracker.outstanding {
+		tickets = append(tickets, ticket)
+	}
+	tracker.mu.Unlock()
+	sort.Slice(tickets, func(i, j int) bool {
+		return tickets[i].timestamp < tickets[j].timestamp
+	})
+	return tickets
+}
+
+func (tracker *ticketTracker) abandonAll() {
+	for _, ticket := range tracker.pending() {
+		ticket.abandon()
+	}
+}
+
+// Blocks until every ticket issued before the call is complete and returns the
+// error of the earliest issued one that failed
+func (tracker *ticketTracker) flush() error {
+	var firstErr error
+	for _, ticket := range tracker.pending() {
+		if err := ticket.Wait(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,301 @@
+package dataflow
+
+import (
+	"container/heap"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type expiryEntry struct {
+	// Unix time in nanoseconds
+	expiresAt int64
+	key       uint64
+	record    *Record
+}
+
+// Min-heap of rows ordered by expiry
+type expiryHeap []expiryEntry
+
+func (this expiryHeap) Len() int            { return len(this) }
+func (this expiryHeap) Less(i, j int) bool  { return this[i].expiresAt < this[j].expiresAt }
+func (this expiryHeap) Swap(i, j int)       { this[i], this[j] = this[j], this[i] }
+func (this *expiryHeap) Push(x interface{}) { *this = append(*this, x.(expiryEntry)) }
+func (this *expiryHeap) Pop() interface{} {
+	entry := (*this)[len(*this)-1]
+	*this = (*this)[:len(*this)-1]
+	return entry
+}
+
+type ttlConfig struct {
+	ttl time.Duration
+	// If set, a row's age is measured from the Unix time (in milliseconds)
+	// held by @column, rather than from when the view received it
+	fromColumn bool
+	column     uint64
+	queue      expiryHeap
+	expired    int64
+	// Unless @fromColumn is set: the expiry of every row that the view holds,
+	// and those of the rows of every spilled key (in the order in which they
+	// were spilled), which the rows keep once they are loaded back
+	expiries map[*Record]int64
+	spilled  map[uint64][]int64
+}
+
+func newTTLConfig(ttl time.Duration) *ttlConfig {
+	return &ttlConfig{
+		ttl:      ttl,
+		expiries: make(map[*Record]int64),
+		spilled:  make(map[uint64][]int64),
+	}
+}
+
+func (this *ttlConfig) clone() *ttlConfig {
+	clone := newTTLConfig(this.ttl)
+	clone.fromColumn = this.fromColumn
+	clone.column = this.column
+	return clone
+}
+
+func (this *ttlConfig) expiresAt(record *Record, now time.Time) int64 {
+	if this.fromColumn {
+		return int64(record.GetValue(this.column))*int64(time.Millisecond) + int64(this.ttl)
+	}
+	return now.UnixNano() + int64(this.ttl)
+}
+
+// Expires rows @ttl after the view receives them; rows that are spilled keep
+// their expiry once they are loaded back. Returns ErrUnsupportedOperator for
+// partial views, which would recompute expired rows as if they were just
+// received (refer SetColumnTTL), or ErrInvalidArgument unless @ttl is positive.
+func (op *MatViewOperator) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: TTL must be positive", ErrInvalidArgument)
+	}
+	if op.partial {
+		return fmt.Errorf("%w: partial views only expire rows by a column", ErrUnsupportedOperator)
+	}
+	op.ttl = newTTLConfig(ttl)
+	return nil
+}
+
+// Expires rows @ttl after the Unix time (in milliseconds) held by @column.
+// Returns ErrInvalidArgument unless @ttl is positive, or if the view has been
+// added to a graph and its rows do not have @column.
+func (op *MatViewOperator) SetColumnTTL(column uint64, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: TTL must be positive", ErrInvalidArgument)
+	}
+	// The view's rows are those of its parent
+	if schemas := op.Core.InputSchemas; len(schemas) > 0 && schemas[0] != nil && column >= uint64(len(schemas[0].ColumnNames)) {
+		return fmt.Errorf("%w: the view's rows have no column %d", ErrInvalidArgument, column)
+	}
+	op.ttl = newTTLConfig(ttl)
+	op.ttl.fromColumn = true
+	op.ttl.column = column
+	return nil
+}
+
+// Returns how often the view should be swept, or 0 if it has no TTL
+func (op *MatViewOperator) sweepInterval() time.Duration {
+	if op.ttl == nil {
+		return 0
+	}
+	interval := op.ttl.ttl / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval
+}
+
+// Returns false if @record is already expired (and hence should not be stored)
+// Must be invoked by the view's writer
+func (op *MatViewOperator) trackExpiry(key uint64, record *Record, now time.Time) bool {
+	if op.ttl == nil {
+		return true
+	}
+	return op.restoreExpiry(key, record, op.ttl.expiresAt(record, now), now)
+}
+
+// Same as trackExpiry, for a row that expires at @expiresAt
+func (op *MatViewOperator) restoreExpiry(key uint64, record *Record, expiresAt int64, now time.Time) bool {
+	if expiresAt <= now.UnixNano() {
+		return false
+	}
+	op.ttl.track(expiryEntry{expiresAt: expiresAt, key: key, record: record})
+	return true
+}
+
+func (this *ttlConfig) track(entry expiryEntry) {
+	heap.Push(&this.queue, entry)
+	if !this.fromColumn {
+		this.expiries[entry.record] = entry.expiresAt
+	}
+}
+
+// Returns the entries of the rows that the view holds, i.e. without those of
+// rows that were evicted or expired
+func (this *ttlConfig) heldEntries() []expiryEntry {
+	var entries []expiryEntry
+	for _, entry := range this.queue {
+		if _, ok := this.expiries[entry.record]; ok || this.fromColumn {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Returns the expiry of each of @records, which the view no longer holds
+// (their entries in the queue are skipped once they expire)
+func (this *ttlConfig) forget(records []*Record) []int64 {
+	expiries := make([]int64, len(records))
+	for i, record := range records {
+		if this.fromColumn {
+			expiries[i] = this.expiresAt(record, time.Time{})
+			continue
+		}
+		expiries[i] = this.expiries[record]
+		delete(this.expiries, record)
+	}
+	return expiries
+}
+
+// Returns the expiry of each of the spilled @records of @key
+func (this *ttlConfig) spilledExpiries(key uint64, records []*Record) []int64 {
+	if this.fromColumn {
+		return this.forget(records)
+	}
+	return this.spilled[key]
+}
+
+// Records the expiries of the rows of @key that are spilled, after the ones
+// spilled already unless @replace is set
+func (this *ttlConfig) spill(key uint64, expiries []int64, replace bool) {
+	if this.fromColumn {
+		return
+	}
+	if replace {
+		this.spilled[key] = expiries
+	} else {
+		this.spilled[key] = append(this.spilled[key], expiries...)
+	}
+}
+
+// Drops the rows of a spilled key that expire at or before @now
+func (op *MatViewOperator) expireSpilled(key uint64, now time.Time) error {
+	spill := op.Core.memory.spilled()
+	records, err := spill.read(stateKey{key: key}, op.Core.OutputSchema)
+	if err != nil {
+		return err
+	}
+	expiries := op.ttl.spilledExpiries(key, records)
+	var live []*Record
+	var liveExpiries []int64
+	for i, record := range records {
+		if i < len(expiries) && expiries[i] <= now.UnixNano() {
+			continue
+		}
+		live = append(live, record)
+		if i < len(expiries) {
+			liveExpiries = append(liveExpiries, expiries[i])
+		}
+	}
+	if len(live) == len(records) {
+		return nil
+	}
+	atomic.AddInt64(&op.ttl.expired, int64(len(records)-len(live)))
+	if len(live) == 0 {
+		spill.drop(stateKey{key: key})
+		delete(op.ttl.spilled, key)
+		return nil
+	}
+	op.ttl.spill(key, liveExpiries, true)
+	return spill.replace(stateKey{key: key}, live)
+}
+
+// Drops the rows that expire at or before @now. Invoked periodically by the
+// partition's goroutine when the graph is run by an engine. Returns the first
+// error of the spill file, whose expired rows are instead dropped once they
+// are loaded back (refer reload); the other rows are dropped regardless.
+func (op *MatViewOperator) Expire(now time.Time) error {
+	if op.ttl == nil {
+		return nil
+	}
+	var firstErr error
+	op.state.beginWrite()
+	defer op.state.publish()
+	queue := &op.ttl.queue
+	for queue.Len() > 0 && (*queue)[0].expiresAt <= now.UnixNano() {
+		entry := heap.Pop(queue).(expiryEntry)
+		// The key may have been evicted since
+		records, ok := op.state.get(entry.key)
+		if !ok {
+			if op.Core.memory.isSpilled(stateKey{key: entry.key}) {
+				if err := op.expireSpilled(entry.key, now); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			continue
+		}
+		remaining := make([]*Record, 0, len(records))
+		for i, record := range records {
+			if record == entry.record {
+				remaining = append(remaining, records[i+1:]...)
+				break
+			}
+			remaining = append(remaining, record)
+		}
+		if len(remaining) == len(records) {
+			continue
+		}
+		atomic.AddInt64(&op.ttl.expired, 1)
+		delete(op.ttl.expiries, entry.record)
+		if len(remaining) == 0 {
+			op.state.remove(entry.key)
+			op.Core.memory.remove(stateKey{key: entry.key})
+			op.Core.memory.charge(-(entry.record.Size() + keyOverhead), -1)
+		} else {
+			op.state.set(entry.key, remaining)
+			op.Core.memory.charge(-entry.record.Size(), 0)
+		}
+	}
+	return firstErr
+}
+
+// Drops the rows of every view that expire at or before @now, on the
+// partitions' goroutines, and blocks until they are dropped. Returns the first
+// error of a view's spill file. Partitions otherwise expire rows periodically
+// (refer sweepInterval).
+func (engine *DataflowEngine) Expire(now time.Time) error {
+	engine.stateMu.RLock()
+	defer engine.stateMu.RUnlock()
+	if engine.stopped {
+		return ErrEngineStopped
+	}
+	engine.migrateMu.Lock()
+	defer engine.migrateMu.Unlock()
+	if len(engine.graphs) == 0 {
+		return ErrNotStarted
+	}
+	var partitions []uint64
+	for partition := range engine.graphs {
+		partitions = append(partitions, partition)
+	}
+	return engine.runTask(partitions, func(graph *Graph) error {
+		var firstErr error
+		for _, output := range graph.outputs {
+			if err := output.Expire(now); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+}
+
+// Returns the number of rows expired by the view
+func (op *MatViewOperator) GetExpiredCount() int64 {
+	if op.ttl == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&op.ttl.expired)
+}
@@ -0,0 +1,341 @@
+package dataflow
+
+import (
+	"fmt"
+	"time"
+)
+
+// A partial view that misses on a key upqueries the operators above it. The
+// upquery travels up through stateless operators (filters and projections)
+// until it reaches either:
+// (a) a stateful operator (input or equijoin) in the same partition, which
+// answers it on the partition's goroutine, or
+// (b) an exchange, in which case the records upstream of the exchange are
+// spread across partitions. Every partition answers from its share of the
+// state and sends the response through the exchange, i.e. on the same channel
+// as regular updates. This ensures that an update either is reflected in a
+// response or arrives after it, so updates are never lost nor applied twice.
+
+type UpqueryRequest struct {
+	// Index of the partial view that missed
+	ViewIndex int
+	// Key that missed
+	Key uint64
+	// Partition of the view that missed
+	Partition uint64
+}
+
+type ReplayResponse struct {
+	ViewIndex int
+	Key       uint64
+	// Partition that computed the response
+	Partition uint64
+	// Set if the partition failed to compute the response, in which case the
+	// fill fails
+	Err error
+}
+
+// Path from a partial view to the operator that answers its upqueries. Node
+// indices are used (rather than operators) so that the route can be resolved
+// in any partition's clone of the graph.
+type upqueryRoute struct {
+	// Stateless operators between the source and the view, in processing order
+	path []int
+	// Either an exchange or a stateful operator
+	source int
+	// Operator at @source in the view's graph; readers use it rather than
+	// looking it up, since migrations may modify the graph's nodes
+	sourceOp Operator
+	// Column of the source's output that corresponds to the view's key
+	column uint64
+}
+
+type pendingFill struct {
+	records  []*Record
+	buffered []*Record
+	// Partitions that have responded. Updates that arrive from these are
+	// buffered, while updates from the others are dropped since they will be
+	// reflected in the responses.
+	responded map[uint64]bool
+	expected  int
+	// Records of the key once the fill is complete
+	result []*Record
+	err    error
+	done   chan struct{}
+}
+
+func computeUpqueryRoute(view *MatViewOperator) *upqueryRoute {
+	route := &upqueryRoute{
+		column: view.GetKey(),
+	}
+	node := view.GetCore().GetParents()[0]
+	for {
+		switch node.(type) {
+		case *FilterOperator:
+		case *ProjectOperator:
+			route.column = node.(*ProjectOperator).cids[route.column]
+		default:
+			route.source = node.GetCore().GetIndex()
+			route.sourceOp = node
+			return route
+		}
+		route.path = append([]int{node.GetCore().GetIndex()}, route.path...)
+		node = node.GetCore().GetParents()[0]
+	}
+}
+
+// Processes @records through the stateless operators on the route
+func (route *upqueryRoute) forward(graph *Graph, records []*Record) ([]*Record, error) {
+	for _, index := range route.path {
+		var output []*Record
+		if err := graph.GetNode(index).Process(-1, &records, &output); err != nil {
+			return nil, err
+		}
+		records = output
+	}
+	return records, nil
+}
+
+// Upqueries @source and processes the response through the route
+func (route *upqueryRoute) compute(graph *Graph, source Operator, key uint64) ([]*Record, error) {
+	records, err := source.Upquery(route.column, key)
+	if err != nil {
+		return nil, err
+	}
+	return route.forward(graph, records)
+}
+
+func (op *MatViewOperator) getRoute() *upqueryRoute {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	if op.route == nil {
+		op.route = computeUpqueryRoute(op)
+	}
+	return op.route
+}
+
+// Computes @key for a partial view and blocks until the view holds it
+func (op *MatViewOperator) fill(key uint64) ([]*Record, error) {
+	graph := op.GetCore().GetGraph()
+	route := op.getRoute()
+	source := route.sourceOp
+	exchange, viaExchange := source.(*ExchangeOperator)
+	if graph.inbox == nil {
+		// The graph is not being run by an engine, hence the upquery can be
+		// answered on the calling goroutine
+		if viaExchange {
+			return nil, fmt.Errorf("%w: upqueries through an exchange are answered by the engine's partitions", ErrNotStarted)
+		}
+		computed, err := route.compute(graph, source, key)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]*Record, 0)
+		records = append(records, computed...)
+		op.state.beginWrite()
+		defer op.state.publish()
+		records = op.install(key, records, nil)
+		return records, op.enforceMemoryLimit()
+	}
+
+	op.pendingMu.Lock()
+	if op.removed {
+		op.pendingMu.Unlock()
+		return nil, ErrViewRemoved
+	}
+	if graph.lifecycle.isStopped() {
+		op.pendingMu.Unlock()
+		return nil, ErrEngineStopped
+	}
+	fill, ok := op.pending[key]
+	if !ok {
+		fill = &pendingFill{
+			responded: make(map[uint64]bool),
+			expected:  1,
+			done:      make(chan struct{}),
+		}
+		if viaExchange {
+			fill.expected = int(exchange.totalParitions)
+		}
+		op.pending[key] = fill
+	}
+	op.pendingMu.Unlock()
+	// Only the first reader to miss issues the upquery
+	if !ok {
+		request := &UpqueryRequest{
+			ViewIndex: op.GetCore().GetIndex(),
+			Key:       key,
+			Partition: graph.GetIndex(),
+		}
+		if viaExchange {
+			for _, peerChan := range exchange.peerChans {
+				graph.lifecycle.send(peerChan, &BatchMessage{EntryIndex: -1, Upquery: request})
+			}
+		} else {
+			graph.lifecycle.send(graph.inbox, &BatchMessage{EntryIndex: -1, Upquery: request})
+		}
+	}
+	if graph.lifecycle == nil {
+		<-fill.done
+		return fill.result, fill.err
+	}
+	select {
+	case <-fill.done:
+		return fill.result, fill.err
+	case <-graph.lifecycle.done:
+		// The engine stopped (or the view was replaced by rescaling) before the
+		// upquery was answered
+		if op.isRemoved() {
+			return nil, ErrViewRemoved
+		}
+		return nil, ErrEngineStopped
+	}
+}
+
+// Fails the view's pending fills, and any fill attempted later, once the view
+// is removed
+func (op *MatViewOperator) abortFills() {
+	op.pendingMu.Lock()
+	op.removed = true
+	pending := op.pending
+	op.pending = make(map[uint64]*pendingFill)
+	op.pendingMu.Unlock()
+	for _, fill := range pending {
+		fill.err = ErrViewRemoved
+		close(fill.done)
+	}
+}
+
+func (op *MatViewOperator) isRemoved() bool {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	return op.removed
+}
+
+// Invoked for records of a partial view whose key is not materialized
+func (op *MatViewOperator) bufferIfPending(key uint64, record *Record) {
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	fill, ok := op.pending[key]
+	if ok && fill.responded[op.GetCore().viaPartition()] {
+		fill.buffered = append(fill.buffered, record)
+	}
+}
+
+// A failed response (@err) fails the whole fill; responses from the other
+// partitions are then ignored
+func (op *MatViewOperator) applyReplay(key uint64, partition uint64, records []*Record, err error) {
+	op.state.beginWrite()
+	op.pendingMu.Lock()
+	fill, ok := op.pending[key]
+	if !ok || fill.responded[partition] {
+		op.pendingMu.Unlock()
+		op.state.publish()
+		return
+	}
+	if err != nil {
+		fill.err = err
+		delete(op.pending, key)
+		op.pendingMu.Unlock()
+		op.state.publish()
+		close(fill.done)
+		return
+	}
+	fill.records = append(fill.records, records...)
+	fill.responded[partition] = true
+	complete := len(fill.responded) == fill.expected
+	if complete {
+		filled := make([]*Record, 0, len(fill.records)+len(fill.buffered))
+		filled = append(filled, fill.records...)
+		fill.result = op.install(key, append(filled, fill.buffered...), nil)
+		delete(op.pending, key)
+	}
+	op.pendingMu.Unlock()
+	if complete {
+		fill.err = op.enforceMemoryLimit()
+	}
+	op.state.publish()
+	// Readers are only woken up once the key has been published
+	if complete {
+		close(fill.done)
+	}
+}
+
+// Must be invoked by the view's writer. @expiries hold the expiry of each of
+// @records if they were received earlier (i.e. spilled), and are nil if the
+// records are received now. Returns the records that the view holds, i.e.
+// without those that already expired.
+func (op *MatViewOperator) install(key uint64, records []*Record, expiries []int64) []*Record {
+	if op.ttl != nil {
+		now := time.Now()
+		live := make([]*Record, 0, len(records))
+		for i, record := range records {
+			received := i >= len(expiries)
+			if (received && op.trackExpiry(key, record, now)) || (!received && op.restoreExpiry(key, record, expiries[i], now)) {
+				live = append(live, record)
+			}
+		}
+		records = live
+	}
+	op.state.set(key, records)
+	op.Core.memory.charge(recordsSize(records)+keyOverhead, 1)
+	op.Core.memory.touch(stateKey{key: key})
+	return records
+}
+
+// Invoked on the partition's goroutine
+func (graph *Graph) answerUpquery(request *UpqueryRequest) {
+	view, ok := graph.GetNode(request.ViewIndex).(*MatViewOperator)
+	if !ok {
+		// The view was removed; its fills have been aborted
+		return
+	}
+	route := view.getRoute()
+	source := graph.GetNode(route.source)
+	exchange, ok := source.(*ExchangeOperator)
+	if !ok {
+		records, err := route.compute(graph, source, request.Key)
+		view.applyReplay(request.Key, graph.GetIndex(), records, err)
+		return
+	}
+	// Respond only with the records that the exchange routes to the view (the
+	// view's own partition holds all of them if they are replicated)
+	var records []*Record
+	upstream, err := exchange.GetCore().GetParents()[0].Upquery(route.column, request.Key)
+	if exchange.routing.mode != localRouting || request.Partition == graph.GetIndex() {
+		for _, record := range upstream {
+			if exchange.partitionOf(record) == request.Partition {
+				records = append(records, record)
+			}
+		}
+	}
+	response := &ReplayResponse{
+		ViewIndex: request.ViewIndex,
+		Key:       request.Key,
+		Partition: graph.GetIndex(),
+		Err:       err,
+	}
+	if request.Partition == graph.GetIndex() {
+		graph.applyReplay(response, &records)
+		return
+	}
+	graph.lifecycle.send(exchange.peerChans[request.Partition], &BatchMessage{
+		EntryIndex:      -1,
+		Records:         &records,
+		SourcePartition: graph.GetIndex(),
+		Replay:          response,
+	})
+}
+
+func (graph *Graph) applyReplay(response *ReplayResponse, records *[]*Record) {
+	view, ok := graph.GetNode(response.ViewIndex).(*MatViewOperator)
+	if !ok {
+		return
+	}
+	if response.Err != nil {
+		view.applyReplay(response.Key, response.Partition, nil, response.Err)
+		return
+	}
+	forwarded, err := view.getRoute().forward(graph, *records)
+	view.applyReplay(response.Key, response.Partition, forwarded, err)
+}
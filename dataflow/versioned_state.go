@@ -0,0 +1,144 @@
+package dataflow
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type viewOpKind uint8
+
+const (
+	appendRecord viewOpKind = iota
+	setRecords
+	removeKey
+)
+
+type viewOp struct {
+	kind    viewOpKind
+	key     uint64
+	record  *Record
+	records []*Record
+}
+
+// The state of a view, kept as two copies (left-right) so that readers never
+// block the writer nor observe a partially applied batch. Readers access the
+// published copy, while the writer applies a batch to the other copy and then
+// publishes it. The operations of the batch are replayed onto the stale copy
+// when the next batch begins, by which time readers have moved to the newly
+// published copy (the writer waits for any that have not).
+type versionedState struct {
+	copies    [2]map[uint64][]*Record
+	locks     [2]sync.RWMutex
+	published int32
+	// Incremented every time a batch is published
+	version uint64
+	// Operations applied to the published copy but not to the stale one
+	oplog []viewOp
+	// Serializes writers; a batch is applied between beginWrite and publish
+	writeMu sync.Mutex
+}
+
+func newVersionedState() *versionedState {
+	return &versionedState{
+		copies: [2]map[uint64][]*Record{
+			make(map[uint64][]*Record),
+			make(map[uint64][]*Record),
+		},
+	}
+}
+
+func (this *versionedState) writeSide() int32 {
+	return 1 - atomic.LoadInt32(&this.published)
+}
+
+func (this *versionedState) beginWrite() {
+	this.writeMu.Lock()
+	side := this.writeSide()
+	this.locks[side].Lock()
+	for _, op := range this.oplog {
+		this.apply(side, op, true)
+	}
+	this.oplog = this.oplog[:0]
+}
+
+func (this *versionedState) publish() {
+	this.publishThen(nil)
+}
+
+// Same as publish, but invokes @published (unless nil) once readers access the
+// batch, before the next batch may begin
+func (this *versionedState) publishThen(published func()) {
+	side := this.writeSide()
+	this.locks[side].Unlock()
+	atomic.StoreInt32(&this.published, side)
+	atomic.AddUint64(&this.version, 1)
+	if published != nil {
+		published()
+	}
+	this.writeMu.Unlock()
+}
+
+func (this *versionedState) apply(side int32, op viewOp, replay bool) {
+	switch op.kind {
+	case appendRecord:
+		this.copies[side][op.key] = append(this.copies[side][op.key], op.record)
+	case setRecords:
+		records := op.records
+		if replay {
+			// Each copy needs its own backing array since both get appended to
+			records = append(make([]*Record, 0, len(op.records)), op.records...)
+		}
+		this.copies[side][op.key] = records
+	case removeKey:
+		delete(this.copies[side], op.key)
+	}
+	if !replay {
+		this.oplog = append(this.oplog, op)
+	}
+}
+
+// The following may only be invoked by the writer (i.e. between beginWrite
+// and publish), and reflect the batch being written.
+
+func (this *versionedState) get(key uint64) ([]*Record, bool) {
+	records, ok := this.copies[this.writeSide()][key]
+	return records, ok
+}
+
+func (this *versionedState) append(key uint64, record *Record) {
+	this.apply(this.writeSide(), viewOp{kind: appendRecord, key: key, record: record}, false)
+}
+
+func (this *versionedState) set(key uint64, records []*Record) {
+	this.apply(this.writeSide(), viewOp{kind: setRecords, key: key, records: records}, false)
+}
+
+func (this *versionedState) remove(key uint64) {
+	this.apply(this.writeSide(), viewOp{kind: removeKey, key: key}, false)
+}
+
+// The following may be invoked concurrently with the writer, and reflect the
+// most recently published batch.
+
+func (this *versionedState) read(key uint64) ([]*Record, bool) {
+	side := atomic.LoadInt32(&this.published)
+	this.locks[side].RLock()
+	defer this.locks[side].RUnlock()
+	records, ok := this.copies[side][key]
+	return records, ok
+}
+
+// Invokes @visit for every key of the published copy; the writer may be
+// blocked until it returns, hence @visit should not block
+func (this *versionedState) forEach(visit func(key uint64, records []*Record)) {
+	side := atomic.LoadInt32(&this.published)
+	this.locks[side].RLock()
+	defer this.locks[side].RUnlock()
+	for key, records := range this.copies[side] {
+		visit(key, records)
+	}
+}
+
+func (this *versionedState) getVersion() uint64 {
+	return atomic.LoadUint64(&this.version)
+}
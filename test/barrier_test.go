@@ -0,0 +1,56 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// DESCRIPTION: Tickets cover the batches that exchanges send on behalf of the
+// original batch, hence waiting on them is enough for the join results to be
+// visible in the (exchanged) view.
+func TestTicketsAcrossExchanges(t *testing.T) {
+	schema1, schema2 := makeSchemasForJoin()
+	schema3 := makeThirdInputSchema()
+	input1 := dataflow.NewInputOperator("table1", schema1)
+	input2 := dataflow.NewInputOperator("table2", schema2)
+	input3 := dataflow.NewInputOperator("table3", schema3)
+	join1 := dataflow.NewEquiJoinOperator(1, 0)
+	join2 := dataflow.NewEquiJoinOperator(3, 1)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(input3, true)
+	graph.AddInputOperator(input1, true)
+	graph.AddInputOperator(input2, true)
+	graph.AddNodeMultipleParents(join1, []dataflow.Operator{input1, input2}, true)
+	graph.AddNodeMultipleParents(join2, []dataflow.Operator{join1, input3}, true)
+	graph.AddOutputOperator(matview, join2, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	records1 := makeLeftRecords(schema1)
+	records2 := makeRightRecords(schema2)
+	records3 := makeThirdInputRecords(schema3)
+	engine.Process("table1", &records1)
+	engine.Process("table2", &records2)
+	ticket, err := engine.Process("table3", &records3)
+	assert.Nil(t, err)
+	assert.Nil(t, ticket.Wait())
+	// Earlier batches are not necessarily complete, hence flush
+	assert.Nil(t, engine.Flush())
+	assert.Equal(t, engine.GetOutput(0).Lookup(2)[0].Data, []uint64{2, 20, 10, 60, 120})
+	assert.Equal(t, engine.GetOutput(1).Lookup(3)[0].Data, []uint64{3, 31, 10, 62, 124})
+
+	// A ticket without any records completes immediately
+	var empty []*dataflow.Record
+	ticket, _ = engine.Process("table1", &empty)
+	select {
+	case <-ticket.Done():
+	default:
+		t.Errorf("Empty batch did not complete")
+	}
+}
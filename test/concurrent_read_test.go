@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// DESCRIPTION: Lookups run concurrently with the partition's goroutine
+// applying batches. Every batch adds two records for the same key, hence a
+// lookup must never observe an odd number of them.
+func TestConcurrentLookups(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	const batches = 200
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				records := engine.GetOutput(0).Lookup(2)
+				assert.Equal(t, len(records)%2, 0)
+			}
+		}()
+	}
+	for i := 0; i < batches; i++ {
+		records := []*dataflow.Record{
+			{Schema: schema, Data: []uint64{2, uint64(i)}},
+			{Schema: schema, Data: []uint64{2, uint64(i)}},
+		}
+		_, err := engine.Process("table1", &records)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, engine.Flush())
+	close(done)
+	wg.Wait()
+	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 2*batches)
+	assert.Equal(t, engine.GetOutput(0).GetVersion(), uint64(batches))
+}
+
+// DESCRIPTION: Lookups run concurrently with a view that spills a key and
+// loads it back on every batch, hence a lookup must always find the key's
+// records in either place.
+func TestConcurrentLookupsOfSpilledKeys(t *testing.T) {
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetMemoryLimit(twoKeyLimit/2, dataflow.LRU, dataflow.Spill))
+	var output []*dataflow.Record
+	seed := []*dataflow.Record{{Schema: schema, Data: []uint64{1, 0}}}
+	matviewOperator.Process(-1, &seed, &output)
+
+	// Key 2 is only read once it is added; the first batch spills key 1
+	const batches = 500
+	added := uint64(1)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for key := uint64(1); key <= atomic.LoadUint64(&added); key++ {
+					records, err := matviewOperator.TryLookup(key)
+					assert.Nil(t, err)
+					assert.NotEmpty(t, records)
+				}
+			}
+		}()
+	}
+	for i := 0; i < batches; i++ {
+		// Loads the key back, and spills the other one
+		records := []*dataflow.Record{{Schema: schema, Data: []uint64{uint64(i%2 + 2), uint64(i)}}}
+		assert.Nil(t, matviewOperator.Process(-1, &records, &output))
+		if i == 0 {
+			atomic.StoreUint64(&added, 2)
+		}
+	}
+	close(done)
+	wg.Wait()
+	assert.Len(t, matviewOperator.Lookup(1), 1)
+	assert.Len(t, matviewOperator.Lookup(2), batches/2)
+	assert.Len(t, matviewOperator.Lookup(3), batches/2)
+}
@@ -0,0 +1,272 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeOrdersSchemas() (*dataflow.Schema, *dataflow.Schema) {
+	orders := &dataflow.Schema{ColumnNames: []string{"id", "customer", "amount"}}
+	customers := &dataflow.Schema{ColumnNames: []string{"id", "region"}}
+	return orders, customers
+}
+
+// Orders (viewed by id) joined with their customers, and viewed by order id
+func makeOrdersEngine(stats *dataflow.Statistics) (*dataflow.DataflowEngine, *dataflow.EquiJoinOperator, *dataflow.MatViewOperator) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := dataflow.NewInputOperator("orders", ordersSchema)
+	customers := dataflow.NewInputOperator("customers", customersSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(orders, true)
+	graph.AddInputOperator(customers, true)
+	graph.AddOutputOperator(dataflow.NewMatViewOperator(0), orders, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{orders, customers}, true)
+	byOrder := dataflow.NewMatViewOperator(0)
+	graph.AddOutputOperator(byOrder, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	if stats != nil {
+		engine.SetStatistics(stats)
+	}
+	engine.StartEngine()
+	return engine, equijoin, byOrder
+}
+
+func makeOrders(schema *dataflow.Schema, first uint64, count uint64) []*dataflow.Record {
+	var records []*dataflow.Record
+	for id := first; id < first+count; id++ {
+		records = append(records, &dataflow.Record{Schema: schema, Data: []uint64{id, id % 3, id * 10}})
+	}
+	return records
+}
+
+func countExchanges(plan *dataflow.PhysicalPlan) (shuffles int, broadcasts int) {
+	for _, node := range plan.Nodes {
+		if node.Type != dataflow.EXCHANGE {
+			continue
+		}
+		if node.Replicated {
+			broadcasts++
+		} else {
+			shuffles++
+		}
+	}
+	return shuffles, broadcasts
+}
+
+func TestCollectStatistics(t *testing.T) {
+	engine, equijoin, byOrder := makeOrdersEngine(nil)
+	defer engine.Stop(context.Background())
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := makeOrders(ordersSchema, 0, 30)
+	customers := []*dataflow.Record{
+		{Schema: customersSchema, Data: []uint64{0, 7}},
+		{Schema: customersSchema, Data: []uint64{1, 7}},
+		{Schema: customersSchema, Data: []uint64{2, 8}},
+	}
+	assert.Nil(t, engine.ProcessSync("orders", &orders))
+	assert.Nil(t, engine.ProcessSync("customers", &customers))
+
+	stats, err := engine.CollectStatistics()
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Inputs["orders"].Rows, int64(30))
+	assert.Equal(t, stats.Inputs["orders"].Columns[0], dataflow.ColumnStatistics{Distinct: 30, MaxFrequency: 1})
+	assert.Equal(t, stats.Inputs["orders"].Columns[1], dataflow.ColumnStatistics{Distinct: 3, MaxFrequency: 10})
+	assert.Equal(t, stats.Inputs["customers"].Columns[1], dataflow.ColumnStatistics{Distinct: 2, MaxFrequency: 2})
+	// Both tables of the join, by join key
+	joinStats := stats.Operators[equijoin.GetCore().GetIndex()]
+	assert.Equal(t, joinStats.Type, dataflow.EQUIJOIN)
+	assert.Equal(t, joinStats.Rows, int64(33))
+	assert.Equal(t, joinStats.Keys, int64(3))
+	assert.Equal(t, joinStats.MaxKeyRows, int64(11))
+	viewStats := stats.Operators[byOrder.GetCore().GetIndex()]
+	assert.Equal(t, viewStats.Rows, int64(30))
+	assert.Equal(t, viewStats.Keys, int64(30))
+}
+
+func TestBroadcastSmallInput(t *testing.T) {
+	// Without statistics the orders are shuffled by customer, and then back by
+	// order id for the view
+	engine, _, _ := makeOrdersEngine(nil)
+	shuffles, broadcasts := countExchanges(engine.Explain())
+	assert.Equal(t, shuffles, 2)
+	assert.Equal(t, broadcasts, 0)
+	engine.Stop(context.Background())
+
+	// Broadcasting the few customers is cheaper, and leaves the join's output
+	// partitioned by order id. The customers are replicated as they enter the
+	// engine, hence no exchange is needed.
+	stats := &dataflow.Statistics{
+		Inputs: map[string]*dataflow.InputStatistics{
+			"orders":    {Rows: 100000},
+			"customers": {Rows: 10},
+		},
+	}
+	engine, equijoin, byOrder := makeOrdersEngine(stats)
+	defer engine.Stop(context.Background())
+	plan := engine.Explain()
+	shuffles, broadcasts = countExchanges(plan)
+	assert.Equal(t, shuffles, 0)
+	assert.Equal(t, broadcasts, 0)
+	assert.Equal(t, plan.BroadcastInputs, []string{"customers"})
+	text := plan.String()
+	assert.True(t, strings.Contains(text, "broadcasting the right input <- 0, 1: partitioned by column 0\n"))
+	assert.True(t, strings.Contains(text, "customers: replicated to every partition\n"))
+
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	customers := []*dataflow.Record{
+		{Schema: customersSchema, Data: []uint64{0, 7}},
+		{Schema: customersSchema, Data: []uint64{1, 8}},
+	}
+	assert.Nil(t, engine.ProcessSync("customers", &customers))
+	orders := makeOrders(ordersSchema, 0, 10)
+	assert.Nil(t, engine.ProcessSync("orders", &orders))
+	// Every order is joined once, in the partition of its id
+	assert.Equal(t, engine.GetView(1, byOrder).Lookup(7)[0].Data, []uint64{7, 1, 70, 8})
+	assert.Len(t, engine.GetView(0, byOrder).Lookup(6), 1)
+	assert.Empty(t, engine.GetView(1, byOrder).Lookup(8))
+	assert.Empty(t, engine.GetView(0, byOrder).Lookup(5))
+
+	// Customers added later reach every partition
+	late := []*dataflow.Record{{Schema: customersSchema, Data: []uint64{2, 9}}}
+	assert.Nil(t, engine.ProcessSync("customers", &late))
+	assert.Equal(t, engine.GetView(1, byOrder).Lookup(5)[0].Data, []uint64{5, 2, 50, 9})
+	assert.Equal(t, engine.GetView(0, byOrder).Lookup(8)[0].Data, []uint64{8, 2, 80, 9})
+
+	// The broadcast side is copied to every new partition, and the orders stay
+	// in the partition of their id
+	assert.Nil(t, engine.Rescale(3))
+	more := makeOrders(ordersSchema, 10, 3)
+	assert.Nil(t, engine.ProcessSync("orders", &more))
+	assert.Equal(t, engine.GetView(1, byOrder).Lookup(10)[0].Data, []uint64{10, 1, 100, 8})
+	assert.Equal(t, engine.GetView(2, byOrder).Lookup(11)[0].Data, []uint64{11, 2, 110, 9})
+	assert.Equal(t, engine.GetView(0, byOrder).Lookup(12)[0].Data, []uint64{12, 0, 120, 7})
+	assert.Equal(t, engine.GetView(0, byOrder).Lookup(3)[0].Data, []uint64{3, 0, 30, 7})
+	for partition := uint64(0); partition < 3; partition++ {
+		for id := uint64(0); id < 13; id++ {
+			if id%3 != partition {
+				assert.Empty(t, engine.GetView(partition, byOrder).Lookup(id))
+			}
+		}
+	}
+
+	// Keys of a broadcast join need not be split
+	err := engine.SplitJoinKey(equijoin, 1, dataflow.LeftSide)
+	assert.ErrorIs(t, err, dataflow.ErrInvalidSplit)
+}
+
+func TestMigrationBroadcastsFromCollectedStatistics(t *testing.T) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := dataflow.NewInputOperator("orders", ordersSchema)
+	customers := dataflow.NewInputOperator("customers", customersSchema)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(orders, true)
+	graph.AddInputOperator(customers, true)
+	graph.AddOutputOperator(dataflow.NewMatViewOperator(0), orders, true)
+	graph.AddOutputOperator(dataflow.NewMatViewOperator(0), customers, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+	customerRecords := []*dataflow.Record{
+		{Schema: customersSchema, Data: []uint64{0, 7}},
+		{Schema: customersSchema, Data: []uint64{1, 8}},
+		{Schema: customersSchema, Data: []uint64{2, 9}},
+	}
+	assert.Nil(t, engine.ProcessSync("customers", &customerRecords))
+	orderRecords := makeOrders(ordersSchema, 0, 60)
+	assert.Nil(t, engine.ProcessSync("orders", &orderRecords))
+	_, err := engine.CollectStatistics()
+	assert.Nil(t, err)
+
+	// The customers (the right side) are already partitioned by the join key,
+	// yet shuffling the orders by customer costs more than broadcasting the
+	// customers.
+	// The orders are joined with the customers in the partition of their id.
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	byOrder := dataflow.NewMatViewOperator(0)
+	migration := engine.NewMigration()
+	migration.AddNodeMultipleParents(equijoin, []dataflow.Operator{orders, customers})
+	migration.AddOutputOperator(byOrder, equijoin)
+	assert.Nil(t, migration.Commit())
+	shuffles, broadcasts := countExchanges(engine.Explain())
+	assert.Equal(t, shuffles, 0)
+	assert.Equal(t, broadcasts, 1)
+	for id := uint64(0); id < 60; id++ {
+		rows := engine.GetView(id%2, byOrder).Lookup(id)
+		assert.Len(t, rows, 1)
+		assert.Equal(t, rows[0].Data, []uint64{id, id % 3, id * 10, 7 + id%3})
+		assert.Empty(t, engine.GetView(1-id%2, byOrder).Lookup(id))
+	}
+}
+
+func TestBroadcastInputHint(t *testing.T) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := dataflow.NewInputOperator("orders", ordersSchema)
+	customers := dataflow.NewInputOperator("customers", customersSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	byCustomer := dataflow.NewMatViewOperator(1)
+	byRegion := dataflow.NewMatViewOperator(1)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(orders, true)
+	graph.AddInputOperator(customers, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{orders, customers}, true)
+	graph.AddOutputOperator(byCustomer, equijoin, true)
+	graph.AddOutputOperator(byRegion, customers, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.BroadcastInput("customers")
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	// The orders are partitioned by customer as they enter the engine, and
+	// joined with the customers in their partition. Every partition keeps the
+	// customers of its own regions for the view, without sending any.
+	plan := engine.Explain()
+	assert.Equal(t, plan.BroadcastInputs, []string{"customers"})
+	assert.Equal(t, plan.InputPartitioning["orders"], uint64(1))
+	exchanges := planNodesOfType(plan, dataflow.EXCHANGE)
+	assert.Len(t, exchanges, 1)
+	assert.Equal(t, exchanges[0].Details, "by column 1, within every partition")
+	assert.Equal(t, exchanges[0].Reason, "MatView 4 requires its input partitioned by column 1, but Input 1 emits records replicated to every partition")
+
+	customerRecords := []*dataflow.Record{
+		{Schema: customersSchema, Data: []uint64{0, 7}},
+		{Schema: customersSchema, Data: []uint64{1, 8}},
+		{Schema: customersSchema, Data: []uint64{2, 7}},
+	}
+	assert.Nil(t, engine.ProcessSync("customers", &customerRecords))
+	orderRecords := makeOrders(ordersSchema, 0, 6)
+	assert.Nil(t, engine.ProcessSync("orders", &orderRecords))
+	assert.Len(t, engine.GetView(1, byRegion).Lookup(7), 2)
+	assert.Len(t, engine.GetView(0, byRegion).Lookup(8), 1)
+	assert.Empty(t, engine.GetView(0, byRegion).Lookup(7))
+	assert.Len(t, engine.GetView(1, byCustomer).Lookup(1), 2)
+	assert.Equal(t, engine.GetView(0, byCustomer).Lookup(2)[0].Data[3], uint64(7))
+
+	// Views added later read the replicated customers once as well
+	byId := dataflow.NewMatViewOperator(0)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byId, customers)
+	assert.Nil(t, migration.Commit())
+	assert.Len(t, engine.GetView(0, byId).Lookup(2), 1)
+	assert.Empty(t, engine.GetView(1, byId).Lookup(2))
+
+	// Updates to the customers reach every partition, also once rescaled
+	assert.Nil(t, engine.Rescale(3))
+	late := []*dataflow.Record{{Schema: customersSchema, Data: []uint64{3, 8}}}
+	assert.Nil(t, engine.ProcessSync("customers", &late))
+	more := []*dataflow.Record{{Schema: ordersSchema, Data: []uint64{6, 3, 60}}, {Schema: ordersSchema, Data: []uint64{7, 1, 70}}}
+	assert.Nil(t, engine.ProcessSync("orders", &more))
+	assert.Equal(t, engine.GetView(0, byCustomer).Lookup(3)[0].Data, []uint64{6, 3, 60, 8})
+	assert.Len(t, engine.GetView(1, byCustomer).Lookup(1), 3)
+	assert.Len(t, engine.GetView(2, byRegion).Lookup(8), 2)
+	assert.Len(t, engine.GetView(1, byRegion).Lookup(7), 2)
+	assert.Len(t, engine.GetView(0, byId).Lookup(3), 1)
+
+	unknown := dataflow.NewDataflowEngine(2, dataflow.NewGraph())
+	unknown.BroadcastInput("missing")
+	assert.ErrorIs(t, unknown.StartEngine(), dataflow.ErrUnknownInput)
+}
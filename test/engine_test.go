@@ -1,9 +1,9 @@
 package test
 
 import (
+	"context"
 	"prototype/dataflow"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -132,11 +132,11 @@ func TestFilterGraph(t *testing.T) {
 	graph.AddOutputOperator(matviewOperator, filterOperator, true)
 
 	engine := dataflow.NewDataflowEngine(2, graph)
-	engine.StartEngine()
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
 
 	records := makeInputRecords(schema)
-	engine.Process("table1", &records)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("table1", &records))
 
 	// Check outputs
 	assert.Equal(t, engine.GetOutput(0).Lookup(4)[0], records[3])
@@ -161,20 +161,19 @@ func TestSingleJoinGraph(t *testing.T) {
 	graph.AddOutputOperator(matview, equijoin, true)
 
 	engine := dataflow.NewDataflowEngine(2, graph)
-	engine.StartEngine()
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
 
 	// NOTE: The matview is keyed on Column 0 (refer the operator construction
 	// above), hence an exchange operator will partition it on the same.
 	leftRecords := makeLeftRecords(leftSchema)
-	engine.Process("leftTable", &leftRecords)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(1)), 0)
 	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 0)
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 0)
 
 	rightRecords := makeRightRecords(rightSchema)
-	engine.Process("rightTable", &rightRecords)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(1)), 1)
 	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 1)
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 1)
@@ -212,23 +211,21 @@ func TestTwoJoinGraph(t *testing.T) {
 	graph.AddOutputOperator(matview, join2, true)
 
 	engine := dataflow.NewDataflowEngine(2, graph)
-	engine.StartEngine()
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
 
 	records1 := makeLeftRecords(schema1)
-	engine.Process("table1", &records1)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("table1", &records1))
 	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 0)
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 0)
 
 	records2 := makeRightRecords(schema2)
-	engine.Process("table2", &records2)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("table2", &records2))
 	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 0)
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 0)
 
 	records3 := makeThirdInputRecords(schema3)
-	engine.Process("table3", &records3)
-	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, engine.ProcessSync("table3", &records3))
 	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 1)
 	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 1)
 
@@ -237,3 +234,151 @@ func TestTwoJoinGraph(t *testing.T) {
 	assert.Equal(t, engine.GetOutput(0).Lookup(2)[0].Data, []uint64{2, 20, 10, 60, 120})
 	assert.Equal(t, engine.GetOutput(1).Lookup(3)[0].Data, []uint64{3, 31, 10, 62, 124})
 }
+
+// DESCRIPTION: An input feeds a filter (which in turn feeds two views keyed on
+// different columns) as well as a join. Each branch is planned on its own:
+// exchanges are inserted on the edges that need them, rather than after the
+// node that fans out.
+func TestFanOutGraph(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	filter := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.LessThan}, []uint64{3})
+	byID := dataflow.NewMatViewOperator(0)
+	byValue := dataflow.NewMatViewOperator(2)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	joined := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNode(filter, leftInput, true)
+	graph.AddOutputOperator(byID, filter, true)
+	graph.AddOutputOperator(byValue, filter, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(joined, equijoin, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	assert.Equal(t, engine.GetView(1, byID).Lookup(1)[0].Data, []uint64{1, 10, 5})
+	assert.Equal(t, engine.GetView(0, byID).Lookup(2)[0].Data, []uint64{2, 20, 10})
+	assert.Nil(t, engine.GetView(1, byID).Lookup(3))
+	assert.Equal(t, engine.GetView(1, byValue).Lookup(5)[0].Data, []uint64{1, 10, 5})
+	assert.Equal(t, engine.GetView(0, byValue).Lookup(10)[0].Data, []uint64{2, 20, 10})
+	assert.Equal(t, engine.GetView(1, joined).Lookup(1)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, engine.GetView(0, joined).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	assert.Equal(t, engine.GetView(1, joined).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+}
+
+// DESCRIPTION: A projection that reorders columns feeds a join. The join
+// column is mapped through the projection, hence the input is partitioned by
+// the column that becomes the join column.
+func TestPartitioningThroughProjection(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	project := dataflow.NewProjectOperator([]uint64{1, 0})
+	equijoin := dataflow.NewEquiJoinOperator(0, 0)
+	matview := dataflow.NewMatViewOperator(1)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNode(project, leftInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{project, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	assert.Equal(t, engine.GetView(1, matview).Lookup(1)[0].Data, []uint64{10, 1, 20})
+	assert.Equal(t, engine.GetView(0, matview).Lookup(2)[0].Data, []uint64{20, 2, 60})
+	assert.Equal(t, engine.GetView(1, matview).Lookup(3)[0].Data, []uint64{31, 3, 62})
+	// The right join column is not part of the output
+	assert.Equal(t, equijoin.GetCore().OutputSchema.ColumnNames, []string{"Col2", "Col1", "Col5"})
+}
+
+// DESCRIPTION: A view keyed by the join column is already partitioned as it
+// requires, hence no exchange is inserted before it.
+func TestNoExchangeWhenPartitioned(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	byJoinKey := dataflow.NewMatViewOperator(1)
+	byID := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(byJoinKey, equijoin, true)
+	graph.AddOutputOperator(byID, equijoin, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	_, shuffled := engine.GetView(0, byJoinKey).GetCore().GetParents()[0].(*dataflow.ExchangeOperator)
+	assert.False(t, shuffled)
+	_, shuffled = engine.GetView(0, byID).GetCore().GetParents()[0].(*dataflow.ExchangeOperator)
+	assert.True(t, shuffled)
+	assert.Equal(t, engine.GetView(0, byJoinKey).Lookup(10)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, engine.GetView(1, byJoinKey).Lookup(31)[0].Data, []uint64{3, 31, 10, 62})
+	assert.Equal(t, engine.GetView(1, byID).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+}
+
+// DESCRIPTION: An input feeds a join on its second column, and two views keyed
+// on its first column. The input is partitioned by the column that most of
+// them require, although the join is visited first, and only the join is fed
+// through an exchange.
+func TestConflictingInputPartitioning(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	joined := dataflow.NewMatViewOperator(1)
+	filter := dataflow.NewFilterOperator([]uint64{2}, []dataflow.CompOp{dataflow.GreaterThan}, []uint64{5})
+	byID := dataflow.NewMatViewOperator(0)
+	filtered := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(joined, equijoin, true)
+	graph.AddOutputOperator(byID, leftInput, true)
+	graph.AddNode(filter, leftInput, true)
+	graph.AddOutputOperator(filtered, filter, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	plan := engine.Explain()
+	assert.Equal(t, plan.InputPartitioning["leftTable"], uint64(0))
+	exchanges := planNodesOfType(plan, dataflow.EXCHANGE)
+	assert.Len(t, exchanges, 1)
+	assert.Equal(t, exchanges[0].Reason, "EquiJoin 2 requires its left input partitioned by column 1, but Input 0 emits records partitioned by column 0")
+
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Equal(t, engine.GetView(0, byID).Lookup(2)[0].Data, []uint64{2, 20, 10})
+	assert.Empty(t, engine.GetView(1, byID).Lookup(2))
+	assert.Equal(t, engine.GetView(1, filtered).Lookup(3)[0].Data, []uint64{3, 31, 10})
+	assert.Empty(t, engine.GetView(1, filtered).Lookup(1))
+	assert.Equal(t, engine.GetView(0, joined).Lookup(10)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, engine.GetView(1, joined).Lookup(31)[0].Data, []uint64{3, 31, 10, 62})
+}
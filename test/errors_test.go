@@ -0,0 +1,89 @@
+package test
+
+import (
+	"context"
+	"errors"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEngineRejectsMalformedBatch(t *testing.T) {
+	engine, leftSchema, _ := makeJoinEngine()
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+
+	malformed := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{1}}}
+	_, err := engine.Process("leftTable", &malformed)
+	assert.True(t, errors.Is(err, dataflow.ErrMalformedRecord))
+	var processErr *dataflow.ProcessError
+	assert.True(t, errors.As(err, &processErr))
+	assert.Equal(t, processErr.InputName, "leftTable")
+	assert.Equal(t, processErr.Type, dataflow.INPUT)
+
+	_, err = engine.Process("missingTable", &malformed)
+	assert.True(t, errors.Is(err, dataflow.ErrUnknownInput))
+
+	// The engine keeps processing well-formed batches
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+}
+
+func TestEngineReportsFailedBatch(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	// The filter is missing a value for its condition
+	filterOperator := dataflow.NewFilterOperator([]uint64{1}, []dataflow.CompOp{dataflow.LessThan}, []uint64{})
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddNode(filterOperator, inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, filterOperator, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.StartEngine()
+
+	records := makeInputRecords(schema)
+	ticket, err := engine.Process("table1", &records)
+	assert.Nil(t, err)
+	err = ticket.Wait()
+	assert.True(t, errors.Is(err, dataflow.ErrInvalidFilter))
+	var processErr *dataflow.ProcessError
+	assert.True(t, errors.As(err, &processErr))
+	assert.Equal(t, processErr.NodeIndex, filterOperator.GetCore().GetIndex())
+	assert.Equal(t, processErr.Type, dataflow.FILTER)
+	assert.Equal(t, processErr.InputName, "table1")
+	// Every partition that received records reports its failure
+	assert.Equal(t, len(ticket.Errors()), 2)
+
+	// The partitions survive the failure
+	assert.NotNil(t, engine.ProcessSync("table1", &records))
+	report, err := engine.Stop(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, report.UnfinishedTickets, 0)
+}
+
+func TestGraphRecoversOperatorPanic(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	projectOperator := dataflow.NewProjectOperator([]uint64{0, 2})
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddNode(projectOperator, inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, projectOperator, true)
+
+	records := makeInputRecords(schema)
+	err := graph.Process(-1, -1, "table1", &records)
+	assert.True(t, errors.Is(err, dataflow.ErrOperatorPanic))
+	var processErr *dataflow.ProcessError
+	assert.True(t, errors.As(err, &processErr))
+	assert.Equal(t, processErr.Type, dataflow.PROJECT)
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 0)
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	filter := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.LessThan}, []uint64{3})
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNode(filter, leftInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{filter, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+
+	// Nothing is decided before the engine starts
+	plan := engine.Explain()
+	assert.Len(t, plan.Nodes, 5)
+	assert.False(t, plan.Nodes[0].Decided)
+	assert.Empty(t, plan.InputPartitioning)
+
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	plan = engine.Explain()
+	assert.Equal(t, plan.Partitions, uint64(2))
+	assert.Equal(t, plan.InputPartitioning, map[string]uint64{"leftTable": 1, "rightTable": 0})
+	assert.Len(t, plan.Nodes, 6)
+	// The filter preserves the partitioning that the join requires
+	filterNode := plan.Nodes[2]
+	assert.Equal(t, filterNode.Type, dataflow.FILTER)
+	assert.True(t, filterNode.Keyed)
+	assert.Equal(t, filterNode.PartitionColumn, uint64(1))
+	// The view requires an exchange, which comes before it
+	exchangeNode := plan.Nodes[4]
+	assert.Equal(t, exchangeNode.Type, dataflow.EXCHANGE)
+	assert.Equal(t, exchangeNode.Parents, []int{equijoin.GetCore().GetIndex()})
+	assert.Equal(t, exchangeNode.PartitionColumn, uint64(0))
+	assert.Equal(t, exchangeNode.Reason, "MatView 4 requires its input partitioned by column 0, but EquiJoin 3 emits records partitioned by column 1")
+	assert.Equal(t, plan.Nodes[5].Parents, []int{exchangeNode.Index})
+
+	text := plan.String()
+	assert.True(t, strings.Contains(text, "  leftTable: partitioned by column 1\n"))
+	assert.True(t, strings.Contains(text, "  [3] EquiJoin left column 1 = right column 0 <- 2, 1: partitioned by column 1\n"))
+	assert.True(t, strings.Contains(text, "(MatView 4 requires its input partitioned by column 0"))
+
+	// Exchanges inserted by migrations are part of the plan
+	byRight := dataflow.NewMatViewOperator(3)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byRight, equijoin)
+	assert.Nil(t, migration.Commit())
+	plan = engine.Explain()
+	var exchanges int
+	for _, node := range plan.Nodes {
+		if node.Type == dataflow.EXCHANGE && node.PartitionColumn == 3 {
+			exchanges++
+			assert.Equal(t, node.Parents, []int{equijoin.GetCore().GetIndex()})
+		}
+	}
+	assert.Equal(t, exchanges, 1)
+}
@@ -0,0 +1,220 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// DESCRIPTION: Partitions exchange batches with each other concurrently
+// (two joins across four partitions), while callers are throttled by a flow
+// capacity that is smaller than the records they send.
+func TestExchangesUnderBackpressure(t *testing.T) {
+	schema1, schema2 := makeSchemasForJoin()
+	schema3 := makeThirdInputSchema()
+	input1 := dataflow.NewInputOperator("table1", schema1)
+	input2 := dataflow.NewInputOperator("table2", schema2)
+	input3 := dataflow.NewInputOperator("table3", schema3)
+	join1 := dataflow.NewEquiJoinOperator(1, 0)
+	join2 := dataflow.NewEquiJoinOperator(3, 1)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(input3, true)
+	graph.AddInputOperator(input1, true)
+	graph.AddInputOperator(input2, true)
+	graph.AddNodeMultipleParents(join1, []dataflow.Operator{input1, input2}, true)
+	graph.AddNodeMultipleParents(join2, []dataflow.Operator{join1, input3}, true)
+	graph.AddOutputOperator(matview, join2, true)
+
+	engine := dataflow.NewDataflowEngine(4, graph)
+	assert.Nil(t, engine.SetFlowCapacity(8))
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+
+	const rounds = 8
+	finished := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		send := func(inputName string, makeRecords func() []*dataflow.Record) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				records := makeRecords()
+				_, err := engine.Process(inputName, &records)
+				assert.Nil(t, err)
+			}
+		}
+		wg.Add(3)
+		go send("table1", func() []*dataflow.Record { return makeLeftRecords(schema1) })
+		go send("table2", func() []*dataflow.Record { return makeRightRecords(schema2) })
+		go send("table3", func() []*dataflow.Record { return makeThirdInputRecords(schema3) })
+		wg.Wait()
+		assert.Nil(t, engine.Flush())
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Engine did not drain")
+	}
+
+	view := engine.GetView(2, matview)
+	assert.Equal(t, len(view.Lookup(2)), rounds*rounds*rounds)
+	stats := engine.GetFlowStats()
+	assert.Equal(t, stats.Capacity, int64(8))
+	assert.Equal(t, stats.InFlight, int64(0))
+	assert.Greater(t, stats.Throttled, int64(0))
+}
+
+func TestProcessContextExpires(t *testing.T) {
+	engine, leftSchema, _ := makeJoinEngine()
+	assert.Nil(t, engine.SetFlowCapacity(1))
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+
+	// The engine remains at capacity until the first batch completes
+	leftRecords := makeLeftRecords(leftSchema)
+	ticket, err := engine.Process("leftTable", &leftRecords)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	moreRecords := makeLeftRecords(leftSchema)
+	if moreTicket, err := engine.ProcessContext(ctx, "leftTable", &moreRecords); err != nil {
+		assert.Equal(t, err, context.Canceled)
+	} else {
+		// The first batch completed in the meantime
+		assert.Nil(t, moreTicket.Wait())
+	}
+	assert.Nil(t, ticket.Wait())
+	_, err = engine.ProcessContext(ctx, "leftTable", &moreRecords)
+	assert.Nil(t, err)
+}
+
+func TestInvalidFlowSettings(t *testing.T) {
+	engine, _, _ := makeJoinEngine()
+	assert.ErrorIs(t, engine.SetFlowCapacity(0), dataflow.ErrInvalidArgument)
+	assert.ErrorIs(t, engine.SetExchangeCoalescing(64, 0), dataflow.ErrInvalidArgument)
+	// Batches sent as they are need no delay
+	assert.Nil(t, engine.SetExchangeCoalescing(1, 0))
+	assert.Equal(t, engine.GetFlowStats().Capacity, int64(dataflow.DefaultFlowCapacity))
+}
+
+func makeCoalescingEngine(matview *dataflow.MatViewOperator) *dataflow.DataflowEngine {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetExchangeCoalescing(64, 5*time.Millisecond)
+	engine.StartEngine()
+	return engine
+}
+
+// DESCRIPTION: Single-row writes are joined on one partition and sent to the
+// view's partitions by an exchange, which merges them into few messages.
+func TestExchangeCoalescing(t *testing.T) {
+	matview := dataflow.NewMatViewOperator(0)
+	engine := makeCoalescingEngine(matview)
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	right := []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 1}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+
+	var tickets []*dataflow.Ticket
+	for i := uint64(0); i < 256; i++ {
+		records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{i, 10, i}}}
+		ticket, err := engine.Process("leftTable", &records)
+		assert.Nil(t, err)
+		tickets = append(tickets, ticket)
+	}
+	for _, ticket := range tickets {
+		assert.Nil(t, ticket.Wait())
+	}
+	for i := uint64(0); i < 256; i++ {
+		assert.Equal(t, engine.GetOutput(i % 2).Lookup(i)[0].Data, []uint64{i, 10, i, 1})
+	}
+	stats := engine.GetFlowStats()
+	assert.Greater(t, stats.CoalescedBatches, int64(0))
+	assert.Equal(t, stats.ExchangeMessages+stats.CoalescedBatches, int64(128))
+	assert.Equal(t, stats.InFlight, int64(0))
+
+	// A lone batch is sent once the delay passes
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{301, 10, 0}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Len(t, engine.GetOutput(1).Lookup(301), 1)
+}
+
+// DESCRIPTION: Upqueries observe the batches that were coalesced before them
+func TestCoalescingFlushesBeforeUpquery(t *testing.T) {
+	matview := dataflow.NewPartialMatViewOperator(0)
+	engine := makeCoalescingEngine(matview)
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Len(t, engine.GetOutput(1).Lookup(1), 1)
+
+	// The update is either part of the fill or applied after it, never both
+	for i := uint64(0); i < 20; i++ {
+		records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{3, 20, i}}}
+		_, err := engine.Process("leftTable", &records)
+		assert.Nil(t, err)
+	}
+	assert.LessOrEqual(t, len(engine.GetOutput(1).Lookup(3)), 21)
+	assert.Nil(t, engine.Flush())
+	assert.Len(t, engine.GetOutput(1).Lookup(3), 21)
+}
+
+// DESCRIPTION: A hot join key makes every left record emit a record per right
+// record, most of which are sent to the view's other partition. The records
+// sent hold credits of the batch that caused them, hence the engine goes over
+// capacity, which holds back the batches sent after it.
+func TestHotJoinKeyHoldsCredits(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(3)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.SetFlowCapacity(8))
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	const fanOut = 64
+	var right []*dataflow.Record
+	for i := uint64(0); i < fanOut; i++ {
+		right = append(right, &dataflow.Record{Schema: rightSchema, Data: []uint64{10, i}})
+	}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+
+	const batches = 16
+	for i := uint64(0); i < batches; i++ {
+		records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{i, 10, i}}}
+		_, err := engine.Process("leftTable", &records)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, engine.Flush())
+	for i := uint64(0); i < fanOut; i++ {
+		assert.Len(t, engine.GetView(i%2, matview).Lookup(i), batches)
+	}
+	// Each left record sent the records of the odd right records to the
+	// other partition
+	stats := engine.GetFlowStats()
+	assert.GreaterOrEqual(t, stats.MaxInFlight, int64(1+fanOut/2))
+	assert.Equal(t, stats.InFlight, int64(0))
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeJoinEngine() (*dataflow.DataflowEngine, *dataflow.Schema, *dataflow.Schema) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	return dataflow.NewDataflowEngine(2, graph), leftSchema, rightSchema
+}
+
+func TestEngineStop(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	engine, leftSchema, rightSchema := makeJoinEngine()
+	engine.StartEngine()
+
+	leftRecords := makeLeftRecords(leftSchema)
+	rightRecords := makeRightRecords(rightSchema)
+	engine.Process("leftTable", &leftRecords)
+	engine.Process("rightTable", &rightRecords)
+	report, err := engine.Stop(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, *report, dataflow.ShutdownReport{})
+	assert.Equal(t, runtime.NumGoroutine(), goroutines)
+
+	// In-flight batches were drained before stopping, and views stay readable
+	assert.Equal(t, engine.GetOutput(1).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+
+	_, err = engine.Stop(context.Background())
+	assert.Equal(t, err, dataflow.ErrEngineStopped)
+	_, err = engine.Process("leftTable", &leftRecords)
+	assert.Equal(t, err, dataflow.ErrEngineStopped)
+}
+
+func TestEngineStopExpiredContext(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	engine, leftSchema, rightSchema := makeJoinEngine()
+	engine.StartEngine()
+
+	var tickets []*dataflow.Ticket
+	for i := 0; i < 20; i++ {
+		leftRecords := makeLeftRecords(leftSchema)
+		rightRecords := makeRightRecords(rightSchema)
+		leftTicket, _ := engine.Process("leftTable", &leftRecords)
+		rightTicket, _ := engine.Process("rightTable", &rightRecords)
+		tickets = append(tickets, leftTicket, rightTicket)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	report, _ := engine.Stop(ctx)
+	assert.Equal(t, runtime.NumGoroutine(), goroutines)
+
+	// Every ticket is done, whether or not its batches were processed
+	abandoned := 0
+	for _, ticket := range tickets {
+		err := ticket.Wait()
+		if ticket.Abandoned() {
+			assert.Equal(t, err, dataflow.ErrEngineStopped)
+			abandoned++
+		}
+	}
+	assert.LessOrEqual(t, abandoned, report.UnfinishedTickets)
+	if report.DroppedBatches > 0 {
+		assert.Greater(t, abandoned, 0)
+	}
+}
@@ -28,4 +28,8 @@ func TestMatviewBatch(t *testing.T) {
 
 	assert.Equal(t, matviewOperator.Lookup(1)[0], records[0])
 	assert.Equal(t, matviewOperator.Lookup(2)[0], records[1])
+
+	// Only partial views evict keys on demand
+	assert.ErrorIs(t, matviewOperator.Evict(1), dataflow.ErrUnsupportedOperator)
+	assert.Equal(t, matviewOperator.Lookup(1)[0], records[0])
 }
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Each key with a single record of 2 columns accounts for 112 bytes
+const twoKeyLimit = 250
+
+func TestMatviewLRUReportMiss(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetMemoryLimit(twoKeyLimit, dataflow.LRU, dataflow.ReportMiss))
+	records := makeInputRecords(schema)
+	first := records[:2]
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &first, &output)
+	// Read key 1 so that key 2 becomes the least recently used
+	matviewOperator.Lookup(1)
+	rest := records[2:3]
+	matviewOperator.Process(-1, &rest, &output)
+
+	_, err := matviewOperator.TryLookup(2)
+	assert.Equal(t, err, dataflow.ErrKeyEvicted)
+	assert.Equal(t, matviewOperator.Lookup(1)[0], records[0])
+	assert.Equal(t, matviewOperator.Lookup(3)[0], records[2])
+	usage, _ := matviewOperator.GetCore().GetMemoryUsage()
+	assert.Equal(t, usage.Keys, int64(2))
+	assert.Equal(t, usage.Evictions, int64(1))
+	assert.Equal(t, usage.Misses, int64(1))
+	assert.LessOrEqual(t, usage.Bytes, int64(twoKeyLimit))
+
+	// Writing the key again materializes it with the records written since
+	update := []*dataflow.Record{{Schema: schema, Data: []uint64{2, 21}}}
+	matviewOperator.Process(-1, &update, &output)
+	updated, err := matviewOperator.TryLookup(2)
+	assert.Nil(t, err)
+	assert.Equal(t, updated, update)
+	usage, _ = matviewOperator.GetCore().GetMemoryUsage()
+	assert.Equal(t, usage.Misses, int64(1))
+}
+
+func TestMatviewLFUSpill(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetMemoryLimit(twoKeyLimit, dataflow.LFU, dataflow.Spill))
+	records := makeInputRecords(schema)
+	first := records[:2]
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &first, &output)
+	// Key 2 is read more often, hence key 1 gets evicted
+	matviewOperator.Lookup(2)
+	matviewOperator.Lookup(2)
+	rest := records[2:3]
+	matviewOperator.Process(-1, &rest, &output)
+
+	usage, _ := matviewOperator.GetCore().GetMemoryUsage()
+	assert.Equal(t, usage.Evictions, int64(1))
+	// Spilled keys are still readable, and loaded back when updated
+	assert.Equal(t, matviewOperator.Lookup(1)[0].Data, records[0].Data)
+	update := []*dataflow.Record{{Schema: schema, Data: []uint64{1, 11}}}
+	matviewOperator.Process(-1, &update, &output)
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 2)
+	assert.Equal(t, matviewOperator.Lookup(2)[0], records[1])
+}
+
+func TestEquiJoinSpill(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	// Small enough to keep a single key resident
+	assert.Nil(t, equijoin.SetMemoryLimit(150, dataflow.LRU, dataflow.Spill))
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+
+	leftRecords := makeLeftRecords(leftSchema)
+	graph.Process(-1, -1, "leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	graph.Process(-1, -1, "rightTable", &rightRecords)
+
+	// Results are the same as those of an unbounded join
+	assert.Equal(t, matview.Lookup(1)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, matview.Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	assert.Equal(t, matview.Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+	usage, _ := equijoin.GetCore().GetMemoryUsage()
+	assert.Greater(t, usage.Evictions, int64(0))
+	assert.LessOrEqual(t, usage.Bytes, int64(150))
+}
+
+// DESCRIPTION: Upqueries of partial views can't be answered by a join that
+// dropped the records of the keys they read
+func TestUpqueryThroughEvictedJoinKey(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	// Small enough to keep a single key resident
+	assert.Nil(t, equijoin.SetMemoryLimit(150, dataflow.LRU, dataflow.ReportMiss))
+	byJoinKey := dataflow.NewPartialMatViewOperator(1)
+	byLeft := dataflow.NewPartialMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(byJoinKey, equijoin, true)
+	graph.AddOutputOperator(byLeft, equijoin, true)
+
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, graph.Process(-1, -1, "leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, graph.Process(-1, -1, "rightTable", &rightRecords))
+
+	_, err := byJoinKey.TryLookup(10)
+	assert.ErrorIs(t, err, dataflow.ErrKeyEvicted)
+	_, err = byLeft.TryLookup(1)
+	assert.ErrorIs(t, err, dataflow.ErrKeyEvicted)
+	usage, _ := equijoin.GetCore().GetMemoryUsage()
+	assert.GreaterOrEqual(t, usage.Misses, int64(2))
+}
+
+func TestEngineMemoryBudget(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewPartialMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	// Enough for a single key of either view; the inputs' state is not counted
+	engine.SetMemoryBudget(150)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	records := makeInputRecords(schema)
+	assert.Nil(t, engine.ProcessSync("table1", &records))
+	assert.Equal(t, engine.GetOutput(0).Lookup(2)[0], records[1])
+	assert.Equal(t, engine.GetOutput(0).Lookup(4)[0], records[3])
+	assert.Equal(t, engine.GetOutput(1).Lookup(1)[0], records[0])
+
+	report := engine.GetMemoryReport()
+	assert.Equal(t, report.Budget, int64(150))
+	assert.Equal(t, len(report.Operators), 4)
+	assert.LessOrEqual(t, report.TotalBytes, int64(150))
+	assert.Equal(t, report.BaseBytes, int64(4*64))
+	// Keys 2 and 4 are in the same partition, hence one of them was evicted
+	assert.Equal(t, report.Operators[1].Evictions, int64(1))
+}
+
+func TestInputsLargerThanBudget(t *testing.T) {
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}}
+	input := dataflow.NewInputOperator("table1", schema)
+	filter := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.LessThan}, []uint64{5})
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(input, true)
+	graph.AddNode(filter, input, true)
+	graph.AddOutputOperator(matview, filter, true)
+	engine := dataflow.NewDataflowEngine(1, graph)
+	engine.SetMemoryBudget(4096)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	var records []*dataflow.Record
+	for i := uint64(0); i < 200; i++ {
+		records = append(records, &dataflow.Record{Schema: schema, Data: []uint64{i, i * 10}})
+	}
+	assert.Nil(t, engine.ProcessSync("table1", &records))
+
+	// The inputs alone exceed the budget, which only bounds the view's state
+	report := engine.GetMemoryReport()
+	assert.Equal(t, report.BaseBytes, int64(200*64))
+	assert.Equal(t, report.TotalBytes, int64(5*112))
+	for key := uint64(0); key < 5; key++ {
+		records, err := engine.GetView(0, matview).TryLookup(key)
+		assert.Nil(t, err)
+		assert.Len(t, records, 1)
+	}
+	usage, _ := engine.GetView(0, matview).GetCore().GetMemoryUsage()
+	assert.Equal(t, usage.Evictions, int64(0))
+}
+
+func TestUnsupportedMemoryLimits(t *testing.T) {
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.ErrorIs(t, matviewOperator.SetMemoryLimit(twoKeyLimit, dataflow.LRU, dataflow.Recompute), dataflow.ErrUnsupportedOperator)
+	assert.ErrorIs(t, matviewOperator.SetMemoryLimit(twoKeyLimit, dataflow.EvictionPolicy(7), dataflow.Spill), dataflow.ErrInvalidArgument)
+	partial := dataflow.NewPartialMatViewOperator(0)
+	assert.ErrorIs(t, partial.SetMemoryLimit(twoKeyLimit, dataflow.LRU, dataflow.ReportMiss), dataflow.ErrUnsupportedOperator)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	assert.ErrorIs(t, equijoin.SetMemoryLimit(150, dataflow.LFU, dataflow.Recompute), dataflow.ErrUnsupportedOperator)
+
+	// The view keeps its records without a limit
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}}
+	records := makeInputRecords(schema)
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &records, &output)
+	usage, _ := matviewOperator.GetCore().GetMemoryUsage()
+	assert.Equal(t, usage.Evictions, int64(0))
+}
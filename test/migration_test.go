@@ -0,0 +1,139 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeMigrationEngine() (*dataflow.DataflowEngine, []dataflow.Operator, *dataflow.MatViewOperator) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.StartEngine()
+
+	leftRecords := makeLeftRecords(leftSchema)
+	rightRecords := makeRightRecords(rightSchema)
+	engine.Process("leftTable", &leftRecords)
+	engine.Process("rightTable", &rightRecords)
+	return engine, []dataflow.Operator{leftInput, rightInput, equijoin}, matview
+}
+
+func TestMigrationAddsView(t *testing.T) {
+	engine, nodes, _ := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	// The join is partitioned by its 1st column, hence the view requires an
+	// exchange, and is backfilled from the join's tables
+	byRight := dataflow.NewMatViewOperator(3)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byRight, nodes[2])
+	assert.Nil(t, migration.Commit())
+	assert.Equal(t, engine.GetView(0, byRight).Lookup(62)[0].Data, []uint64{3, 31, 10, 62})
+	assert.Equal(t, engine.GetView(0, byRight).Lookup(60)[0].Data, []uint64{2, 20, 10, 60})
+
+	// Later batches reach both the old view and the new one
+	leftSchema, _ := makeSchemasForJoin()
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{4, 40, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Equal(t, engine.GetView(0, byRight).Lookup(80)[0].Data, []uint64{4, 40, 7, 80})
+	assert.Equal(t, engine.GetOutput(0).Lookup(4)[0].Data, []uint64{4, 40, 7, 80})
+}
+
+func TestMigrationAddsSubgraph(t *testing.T) {
+	engine, nodes, _ := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	filter := dataflow.NewFilterOperator([]uint64{2}, []dataflow.CompOp{dataflow.Equal}, []uint64{10})
+	project := dataflow.NewProjectOperator([]uint64{0, 1})
+	matview := dataflow.NewMatViewOperator(0)
+	migration := engine.NewMigration()
+	migration.AddNode(filter, nodes[0])
+	migration.AddNode(project, filter)
+	migration.AddOutputOperator(matview, project)
+	assert.Nil(t, migration.Commit())
+	assert.Equal(t, engine.GetView(0, matview).Lookup(2)[0].Data, []uint64{2, 20})
+	assert.Equal(t, engine.GetView(1, matview).Lookup(3)[0].Data, []uint64{3, 31})
+	assert.Nil(t, engine.GetView(1, matview).Lookup(1))
+}
+
+func TestMigrationRemovesView(t *testing.T) {
+	engine, nodes, matview := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	byRight := dataflow.NewMatViewOperator(3)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byRight, nodes[2])
+	assert.Nil(t, migration.Commit())
+
+	// The join still feeds the other view, hence only the view and its
+	// exchange are removed
+	assert.Nil(t, engine.RemoveView(byRight))
+	assert.Nil(t, engine.GetView(0, byRight))
+	leftSchema, _ := makeSchemasForJoin()
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{4, 40, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Equal(t, engine.GetView(0, matview).Lookup(4)[0].Data, []uint64{4, 40, 7, 80})
+
+	// Removing the last view removes the join as well
+	assert.Nil(t, engine.RemoveView(matview))
+	assert.Nil(t, engine.GetView(0, matview))
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.ErrorIs(t, engine.RemoveView(matview), dataflow.ErrInvalidMigration)
+}
+
+func TestFailedBackfillRollsBack(t *testing.T) {
+	engine, nodes, matview := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	// The filter's column is out of range, hence backfilling it fails
+	filter := dataflow.NewFilterOperator([]uint64{7}, []dataflow.CompOp{dataflow.Equal}, []uint64{10})
+	byLeft := dataflow.NewMatViewOperator(0)
+	migration := engine.NewMigration()
+	migration.AddNode(filter, nodes[0])
+	migration.AddOutputOperator(byLeft, filter)
+	var processErr *dataflow.ProcessError
+	assert.ErrorAs(t, migration.Commit(), &processErr)
+	assert.Equal(t, processErr.NodeIndex, filter.GetCore().GetIndex())
+	assert.Nil(t, engine.GetView(0, byLeft))
+	assert.Nil(t, engine.GetView(1, byLeft))
+
+	// Later batches don't reach the filter
+	leftSchema, _ := makeSchemasForJoin()
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{4, 40, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Equal(t, engine.GetView(0, matview).Lookup(4)[0].Data, []uint64{4, 40, 7, 80})
+}
+
+func TestInvalidMigration(t *testing.T) {
+	engine, nodes, matview := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(0), matview)
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+
+	migration = engine.NewMigration()
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(0), dataflow.NewProjectOperator([]uint64{0}))
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+
+	leftSchema, _ := makeSchemasForJoin()
+	migration = engine.NewMigration()
+	migration.AddNode(dataflow.NewInputOperator("thirdTable", leftSchema), nodes[0])
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrUnsupportedOperator)
+
+	engine.Stop(context.Background())
+	migration = engine.NewMigration()
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(0), nodes[2])
+	assert.Equal(t, migration.Commit(), dataflow.ErrEngineStopped)
+}
@@ -0,0 +1,318 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func planNodesOfType(plan *dataflow.PhysicalPlan, opType dataflow.OperatorType) []dataflow.PlanNode {
+	var nodes []dataflow.PlanNode
+	for _, node := range plan.Nodes {
+		if node.Type == opType {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func TestFilterPushdownBelowJoin(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	// Tests the right side's second column, and the join column
+	filter := dataflow.NewFilterOperator([]uint64{3, 1}, []dataflow.CompOp{dataflow.GreaterThan, dataflow.LessThan}, []uint64{30, 31})
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddNode(filter, equijoin, true)
+	graph.AddOutputOperator(matview, filter, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	// The filter is split between the join's sides, and the view reads the
+	// join's output (through an exchange)
+	plan := engine.Explain()
+	filters := planNodesOfType(plan, dataflow.FILTER)
+	assert.Len(t, filters, 2)
+	assert.Equal(t, filters[0].Details, "column 1 < 31")
+	assert.Equal(t, filters[1].Details, "column 1 > 30 and column 0 < 31")
+	joins := planNodesOfType(plan, dataflow.EQUIJOIN)
+	assert.Equal(t, joins[0].Parents, []int{filters[0].Index, filters[1].Index})
+
+	leftRecords := makeLeftRecords(leftSchema)
+	engine.Process("leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Equal(t, engine.GetView(0, matview).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	assert.Empty(t, engine.GetView(1, matview).Lookup(1))
+	assert.Empty(t, engine.GetView(1, matview).Lookup(3))
+}
+
+func TestProjectionPruning(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	// Only the first left column and the right side's second column are used
+	first := dataflow.NewProjectOperator([]uint64{0, 3})
+	second := dataflow.NewProjectOperator([]uint64{1, 0})
+	matview := dataflow.NewMatViewOperator(1)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddNode(first, equijoin, true)
+	graph.AddNode(second, first, true)
+	graph.AddOutputOperator(matview, second, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	// The left side's last column is dropped before the join, whose output
+	// columns are renumbered; the projections are merged
+	plan := engine.Explain()
+	projects := planNodesOfType(plan, dataflow.PROJECT)
+	assert.Len(t, projects, 2)
+	assert.Equal(t, projects[0].Details, "columns [0 1]")
+	assert.Equal(t, projects[0].Parents, []int{leftInput.GetCore().GetIndex()})
+	assert.Equal(t, projects[1].Details, "columns [2 0]")
+	// The engine rewrites a copy of the graph it was created with
+	assert.Equal(t, equijoin.GetCore().OutputSchema.ColumnNames, []string{"Col1", "Col2", "Col3", "Col5"})
+
+	leftRecords := makeLeftRecords(leftSchema)
+	engine.Process("leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Equal(t, engine.GetView(0, matview).Lookup(2)[0].Data, []uint64{60, 2})
+	assert.Equal(t, engine.GetView(1, matview).Lookup(3)[0].Data, []uint64{62, 3})
+	assert.Equal(t, engine.GetView(1, matview).Lookup(1)[0].Data, []uint64{20, 1})
+}
+
+func TestMergeAdjacentFilters(t *testing.T) {
+	makeEngine := func() (*dataflow.DataflowEngine, *dataflow.MatViewOperator) {
+		schema := &dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}}
+		input := dataflow.NewInputOperator("input", schema)
+		above := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.GreaterThan}, []uint64{1})
+		below := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.LessThan}, []uint64{4})
+		matview := dataflow.NewMatViewOperator(0)
+		graph := dataflow.NewGraph()
+		graph.AddInputOperator(input, true)
+		graph.AddNode(above, input, true)
+		graph.AddNode(below, above, true)
+		graph.AddOutputOperator(matview, below, true)
+		return dataflow.NewDataflowEngine(1, graph), matview
+	}
+	engine, matview := makeEngine()
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	filters := planNodesOfType(engine.Explain(), dataflow.FILTER)
+	assert.Len(t, filters, 1)
+	assert.Equal(t, filters[0].Details, "column 0 > 1 and column 0 < 4")
+	records := makeInputRecords(&dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}})
+	assert.Nil(t, engine.ProcessSync("input", &records))
+	assert.Empty(t, engine.GetOutput(0).Lookup(1))
+	assert.Len(t, engine.GetView(0, matview).Lookup(2), 1)
+	assert.Len(t, engine.GetView(0, matview).Lookup(3), 1)
+	assert.Empty(t, engine.GetOutput(0).Lookup(4))
+
+	// The graph is planned as it was built unless the optimizer is enabled
+	unoptimized, _ := makeEngine()
+	assert.Nil(t, unoptimized.StartEngine())
+	defer unoptimized.Stop(context.Background())
+	assert.Len(t, planNodesOfType(unoptimized.Explain(), dataflow.FILTER), 2)
+}
+
+func TestShareIdenticalJoins(t *testing.T) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := dataflow.NewInputOperator("orders", ordersSchema)
+	customers := dataflow.NewInputOperator("customers", customersSchema)
+	// Both views join the orders with their customers
+	first := dataflow.NewEquiJoinOperator(1, 0)
+	second := dataflow.NewEquiJoinOperator(1, 0)
+	byOrder := dataflow.NewMatViewOperator(0)
+	project := dataflow.NewProjectOperator([]uint64{3, 2})
+	byRegion := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(orders, true)
+	graph.AddInputOperator(customers, true)
+	graph.AddNodeMultipleParents(first, []dataflow.Operator{orders, customers}, true)
+	graph.AddNodeMultipleParents(second, []dataflow.Operator{orders, customers}, true)
+	graph.AddOutputOperator(byOrder, first, true)
+	graph.AddNode(project, second, true)
+	graph.AddOutputOperator(byRegion, project, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	// One join feeds both views, which read it through an exchange each (by
+	// order id, and by region)
+	plan := engine.Explain()
+	joins := planNodesOfType(plan, dataflow.EQUIJOIN)
+	assert.Len(t, joins, 1)
+	shuffles, _ := countExchanges(plan)
+	assert.Equal(t, shuffles, 2)
+
+	customerRecords := []*dataflow.Record{
+		{Schema: customersSchema, Data: []uint64{0, 7}},
+		{Schema: customersSchema, Data: []uint64{1, 8}},
+		{Schema: customersSchema, Data: []uint64{2, 9}},
+	}
+	assert.Nil(t, engine.ProcessSync("customers", &customerRecords))
+	orderRecords := makeOrders(ordersSchema, 0, 6)
+	assert.Nil(t, engine.ProcessSync("orders", &orderRecords))
+	assert.Equal(t, engine.GetView(1, byOrder).Lookup(5)[0].Data, []uint64{5, 2, 50, 9})
+	assert.Len(t, engine.GetView(1, byRegion).Lookup(7), 2)
+	assert.Len(t, engine.GetView(0, byRegion).Lookup(8), 2)
+
+	// A join added later that is the same as the existing one shares it too,
+	// and its new view is backfilled from the existing join's state
+	third := dataflow.NewEquiJoinOperator(1, 0)
+	byAmount := dataflow.NewMatViewOperator(2)
+	migration := engine.NewMigration()
+	migration.AddNodeMultipleParents(third, []dataflow.Operator{orders, customers})
+	migration.AddOutputOperator(byAmount, third)
+	assert.Nil(t, migration.Commit())
+	assert.Len(t, planNodesOfType(engine.Explain(), dataflow.EQUIJOIN), 1)
+	assert.Equal(t, engine.GetView(0, byAmount).Lookup(40)[0].Data, []uint64{4, 1, 40, 8})
+
+	// Operations on the merged joins apply to the one that replaced them
+	assert.Nil(t, engine.SplitJoinKey(second, 1, dataflow.RightSide))
+	more := makeOrders(ordersSchema, 6, 3)
+	assert.Nil(t, engine.ProcessSync("orders", &more))
+	assert.Equal(t, engine.GetView(0, byAmount).Lookup(70)[0].Data, []uint64{7, 1, 70, 8})
+	assert.Len(t, engine.GetView(0, byRegion).Lookup(8), 3)
+}
+
+func TestJoinsWithDifferentMemoryLimits(t *testing.T) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	orders := dataflow.NewInputOperator("orders", ordersSchema)
+	customers := dataflow.NewInputOperator("customers", customersSchema)
+	first := dataflow.NewEquiJoinOperator(1, 0)
+	second := dataflow.NewEquiJoinOperator(1, 0)
+	assert.Nil(t, second.SetMemoryLimit(150, dataflow.LRU, dataflow.Spill))
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(orders, true)
+	graph.AddInputOperator(customers, true)
+	graph.AddNodeMultipleParents(first, []dataflow.Operator{orders, customers}, true)
+	graph.AddNodeMultipleParents(second, []dataflow.Operator{orders, customers}, true)
+	graph.AddOutputOperator(dataflow.NewMatViewOperator(0), first, true)
+	graph.AddOutputOperator(dataflow.NewMatViewOperator(0), second, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	assert.Len(t, planNodesOfType(engine.Explain(), dataflow.EQUIJOIN), 2)
+
+	// Nor is a join added later shared with one whose limit differs
+	third := dataflow.NewEquiJoinOperator(1, 0)
+	assert.Nil(t, third.SetMemoryLimit(300, dataflow.LFU, dataflow.Spill))
+	migration := engine.NewMigration()
+	migration.AddNodeMultipleParents(third, []dataflow.Operator{orders, customers})
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(2), third)
+	assert.Nil(t, migration.Commit())
+	assert.Len(t, planNodesOfType(engine.Explain(), dataflow.EQUIJOIN), 3)
+}
+
+func TestMigrationOnPrunedJoin(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	// The left side's last column is dropped in front of the join
+	project := dataflow.NewProjectOperator([]uint64{0, 3})
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddNode(project, equijoin, true)
+	graph.AddOutputOperator(matview, project, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetLogicalOptimization(true)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	engine.Process("leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	// A view of the join would lack the dropped column, and so would a
+	// projection of it
+	byThird := dataflow.NewMatViewOperator(2)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byThird, equijoin)
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+	migration = engine.NewMigration()
+	migration.AddNode(dataflow.NewProjectOperator([]uint64{2}), equijoin)
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+
+	// Columns that were kept are referred to as the graph numbers them, also
+	// once a migration that fails has been retried
+	swapped := dataflow.NewProjectOperator([]uint64{3, 0})
+	migration = engine.NewMigration()
+	migration.AddNode(swapped, equijoin)
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(0), equijoin)
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+	byCol1 := dataflow.NewMatViewOperator(1)
+	migration = engine.NewMigration()
+	migration.AddNode(swapped, equijoin)
+	migration.AddOutputOperator(byCol1, swapped)
+	assert.Nil(t, migration.Commit())
+	records, err := engine.LookupView(byCol1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Data, []uint64{60, 2})
+}
+
+// DESCRIPTION: The graph of TestMigrationOnPrunedJoin is planned as it was
+// built unless the optimizer is enabled, hence migrations may use every column
+// of the join
+func TestUnoptimizedGraphKeepsColumns(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	project := dataflow.NewProjectOperator([]uint64{0, 3})
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddNode(project, equijoin, true)
+	graph.AddOutputOperator(matview, project, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	projections := planNodesOfType(engine.Explain(), dataflow.PROJECT)
+	assert.Len(t, projections, 1)
+	assert.Equal(t, projections[0].Parents, []int{equijoin.GetCore().GetIndex()})
+
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	byThird := dataflow.NewMatViewOperator(2)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byThird, equijoin)
+	assert.Nil(t, migration.Commit())
+	records, err := engine.LookupView(byThird, 10)
+	assert.Nil(t, err)
+	var data [][]uint64
+	for _, record := range records {
+		data = append(data, record.Data)
+	}
+	assert.ElementsMatch(t, data, [][]uint64{{2, 20, 10, 60}, {3, 31, 10, 62}})
+	records, err = engine.LookupView(matview, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Data, []uint64{2, 60})
+}
@@ -0,0 +1,82 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartialMatviewUpquery(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	filterOperator := dataflow.NewFilterOperator([]uint64{1}, []dataflow.CompOp{dataflow.LessThan}, []uint64{15})
+	matviewOperator := dataflow.NewPartialMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddNode(filterOperator, inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, filterOperator, true)
+
+	records := makeInputRecords(schema)
+	assert.Nil(t, graph.Process(-1, -1, "table1", &records))
+
+	// Misses are computed from the input's state
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 1)
+	assert.Equal(t, matviewOperator.Lookup(1)[0], records[0])
+	assert.Equal(t, len(matviewOperator.Lookup(2)), 0)
+
+	// Materialized keys receive updates
+	update := []*dataflow.Record{{Schema: schema, Data: []uint64{1, 11}}}
+	assert.Nil(t, graph.Process(-1, -1, "table1", &update))
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 2)
+
+	// Evicted keys don't, but are recomputed when read again
+	assert.Nil(t, matviewOperator.Evict(1))
+	update = []*dataflow.Record{{Schema: schema, Data: []uint64{1, 12}}}
+	assert.Nil(t, graph.Process(-1, -1, "table1", &update))
+	upqueried, _ := matviewOperator.Upquery(1, 12)
+	assert.Equal(t, len(upqueried), 0)
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 3)
+}
+
+func TestPartialMatviewJoinGraph(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewPartialMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	leftRecords := makeLeftRecords(leftSchema)
+	_, err := engine.Process("leftTable", &leftRecords)
+	assert.Nil(t, err)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	// The upqueries are answered by the join's state in every partition
+	assert.Equal(t, len(engine.GetOutput(1).Lookup(1)), 1)
+	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 1)
+	assert.Equal(t, engine.GetOutput(1).Lookup(1)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, engine.GetOutput(0).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+
+	// Only materialized keys are updated
+	moreRecords := []*dataflow.Record{
+		{Schema: leftSchema, Data: []uint64{1, 20, 7}},
+		{Schema: leftSchema, Data: []uint64{3, 20, 9}},
+	}
+	assert.Nil(t, engine.ProcessSync("leftTable", &moreRecords))
+	assert.Equal(t, len(engine.GetOutput(1).Lookup(1)), 2)
+	assert.Equal(t, len(engine.GetOutput(1).Lookup(3)), 2)
+}
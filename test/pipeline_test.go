@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makePipelinedJoinEngine(matview *dataflow.MatViewOperator) (*dataflow.DataflowEngine, *dataflow.EquiJoinOperator) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.SetPipelined(true)
+	engine.StartEngine()
+	return engine, equijoin
+}
+
+func TestPipelinedPreservesKeyOrder(t *testing.T) {
+	matview := dataflow.NewMatViewOperator(0)
+	engine, _ := makePipelinedJoinEngine(matview)
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	right := []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 1}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+
+	// The batches pass through the input, the join and an exchange on their way
+	// to the view, yet reach it in the order in which they were processed
+	var tickets []*dataflow.Ticket
+	for i := uint64(0); i < 50; i++ {
+		records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{7, 10, i}}}
+		ticket, err := engine.Process("leftTable", &records)
+		assert.Nil(t, err)
+		tickets = append(tickets, ticket)
+	}
+	for _, ticket := range tickets {
+		assert.Nil(t, ticket.Wait())
+	}
+	rows := engine.GetOutput(1).Lookup(7)
+	assert.Len(t, rows, 50)
+	for i, row := range rows {
+		assert.Equal(t, row.Data, []uint64{7, 10, uint64(i), 1})
+	}
+	assert.Nil(t, engine.WaitForFrontier(context.Background(), matview, tickets[49].Timestamp()))
+}
+
+func TestPipelinedPartialView(t *testing.T) {
+	matview := dataflow.NewPartialMatViewOperator(0)
+	engine, _ := makePipelinedJoinEngine(matview)
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftRecords := makeLeftRecords(leftSchema)
+	engine.Process("leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	// Upqueries are answered once the stages are idle
+	assert.Equal(t, engine.GetOutput(1).Lookup(1)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Equal(t, engine.GetOutput(0).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	moreRecords := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{1, 20, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &moreRecords))
+	assert.Len(t, engine.GetOutput(1).Lookup(1), 2)
+}
+
+func TestPipelinedMigrationAndRescale(t *testing.T) {
+	matview := dataflow.NewMatViewOperator(0)
+	engine, equijoin := makePipelinedJoinEngine(matview)
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftRecords := makeLeftRecords(leftSchema)
+	engine.Process("leftTable", &leftRecords)
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+
+	// Stages are started for the nodes that a migration adds
+	byRight := dataflow.NewMatViewOperator(3)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byRight, equijoin)
+	assert.Nil(t, migration.Commit())
+	assert.Equal(t, engine.GetView(0, byRight).Lookup(60)[0].Data, []uint64{2, 20, 10, 60})
+
+	assert.Nil(t, engine.Rescale(3))
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{4, 40, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Equal(t, engine.GetView(2, byRight).Lookup(80)[0].Data, []uint64{4, 40, 7, 80})
+	assert.Equal(t, engine.GetView(1, matview).Lookup(4)[0].Data, []uint64{4, 40, 7, 80})
+	assert.Equal(t, engine.GetView(0, matview).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+}
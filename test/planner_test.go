@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphBacksSeveralEngines(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	filter := dataflow.NewFilterOperator([]uint64{0}, []dataflow.CompOp{dataflow.LessThan}, []uint64{3})
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddNode(filter, equijoin, true)
+	graph.AddOutputOperator(matview, filter, true)
+
+	// Each engine plans (and optimizes) a copy of the graph
+	engines := []*dataflow.DataflowEngine{dataflow.NewDataflowEngine(2, graph), dataflow.NewDataflowEngine(3, graph)}
+	for _, engine := range engines {
+		assert.Nil(t, engine.StartEngine())
+		defer engine.Stop(context.Background())
+		leftRecords := makeLeftRecords(leftSchema)
+		assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+		rightRecords := makeRightRecords(rightSchema)
+		assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	}
+	assert.Equal(t, engines[0].GetView(0, matview).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	assert.Equal(t, engines[1].GetView(2, matview).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	assert.Equal(t, engines[1].GetView(1, matview).Lookup(1)[0].Data, []uint64{1, 10, 5, 20})
+	assert.Empty(t, engines[1].GetView(0, matview).Lookup(3))
+
+	// The graph is left as it was built: the filter was not pushed below the
+	// join, and no exchange was inserted
+	plan := dataflow.NewDataflowEngine(2, graph).Explain()
+	assert.Len(t, plan.Nodes, 5)
+	assert.Equal(t, planNodesOfType(plan, dataflow.FILTER)[0].Parents, []int{equijoin.GetCore().GetIndex()})
+	assert.Equal(t, equijoin.GetCore().GetParents(), []dataflow.Operator{leftInput, rightInput})
+
+	// Operators of the graph are passed to migrations (and the like) of every
+	// engine, which use their own copies
+	byValue := dataflow.NewMatViewOperator(2)
+	migration := engines[1].NewMigration()
+	migration.AddOutputOperator(byValue, leftInput)
+	assert.Nil(t, migration.Commit())
+	assert.Len(t, engines[1].GetView(1, byValue).Lookup(10), 2)
+	assert.Nil(t, engines[0].SplitJoinKey(equijoin, 2, dataflow.LeftSide))
+	assert.Len(t, dataflow.NewDataflowEngine(2, graph).Explain().Nodes, 5)
+
+	// The graph may be changed and started again
+	byJoinKey := dataflow.NewMatViewOperator(1)
+	graph.AddOutputOperator(byJoinKey, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	assert.Nil(t, engine.ProcessSync("leftTable", &leftRecords))
+	rightRecords := makeRightRecords(rightSchema)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Equal(t, engine.GetView(1, byJoinKey).Lookup(31)[0].Data, []uint64{3, 31, 10, 62})
+	assert.Equal(t, engine.GetView(0, matview).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+}
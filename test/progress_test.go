@@ -0,0 +1,58 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewFrontier(t *testing.T) {
+	engine, leftSchema, rightSchema := makeJoinEngine()
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+	matview := engine.GetOutput(0)
+
+	leftRecords := makeLeftRecords(leftSchema)
+	rightRecords := makeRightRecords(rightSchema)
+	leftTicket, _ := engine.Process("leftTable", &leftRecords)
+	rightTicket, _ := engine.Process("rightTable", &rightRecords)
+	assert.Equal(t, leftTicket.Timestamp(), uint64(1))
+	assert.Equal(t, rightTicket.Timestamp(), uint64(2))
+
+	// Both inputs are reflected once the view's frontier reaches the latter
+	records, err := engine.GetOutput(1).LookupAt(context.Background(), 3, rightTicket.Timestamp())
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Data, []uint64{3, 31, 10, 62})
+	assert.GreaterOrEqual(t, matview.GetFrontier(), uint64(2))
+
+	assert.Nil(t, engine.Flush())
+	for _, progress := range engine.GetProgress() {
+		assert.Equal(t, progress.Frontier, uint64(2))
+	}
+
+	// Waiting for a timestamp that has not been issued yet gives up with the
+	// context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, matview.WaitFor(ctx, 3), context.Canceled)
+}
+
+func TestFrontierWithoutEngine(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+	records := makeInputRecords(schema)
+	graph.Process(-1, -1, "table1", &records)
+
+	// Batches are processed synchronously, hence there is nothing to wait for
+	assert.Equal(t, matviewOperator.GetFrontier(), uint64(0))
+	assert.Nil(t, matviewOperator.WaitFor(context.Background(), 5))
+}
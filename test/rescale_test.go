@@ -0,0 +1,120 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRescaleMovesState(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	engine, leftSchema, rightSchema := makeJoinEngine()
+	engine.StartEngine()
+	leftRecords := makeLeftRecords(leftSchema)
+	rightRecords := makeRightRecords(rightSchema)
+	engine.Process("leftTable", &leftRecords)
+	engine.Process("rightTable", &rightRecords)
+	view := engine.GetOutput(0)
+
+	for _, partitionCount := range []uint64{4, 3, 1} {
+		assert.Nil(t, engine.Rescale(partitionCount))
+		// Keys are held by the partition that owns them, exactly once
+		records := engine.GetView(3%partitionCount, view).Lookup(3)
+		assert.Len(t, records, 1)
+		assert.Equal(t, records[0].Data, []uint64{3, 31, 10, 62})
+		summary := engine.SummarizeView(view)
+		assert.Equal(t, summary.Keys, int64(3))
+		assert.Equal(t, summary.Records, int64(3))
+	}
+
+	// The join's state moved along, hence later batches join with it
+	assert.Nil(t, engine.Rescale(2))
+	records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{4, 40, 7}}}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	assert.Equal(t, engine.GetView(0, view).Lookup(4)[0].Data, []uint64{4, 40, 7, 80})
+	assert.Equal(t, engine.SummarizeView(view).Records, int64(4))
+
+	// The goroutines of the replaced partitions have exited
+	_, err := engine.Stop(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, runtime.NumGoroutine(), goroutines)
+}
+
+func TestRescaleWhileProcessing(t *testing.T) {
+	engine, leftSchema, rightSchema := makeJoinEngine()
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+	rightRecords := makeRightRecords(rightSchema)
+	engine.Process("rightTable", &rightRecords)
+	view := engine.GetOutput(0)
+
+	// Batches that are sent while rescaling are neither lost nor duplicated
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < 100; i++ {
+			records := []*dataflow.Record{{Schema: leftSchema, Data: []uint64{i, 10 * (i%6 + 1), i}}}
+			engine.Process("leftTable", &records)
+		}
+	}()
+	for _, partitionCount := range []uint64{3, 5, 2} {
+		assert.Nil(t, engine.Rescale(partitionCount))
+	}
+	wg.Wait()
+	assert.Nil(t, engine.Flush())
+	// Every left record matches a single right record, except those whose key
+	// is 50
+	summary := engine.SummarizeView(view)
+	assert.Equal(t, summary.Records, int64(100-16))
+	for i := uint64(0); i < 100; i++ {
+		if 10*(i%6+1) == 50 {
+			continue
+		}
+		assert.Len(t, engine.GetView(i%2, view).Lookup(i), 1)
+	}
+}
+
+func TestRescalePartialView(t *testing.T) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	view := dataflow.NewPartialMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(view, equijoin, true)
+	engine := dataflow.NewDataflowEngine(2, graph)
+	engine.StartEngine()
+	defer engine.Stop(context.Background())
+	leftRecords := makeLeftRecords(leftSchema)
+	rightRecords := makeRightRecords(rightSchema)
+	engine.Process("leftTable", &leftRecords)
+	assert.Nil(t, engine.ProcessSync("rightTable", &rightRecords))
+	assert.Equal(t, engine.GetView(3%2, view).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+
+	detached := engine.GetView(1, view)
+	assert.Nil(t, engine.Rescale(3))
+	// Keys are filled by the new partitions
+	assert.Equal(t, engine.GetView(3%3, view).Lookup(3)[0].Data, []uint64{3, 31, 10, 62})
+	assert.Equal(t, engine.GetView(2%3, view).Lookup(2)[0].Data, []uint64{2, 20, 10, 60})
+	_, err := detached.TryLookup(5)
+	assert.ErrorIs(t, err, dataflow.ErrViewRemoved)
+}
+
+func TestInvalidRescale(t *testing.T) {
+	engine, _, _ := makeJoinEngine()
+	assert.ErrorIs(t, engine.Rescale(0), dataflow.ErrInvalidPartitionCount)
+	// An engine that has not been started is simply created with more partitions
+	assert.Nil(t, engine.Rescale(3))
+	engine.StartEngine()
+	assert.NotNil(t, engine.GetOutput(2))
+	engine.Stop(context.Background())
+	assert.Equal(t, engine.Rescale(2), dataflow.ErrEngineStopped)
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatviewScan(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	records := makeInputRecords(schema)
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &records, &output)
+
+	page, _ := matviewOperator.Scan(dataflow.ScanCursor{}, 3)
+	assert.False(t, page.Done)
+	assert.Equal(t, len(page.Entries), 3)
+	assert.Equal(t, page.Entries[0].Key, uint64(1))
+	assert.Equal(t, page.Entries[2].Records[0], records[2])
+	page, _ = matviewOperator.Scan(page.Next, 3)
+	assert.True(t, page.Done)
+	assert.Equal(t, len(page.Entries), 1)
+	assert.Equal(t, page.Entries[0].Key, uint64(4))
+	_, err := matviewOperator.Scan(dataflow.ScanCursor{}, 0)
+	assert.ErrorIs(t, err, dataflow.ErrInvalidArgument)
+
+	summary := matviewOperator.Summary()
+	assert.Equal(t, summary.Keys, int64(4))
+	assert.Equal(t, summary.Records, int64(4))
+}
+
+func TestEngineScan(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+
+	engine := dataflow.NewDataflowEngine(3, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	var records []*dataflow.Record
+	for i := 10; i > 0; i-- {
+		records = append(records, &dataflow.Record{Schema: schema, Data: []uint64{uint64(i), 0}})
+		records = append(records, &dataflow.Record{Schema: schema, Data: []uint64{uint64(i), 1}})
+	}
+	engine.ProcessSync("table1", &records)
+
+	// Keys are returned in order across partitions
+	var keys []uint64
+	cursor := dataflow.ScanCursor{}
+	for pages := 0; ; pages++ {
+		page, err := engine.ScanView(matviewOperator, cursor, 4)
+		assert.Nil(t, err)
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+			assert.Equal(t, len(entry.Records), 2)
+		}
+		cursor = page.Next
+		if page.Done {
+			assert.Equal(t, pages, 2)
+			break
+		}
+	}
+	assert.Equal(t, keys, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+
+	// Only a partition's keys are returned by its view
+	page, _ := engine.GetView(1, matviewOperator).Scan(dataflow.ScanCursor{}, 10)
+	assert.True(t, page.Done)
+	assert.Equal(t, len(page.Entries), 4)
+	assert.Equal(t, page.Entries[3].Key, uint64(10))
+
+	summary := engine.SummarizeView(matviewOperator)
+	assert.Equal(t, summary.Keys, int64(10))
+	assert.Equal(t, summary.Records, int64(20))
+	assert.Greater(t, summary.Bytes, int64(0))
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func planNode(plan *dataflow.PhysicalPlan, index int) dataflow.PlanNode {
+	for _, node := range plan.Nodes {
+		if node.Index == index {
+			return node
+		}
+	}
+	return dataflow.PlanNode{}
+}
+
+// Returns the keys that @view holds
+func scannedKeys(t *testing.T, view *dataflow.MatViewOperator) []uint64 {
+	page, err := view.Scan(dataflow.ScanCursor{}, 100)
+	assert.Nil(t, err)
+	var keys []uint64
+	for _, entry := range page.Entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func processCustomersAndOrders(t *testing.T, engine *dataflow.DataflowEngine, first uint64, count uint64) {
+	ordersSchema, customersSchema := makeOrdersSchemas()
+	if first == 0 {
+		customers := []*dataflow.Record{
+			{Schema: customersSchema, Data: []uint64{0, 7}},
+			{Schema: customersSchema, Data: []uint64{1, 8}},
+			{Schema: customersSchema, Data: []uint64{2, 9}},
+		}
+		assert.Nil(t, engine.ProcessSync("customers", &customers))
+	}
+	orders := makeOrders(ordersSchema, first, count)
+	assert.Nil(t, engine.ProcessSync("orders", &orders))
+}
+
+func TestScatterWriteHeavyView(t *testing.T) {
+	// The view by order id (node 4) receives far more records than it answers
+	// lookups
+	stats := &dataflow.Statistics{
+		Operators: map[int]*dataflow.OperatorStatistics{
+			4: {NodeIndex: 4, Type: dataflow.MATVIEW, Reads: 10, Writes: 1000},
+		},
+	}
+	engine, equijoin, byOrder := makeOrdersEngine(stats)
+	defer engine.Stop(context.Background())
+
+	// The view keeps the join's records partitioned by customer, rather than
+	// reading them through an exchange
+	view := planNode(engine.Explain(), byOrder.GetCore().GetIndex())
+	assert.Equal(t, view.Parents, []int{equijoin.GetCore().GetIndex()})
+	assert.True(t, view.Keyed)
+	assert.Equal(t, view.PartitionColumn, uint64(1))
+	assert.Contains(t, view.Details, "gathered from every partition")
+
+	processCustomersAndOrders(t, engine, 0, 6)
+	records, err := engine.LookupView(byOrder, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Data, []uint64{4, 1, 40, 8})
+	// The order is held by its customer's partition only, while reading any
+	// partition gathers it
+	assert.NotContains(t, scannedKeys(t, engine.GetView(0, byOrder)), uint64(4))
+	assert.Contains(t, scannedKeys(t, engine.GetView(1, byOrder)), uint64(4))
+	assert.Equal(t, engine.GetView(0, byOrder).Lookup(4), records)
+
+	// Rescaling places the records by customer as well
+	assert.Nil(t, engine.Rescale(3))
+	processCustomersAndOrders(t, engine, 6, 3)
+	assert.Contains(t, scannedKeys(t, engine.GetView(1, byOrder)), uint64(4))
+	assert.Contains(t, scannedKeys(t, engine.GetView(2, byOrder)), uint64(8))
+	assert.Len(t, engine.GetView(0, byOrder).Lookup(8), 1)
+	for id := uint64(0); id < 9; id++ {
+		records, err := engine.LookupView(byOrder, id)
+		assert.Nil(t, err)
+		assert.Len(t, records, 1)
+	}
+}
+
+func TestViewReadsFromCollectedStatistics(t *testing.T) {
+	engine, _, byOrder := makeOrdersEngine(nil)
+	defer engine.Stop(context.Background())
+	// Without statistics, the view is read through an exchange
+	view := planNode(engine.Explain(), byOrder.GetCore().GetIndex())
+	assert.Equal(t, view.PartitionColumn, uint64(0))
+	assert.NotContains(t, view.Details, "gathered")
+
+	processCustomersAndOrders(t, engine, 0, 6)
+	records, err := engine.LookupView(byOrder, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Data, []uint64{5, 2, 50, 9})
+	stats, err := engine.CollectStatistics()
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Operators[4].Reads, int64(1))
+	assert.Equal(t, stats.Operators[4].Writes, int64(6))
+
+	// An engine planned with the statistics scatters the view, which is
+	// written to more than twice (the number of partitions) as often as read
+	scattered, _, _ := makeOrdersEngine(stats)
+	defer scattered.Stop(context.Background())
+	view = planNode(scattered.Explain(), byOrder.GetCore().GetIndex())
+	assert.Equal(t, view.PartitionColumn, uint64(1))
+	assert.Contains(t, view.Details, "sends about 1 lookups across partitions rather than 3 records")
+
+	// Read-heavy views keep the exchange
+	stats.Operators[4].Reads = 3
+	readHeavy, _, _ := makeOrdersEngine(stats)
+	defer readHeavy.Stop(context.Background())
+	view = planNode(readHeavy.Explain(), byOrder.GetCore().GetIndex())
+	assert.Equal(t, view.PartitionColumn, uint64(0))
+}
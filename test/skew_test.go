@@ -0,0 +1,159 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSkewedJoinEngine() (*dataflow.DataflowEngine, *dataflow.EquiJoinOperator, *dataflow.MatViewOperator) {
+	leftSchema, rightSchema := makeSchemasForJoin()
+	leftInput := dataflow.NewInputOperator("leftTable", leftSchema)
+	rightInput := dataflow.NewInputOperator("rightTable", rightSchema)
+	equijoin := dataflow.NewEquiJoinOperator(1, 0)
+	matview := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(leftInput, true)
+	graph.AddInputOperator(rightInput, true)
+	graph.AddNodeMultipleParents(equijoin, []dataflow.Operator{leftInput, rightInput}, true)
+	graph.AddOutputOperator(matview, equijoin, true)
+	engine := dataflow.NewDataflowEngine(4, graph)
+	engine.StartEngine()
+	return engine, equijoin, matview
+}
+
+// Left records whose join key is @key, identified by the 0th column from @first
+func makeHotRecords(schema *dataflow.Schema, first uint64, count uint64, key uint64) []*dataflow.Record {
+	var records []*dataflow.Record
+	for i := first; i < first+count; i++ {
+		records = append(records, &dataflow.Record{Schema: schema, Data: []uint64{i, key, 0}})
+	}
+	return records
+}
+
+func TestSkewReport(t *testing.T) {
+	engine, _, _ := makeSkewedJoinEngine()
+	defer engine.Stop(context.Background())
+	leftSchema, _ := makeSchemasForJoin()
+	records := makeHotRecords(leftSchema, 0, 90, 10)
+	records = append(records, makeHotRecords(leftSchema, 90, 10, 11)...)
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+
+	report := engine.GetSkewReport()
+	assert.Equal(t, report.HotKeys[0].Type, dataflow.INPUT)
+	assert.Equal(t, report.HotKeys[0].Key, uint64(10))
+	assert.Equal(t, report.HotKeys[0].Records, int64(90))
+	assert.Equal(t, report.HotKeys[0].Partition, uint64(2))
+	assert.False(t, report.HotKeys[0].Split)
+	assert.Equal(t, report.PartitionLoad[2], int64(90))
+	assert.Equal(t, report.Imbalance, 3.6)
+}
+
+// DESCRIPTION: The hot key remains tracked while more keys than a router
+// tracks replace each other
+func TestSkewReportWithManyKeys(t *testing.T) {
+	engine, _, _ := makeSkewedJoinEngine()
+	defer engine.Stop(context.Background())
+	leftSchema, _ := makeSchemasForJoin()
+	var records []*dataflow.Record
+	for i := uint64(0); i < 300; i++ {
+		records = append(records, makeHotRecords(leftSchema, 2*i, 1, 10)...)
+		records = append(records, makeHotRecords(leftSchema, 2*i+1, 1, 100+i)...)
+	}
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+
+	report := engine.GetSkewReport()
+	assert.Len(t, report.HotKeys, 1)
+	assert.Equal(t, report.HotKeys[0].Key, uint64(10))
+	assert.Equal(t, report.HotKeys[0].Records, int64(300))
+	assert.Equal(t, report.HotKeys[0].Share, 0.5)
+	var load int64
+	for _, partitionLoad := range report.PartitionLoad {
+		load += partitionLoad
+	}
+	assert.Equal(t, load, int64(600))
+}
+
+func TestSplitJoinKey(t *testing.T) {
+	engine, equijoin, matview := makeSkewedJoinEngine()
+	defer engine.Stop(context.Background())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	records := makeHotRecords(leftSchema, 0, 40, 10)
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	right := []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 1}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+
+	split, err := engine.MitigateSkew(0.5)
+	assert.Nil(t, err)
+	assert.Len(t, split, 1)
+	assert.Equal(t, split[0].Key, uint64(10))
+	assert.True(t, engine.GetSkewReport().HotKeys[0].Split)
+	// Splitting again is a no-op
+	assert.Nil(t, engine.SplitJoinKey(equijoin, 10, dataflow.LeftSide))
+
+	// Later left records are spread across partitions, and every match is
+	// emitted exactly once
+	records = makeHotRecords(leftSchema, 40, 40, 10)
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	right = []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 2}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+	assert.Equal(t, engine.SummarizeView(matview).Records, int64(160))
+	for i := uint64(0); i < 80; i++ {
+		assert.Len(t, engine.GetView(i%4, matview).Lookup(i), 2)
+	}
+	report := engine.GetSkewReport()
+	for _, load := range report.PartitionLoad {
+		assert.Greater(t, load, int64(10))
+	}
+
+	// Rescaling merges the key back, without duplicating the replicated
+	// records
+	assert.Nil(t, engine.Rescale(3))
+	right = []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 3}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+	assert.Equal(t, engine.SummarizeView(matview).Records, int64(240))
+}
+
+func TestInvalidSplit(t *testing.T) {
+	engine, nodes, _ := makeMigrationEngine()
+	defer engine.Stop(context.Background())
+
+	// The left input also feeds a view, which relies on its partitioning
+	leftSchema, _ := makeSchemasForJoin()
+	byInput := dataflow.NewMatViewOperator(0)
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(byInput, nodes[0])
+	assert.Nil(t, migration.Commit())
+	records := makeHotRecords(leftSchema, 100, 10, 10)
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	split, err := engine.MitigateSkew(0)
+	assert.Nil(t, err)
+	assert.Len(t, split, 0)
+	err = engine.SplitJoinKey(nodes[2].(*dataflow.EquiJoinOperator), 10, dataflow.LeftSide)
+	assert.ErrorIs(t, err, dataflow.ErrInvalidSplit)
+}
+
+func TestMigrationAfterSplit(t *testing.T) {
+	engine, equijoin, _ := makeSkewedJoinEngine()
+	defer engine.Stop(context.Background())
+	assert.Nil(t, engine.SplitJoinKey(equijoin, 10, dataflow.LeftSide))
+
+	// The inputs route split keys, hence nothing else may consume them
+	migration := engine.NewMigration()
+	migration.AddOutputOperator(dataflow.NewMatViewOperator(0), equijoin.GetCore().GetParents()[1])
+	assert.ErrorIs(t, migration.Commit(), dataflow.ErrInvalidMigration)
+
+	// Views added to the join get an exchange, even if keyed by the join key
+	byKey := dataflow.NewMatViewOperator(1)
+	migration = engine.NewMigration()
+	migration.AddOutputOperator(byKey, equijoin)
+	assert.Nil(t, migration.Commit())
+	leftSchema, rightSchema := makeSchemasForJoin()
+	records := makeHotRecords(leftSchema, 0, 8, 10)
+	assert.Nil(t, engine.ProcessSync("leftTable", &records))
+	right := []*dataflow.Record{{Schema: rightSchema, Data: []uint64{10, 1}}}
+	assert.Nil(t, engine.ProcessSync("rightTable", &right))
+	assert.Len(t, engine.GetView(10%4, byKey).Lookup(10), 8)
+}
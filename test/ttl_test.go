@@ -0,0 +1,154 @@
+package test
+
+import (
+	"context"
+	dataflow "prototype/dataflow"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatviewProcessingTimeTTL(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetTTL(time.Minute))
+	records := makeInputRecords(schema)
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &records, &output)
+
+	assert.Nil(t, matviewOperator.Expire(time.Now()))
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 1)
+	assert.Nil(t, matviewOperator.Expire(time.Now().Add(2*time.Minute)))
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 0)
+	assert.Equal(t, matviewOperator.Summary().Keys, int64(0))
+	assert.Equal(t, matviewOperator.GetExpiredCount(), int64(4))
+}
+
+func TestMatviewColumnTTL(t *testing.T) {
+	colNames := []string{"Col1", "CreatedAt"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetColumnTTL(1, time.Hour))
+	now := time.Now()
+	millis := func(t time.Time) uint64 {
+		return uint64(t.UnixNano() / int64(time.Millisecond))
+	}
+	records := []*dataflow.Record{
+		{Schema: schema, Data: []uint64{1, millis(now.Add(-2 * time.Hour))}},
+		{Schema: schema, Data: []uint64{1, millis(now.Add(-30 * time.Minute))}},
+		{Schema: schema, Data: []uint64{1, millis(now)}},
+	}
+	var output []*dataflow.Record
+	matviewOperator.Process(-1, &records, &output)
+	// Rows that have already expired are not stored
+	assert.Equal(t, len(matviewOperator.Lookup(1)), 2)
+
+	assert.Nil(t, matviewOperator.Expire(now.Add(45*time.Minute)))
+	assert.Equal(t, matviewOperator.Lookup(1), []*dataflow.Record{records[2]})
+}
+
+func TestEngineTTLSweeper(t *testing.T) {
+	colNames := []string{"Col1", "Col2"}
+	schema := &dataflow.Schema{
+		ColumnNames: colNames,
+	}
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetTTL(time.Minute))
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+
+	engine := dataflow.NewDataflowEngine(2, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	records := makeInputRecords(schema)
+	assert.Nil(t, engine.ProcessSync("table1", &records))
+	assert.Nil(t, engine.Expire(time.Now()))
+	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 1)
+	// The partitions sweep their views as they would once the TTL elapses
+	assert.Nil(t, engine.Expire(time.Now().Add(2*time.Minute)))
+	assert.Equal(t, len(engine.GetOutput(0).Lookup(2)), 0)
+	assert.Equal(t, engine.SummarizeView(matviewOperator).Expired, int64(4))
+}
+
+func TestSpilledRowsKeepTheirExpiry(t *testing.T) {
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "Col2"}}
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetTTL(time.Minute))
+	// Enough for a key with two rows, but not for two keys with a row each
+	assert.Nil(t, matviewOperator.SetMemoryLimit(200, dataflow.LRU, dataflow.Spill))
+	var output []*dataflow.Record
+	first := []*dataflow.Record{{Schema: schema, Data: []uint64{1, 10}}}
+	matviewOperator.Process(-1, &first, &output)
+	// Spills key 1
+	other := []*dataflow.Record{{Schema: schema, Data: []uint64{2, 20}}}
+	matviewOperator.Process(-1, &other, &output)
+
+	// Loads key 1 back, along with the expiry of its row, and spills key 2
+	received := time.Now()
+	second := []*dataflow.Record{{Schema: schema, Data: []uint64{1, 11}}}
+	matviewOperator.Process(-1, &second, &output)
+	// Rows received before the second one expire, including spilled ones
+	assert.Nil(t, matviewOperator.Expire(received.Add(time.Minute-time.Nanosecond)))
+	assert.Equal(t, matviewOperator.Lookup(1), second)
+	assert.Empty(t, matviewOperator.Lookup(2))
+	assert.Equal(t, matviewOperator.Summary().SpilledKeys, int64(0))
+
+	assert.Nil(t, matviewOperator.Expire(received.Add(2*time.Minute)))
+	assert.Empty(t, matviewOperator.Lookup(1))
+	assert.Equal(t, matviewOperator.GetExpiredCount(), int64(3))
+}
+
+func TestPartialViewTTL(t *testing.T) {
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "CreatedAt"}}
+	// Rows that expired would be recomputed as if they were just received
+	assert.ErrorIs(t, dataflow.NewPartialMatViewOperator(0).SetTTL(time.Minute), dataflow.ErrUnsupportedOperator)
+
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewPartialMatViewOperator(0)
+	assert.Nil(t, matviewOperator.SetColumnTTL(1, time.Hour))
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+	engine := dataflow.NewDataflowEngine(1, graph)
+	assert.Nil(t, engine.StartEngine())
+	defer engine.Stop(context.Background())
+
+	now := time.Now()
+	millis := func(t time.Time) uint64 {
+		return uint64(t.UnixNano() / int64(time.Millisecond))
+	}
+	records := []*dataflow.Record{
+		{Schema: schema, Data: []uint64{1, millis(now.Add(-2 * time.Hour))}},
+		{Schema: schema, Data: []uint64{1, millis(now)}},
+	}
+	assert.Nil(t, engine.ProcessSync("table1", &records))
+	// The input keeps the expired row, which fills drop
+	assert.Equal(t, engine.GetView(0, matviewOperator).Lookup(1), records[1:])
+	assert.Nil(t, engine.GetView(0, matviewOperator).Evict(1))
+	assert.Equal(t, engine.GetView(0, matviewOperator).Lookup(1), records[1:])
+	assert.Equal(t, engine.GetView(0, matviewOperator).Lookup(1), records[1:])
+}
+
+func TestInvalidTTL(t *testing.T) {
+	schema := &dataflow.Schema{ColumnNames: []string{"Col1", "CreatedAt"}}
+	assert.ErrorIs(t, dataflow.NewMatViewOperator(0).SetTTL(0), dataflow.ErrInvalidArgument)
+	assert.ErrorIs(t, dataflow.NewMatViewOperator(0).SetColumnTTL(1, -time.Hour), dataflow.ErrInvalidArgument)
+
+	inputOperator := dataflow.NewInputOperator("table1", schema)
+	matviewOperator := dataflow.NewMatViewOperator(0)
+	graph := dataflow.NewGraph()
+	graph.AddInputOperator(inputOperator, true)
+	graph.AddOutputOperator(matviewOperator, inputOperator, true)
+	// The view's rows only have two columns
+	assert.ErrorIs(t, matviewOperator.SetColumnTTL(2, time.Hour), dataflow.ErrInvalidArgument)
+	assert.Nil(t, matviewOperator.SetColumnTTL(1, time.Hour))
+}